@@ -70,6 +70,74 @@ func main() {
 		wg.Add(1)
 		go test.Test_1_3_2(serverAddr, &wg)
 		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_1_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_2_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_3_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_4_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_5_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_6_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_7_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_8_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_9_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_10_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_11_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_12_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_13_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_14_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_15_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_16_1(serverAddr, &wg)
+		wg.Wait()
+
+		wg.Add(1)
+		go test.Test_3_17_1(serverAddr, &wg)
+		wg.Wait()
 	}
 
 
@@ -81,6 +149,39 @@ func main() {
 	//wg.Add(1)
 	//go test.Test_2_3_1(serverAddr, &wg)
 	//wg.Wait()
+	// Start the server with -data-dir and restart it during the countdown
+	//wg.Add(1)
+	//go test.Test_4_1_1(serverAddr, &wg)
+	//wg.Wait()
+	// Start the server without -data-dir and restart it during the countdown
+	//wg.Add(1)
+	//go test.Test_4_2_1(serverAddr, &wg)
+	//wg.Wait()
+	// Start the server with -data-dir and -store-chunks and restart it during the countdown
+	//wg.Add(1)
+	//go test.Test_4_3_1(serverAddr, &wg)
+	//wg.Wait()
+	// Start the server with -replicas 2
+	//wg.Add(1)
+	//go test.Test_4_4_1(serverAddr, &wg)
+	//wg.Wait()
+	// Start the server with -replicas 2
+	//wg.Add(1)
+	//go test.Test_4_5_1(serverAddr, &wg)
+	//wg.Wait()
+	// Start a standby with -standby 127.0.0.1:8082 and the server with -backup 127.0.0.1:8082,
+	// then shut the server down during the countdown
+	//wg.Add(1)
+	//go test.Test_4_6_1(serverAddr, &wg)
+	//wg.Wait()
+	// Start the server and two more at 127.0.0.1:8082 and 127.0.0.1:8083, each with its own
+	// -data-dir and -peers listing all three, then shut the leader down during the countdown
+	//wg.Add(1)
+	//go test.Test_4_7_1(serverAddr, &wg)
+	//wg.Wait()
+	//wg.Add(1)
+	//go test.Test_4_8_1(serverAddr, &wg)
+	//wg.Wait()
     // ----------------------------------------------
 
 
@@ -0,0 +1,88 @@
+package dfslib
+
+import (
+	"sync"
+)
+
+// chunkCache remembers which chunks of a mount's local files are known to hold
+// the current version. The server promises a callback on every file the mount
+// opens or reads, and calls DiskService.InvalidateChunk as soon as a newer
+// version of one of its chunks is written, so a cached chunk can be read from
+// the local file without asking the server.
+//
+// The cache is emptied whenever the mount loses (or changes) its server, since
+// callbacks may have been missed in the meantime.
+type chunkCache struct {
+	// versions maps filename to the current version of each cached chunk
+	versions map[string]map[uint64]int
+	// generation counts invalidations, so that a chunk read from the server before
+	// an invalidation arrived is not cached after it
+	generation int
+	lock       sync.Mutex
+}
+
+func newChunkCache() *chunkCache {
+	return &chunkCache{versions: make(map[string]map[uint64]int)}
+}
+
+// currentGeneration is taken before asking the server for a chunk, and passed to put.
+func (cache *chunkCache) currentGeneration() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.generation
+}
+
+// has reports whether the local copy of a chunk is known to be current.
+func (cache *chunkCache) has(filename string, chunkNum uint64) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	_, exists := cache.versions[filename][chunkNum]
+	return exists
+}
+
+// put records that the local copy of a chunk is at version ver, unless the cache
+// was invalidated since generation was taken.
+func (cache *chunkCache) put(filename string, chunkNum uint64, ver int, generation int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if generation != cache.generation {return}
+	chunks, exists := cache.versions[filename]
+	if !exists {
+		chunks = make(map[uint64]int)
+		cache.versions[filename] = chunks
+	}
+	chunks[chunkNum] = ver
+}
+
+// invalidate forgets a chunk now that version ver is current, unless the local
+// copy is already at that version.
+func (cache *chunkCache) invalidate(filename string, chunkNum uint64, ver int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.generation++
+	cached, exists := cache.versions[filename][chunkNum]
+	if exists && cached < ver {delete(cache.versions[filename], chunkNum)}
+}
+
+// forget drops a chunk whose local copy is about to change.
+func (cache *chunkCache) forget(filename string, chunkNum uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	delete(cache.versions[filename], chunkNum)
+}
+
+// forgetFile drops every chunk of a file whose local copy is about to change.
+func (cache *chunkCache) forgetFile(filename string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.generation++
+	delete(cache.versions, filename)
+}
+
+// clear forgets every chunk.
+func (cache *chunkCache) clear() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.generation++
+	cache.versions = make(map[string]map[uint64]int)
+}
@@ -1,6 +1,8 @@
 package dfslib
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net"
 	"regexp"
 	"os"
@@ -9,21 +11,47 @@ import (
 	"time"
 	"log"
 	"strings"
+	"sync"
 )
 
+const HeartbeatPeriod = 2 * time.Second
+
+// DFSConnection is one mount of the DFS. Every mount has its own state, logger,
+// heartbeat and RPC listener, so an application can hold several at once.
 type DFSConnection struct {
 	// Struct fields
-	clientId       int
-	serverAddr     *net.TCPAddr
+	link           *serverLink
 	localAddr      *net.TCPAddr
 	localPath      string
-	rpcClient      *rpc.Client
-	currentMode    FileMode
 	shouldSendPing bool
-	files 		   map[string]*File
+	// files holds every handle opened on this mount that has not been closed
+	files 		   map[*File]bool
+	// waitTickets maps the tickets of pending OpenWithWait calls to their filename
+	waitTickets    map[int]string
+	// cache tracks the chunks of local files the server will call back about
+	cache          *chunkCache
+	// resolver settles conflicting DWRITE writes; nil until set
+	resolver       ConflictResolver
+	// journalLock serializes the updates and replays of the DWRITE journals
+	journalLock    sync.Mutex
+	// diskLock serializes the writes of chunks to the local files, each along with
+	// the update of its version. It is taken after journalLock and before metadataLock.
+	diskLock       sync.Mutex
+	// metadataLock serializes the updates of the local files' version files
+	metadataLock   sync.Mutex
+	logger         *log.Logger
+	// listener accepts the server's RPCs to this mount's DiskService
+	listener       *net.TCPListener
+	serverConns    []net.Conn
+	// stopHeartbeat is closed when the mount is unmounted
+	stopHeartbeat  chan struct{}
+	isUnmounted    bool
+	// lock guards shouldSendPing, isUnmounted, serverConns, files, the files' leases, waitTickets
+	// and resolver
+	lock           sync.Mutex
 }
 
-func (c DFSConnection) LocalFileExists(fname string) (exists bool, err error) {
+func (c *DFSConnection) LocalFileExists(fname string) (exists bool, err error) {
 	if !isFileNameValid(fname) {return false, BadFilenameError(fname)}
 
 	filePath := getFilePath(c.localPath, fname)
@@ -33,32 +61,49 @@ func (c DFSConnection) LocalFileExists(fname string) (exists bool, err error) {
 	return e == nil, nil
 }
 
-func (c DFSConnection) GlobalFileExists(fname string) (exists bool, err error) {
+func (c *DFSConnection) GlobalFileExists(fname string) (exists bool, err error) {
 	if !isFileNameValid(fname) {return false, BadFilenameError(fname)}
 	if !c.isConnected() {
 		c.closeFile(fname)
-		return false, DisconnectedError(c.serverAddr.String())
+		return false, DisconnectedError(c.link.addr().String())
 	}
 
 	args := shared.FileExistsRequest{Filename: fname}
 	var fileExistsReply bool
-	err = c.rpcClient.Call("Server.CheckFileExists", args, &fileExistsReply)
+	err = c.link.client().Call("Server.CheckFileExists", args, &fileExistsReply)
 	return fileExistsReply, nil
 }
 
-func (c DFSConnection) Open(fname string, mode FileMode) (f DFSFile, err error) {
+func (c *DFSConnection) Open(fname string, mode FileMode) (f DFSFile, err error) {
+	return c.open(fname, mode, shared.WholeFile)
+}
+
+func (c *DFSConnection) OpenRange(fname string, firstChunk uint64, lastChunk uint64) (f DFSFile, err error) {
+	chunks := shared.ChunkRange{First: firstChunk, Last: lastChunk}
+	if !chunks.IsValid() {return nil, BadChunkRangeError(chunks)}
+	return c.open(fname, WRITE, chunks)
+}
+
+// open opens a file, locking chunks of it in WRITE mode.
+func (c *DFSConnection) open(fname string, mode FileMode, chunks shared.ChunkRange) (f DFSFile, err error) {
 	if !isFileNameValid(fname) {return nil, BadFilenameError(fname)}
 
-	c.currentMode = mode
+	if mode == DWRITE {
+		if exists, _ := c.LocalFileExists(fname); !exists {
+			// Replayed chunks must be of the chunk size the server knows the file by
+			c.createLocalEmptyFile(fname, c.serverLayout(fname))
+		}
+		return c.createFileInstance(fname, mode, shared.UnsetHandleId, chunks, c.localLayout(fname))
+	}
 
 	if !c.isConnected() {
 		if mode == READ || mode == WRITE {
 			c.closeFile(fname)
-			return nil, DisconnectedError(c.serverAddr.String())
+			return nil, DisconnectedError(c.link.addr().String())
 		} else {
 			exists, _ := c.LocalFileExists(fname)
 			if exists {
-				return c.createFileInstance(fname, true)
+				return c.createFileInstance(fname, mode, shared.UnsetHandleId, chunks, c.localLayout(fname))
 			} else {
 				return nil, FileDoesNotExistError(fname)
 			}
@@ -66,84 +111,185 @@ func (c DFSConnection) Open(fname string, mode FileMode) (f DFSFile, err error)
 	}
 
 	openFileReq := shared.OpenFileRequest{
-		ClientId: c.clientId,
+		ClientId: c.link.getClientId(),
 		Filename: fname,
 		Mode:     convertMode(mode),
+		Chunks:   chunks,
 	}
 	var resp shared.OpenFileResponse
-	err = c.rpcClient.Call("Server.OpenFile", openFileReq, &resp)
+	openedAt := time.Now()
+	generation := c.cache.currentGeneration()
+	err = c.link.client().Call("Server.OpenFile", openFileReq, &resp)
 
 	if err != nil {
 		if mode == READ || mode == WRITE {
 			c.closeFile(fname)
-			return nil, DisconnectedError(c.serverAddr.String())
+			return nil, DisconnectedError(c.link.addr().String())
 		} else {
-			return c.createFileInstance(fname, true)
+			return c.createFileInstance(fname, mode, shared.UnsetHandleId, chunks, c.localLayout(fname))
 		}
 	}
 
 	if resp.UnavailableError {
-		log.Printf("Error: File is unavailable: [%s]\n", fname)
+		c.logger.Printf("Error: File is unavailable: [%s]\n", fname)
 		return nil, FileUnavailableError(fname)
 	}
 	if resp.ConflictError {
-		log.Printf("Error: Write conflict: [%s]\n", fname)
-		return nil, OpenWriteConflictError(fname)
+		c.logger.Printf("Error: Write conflict: [%s]\n", fname)
+		return nil, newWriteConflictError(fname, resp.Conflict)
 	}
 
-	c.createLocalEmptyFile(fname)
+	return c.openFromResponse(fname, mode, chunks, &resp, openedAt, generation)
+}
 
-	WriteChunksToDisk(resp.Chunks, getFilePath(c.localPath, fname))
+// openFromResponse stores the chunks the server sent for an opened file and
+// returns its handle. In WRITE mode, the lease is counted from grantedAt. The
+// chunks are cached unless invalidated since generation was taken.
+func (c *DFSConnection) openFromResponse(fname string, mode FileMode, chunks shared.ChunkRange,
+	resp *shared.OpenFileResponse, grantedAt time.Time, generation int) (f DFSFile, err error) {
+	layout := resp.Layout
+	if !layout.IsValid() {layout = shared.DefaultLayout}
+	c.createLocalEmptyFile(fname, layout)
+	c.recordFileId(fname, resp.FileId)
+
+	err = c.writeChunksToDisk(resp.Chunks, getFilePath(c.localPath, fname))
+	if err == nil {
+		for _, chunk := range resp.Chunks {
+			c.cache.put(fname, chunk.ChunkNum, chunk.Version, generation)
+		}
+	}
 
-	return c.createFileInstance(fname, true)
+	file, err := c.createFileInstance(fname, mode, resp.HandleId, chunks, layout)
+	if err != nil {return nil, err}
+	if mode == WRITE {file.grantLease(resp.Lease, grantedAt)}
+	return file, nil
 }
 
-func (c DFSConnection) UMountDFS() (err error) {
+func (c *DFSConnection) CreateFile(fname string, chunkSize int, numChunks uint64) (err error) {
+	if !isFileNameValid(fname) {return BadFilenameError(fname)}
+	layout := shared.FileLayout{ChunkSize: chunkSize, NumChunks: numChunks}
+	if !layout.IsValid() {
+		if chunkSize > 0 && chunkSize <= shared.MaxChunkSize {return BadChunkNumError(numChunks - 1)}
+		return BadChunkSizeError(chunkSize)
+	}
+	if !c.isConnected() {return DisconnectedError(c.link.addr().String())}
+
+	req := shared.CreateFileRequest{Filename: fname, Layout: layout}
+	var resp shared.CreateFileResponse
+	err = c.link.client().Call("Server.CreateFile", req, &resp)
+	if err != nil {return DisconnectedError(c.link.addr().String())}
+	if resp.Layout.ChunkSize != chunkSize {
+		c.logger.Printf("Error: file [%s] exists with chunk size [%d]\n", fname, resp.Layout.ChunkSize)
+		return FileExistsError(fname)
+	}
+
+	c.createLocalEmptyFile(fname, resp.Layout)
+	c.recordFileId(fname, resp.FileId)
+	return nil
+}
+
+// Describe the lock that kept a client from writing to fname
+func newWriteConflictError(fname string, conflict shared.LockInfo) OpenWriteConflictError {
+	return OpenWriteConflictError{
+		Filename:      fname,
+		LockHolder:    conflict.ClientId,
+		HolderAddress: conflict.ClientAddress,
+		Since:         conflict.Since,
+		IsWaiting:     conflict.IsWaiting,
+	}
+}
+
+func (c *DFSConnection) UMountDFS() (err error) {
 
 	c.closeAllFiles()
+	defer c.stop()
 
 	if !c.isConnected() {
-		log.Println("UMountDFS called but client is disconnected.")
+		c.logger.Println("UMountDFS called but client is disconnected.")
 		return nil
 	}
 
 	req := shared.ClientRegistrationRequest{
-		ClientId: c.clientId,
+		ClientId: c.link.getClientId(),
 		ClientAddress: c.localAddr.String(),
 		LatestHeartbeat: time.Now().UTC(),
 	}
 	var resp int
-	err = c.rpcClient.Call("Server.DisconnectClient", req, &resp)
+	server := c.link.client()
+	err = server.Call("Server.DisconnectClient", req, &resp)
 
-	if resp == c.clientId {
-		log.Printf("Client [%d] unmounting\n", c.clientId)
-		c.shouldSendPing = false
-		c.rpcClient.Close()
+	if resp == req.ClientId {
+		c.logger.Printf("Client [%d] unmounting\n", req.ClientId)
+		server.Close()
 		return nil
 	} else {
-		log.Printf("Client [%d] cannot unmount, already disconnected from server\n", c.clientId)
-		c.shouldSendPing = false
-		c.rpcClient.Close()
-		return DisconnectedError(c.serverAddr.String())
+		c.logger.Printf("Client [%d] cannot unmount, already disconnected from server\n", req.ClientId)
+		server.Close()
+		return DisconnectedError(c.link.addr().String())
+	}
+}
+
+// stop ends the heartbeat and stops serving the server's RPCs. Safe to call more than once.
+func (c *DFSConnection) stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.shouldSendPing = false
+	c.cache.clear()
+	if c.isUnmounted {return}
+	c.isUnmounted = true
+	close(c.stopHeartbeat)
+	if c.listener != nil {c.listener.Close()}
+	for _, conn := range c.serverConns {
+		conn.Close()
 	}
 }
 
 func (c *DFSConnection) closeAllFiles() {
-	log.Println("Closing all files")
-	for _, file := range c.files {
+	c.logger.Println("Closing all files")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for file := range c.files {
 		file.isOpen = false
 	}
+	c.files = make(map[*File]bool)
 }
 
+// closeFile marks every open handle on filename as closed, except those that
+// do not need the server (in DREAD and DWRITE modes).
 func (c *DFSConnection) closeFile(filename string) error {
-	_, exists := c.files[filename]
-	if !exists {
-		log.Printf("Error: close file that does not exist [%s]\n", filename)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	closed := false
+	for file := range c.files {
+		if file.filename != filename || file.mode == DREAD || file.mode == DWRITE {continue}
+		file.isOpen = false
+		delete(c.files, file)
+		closed = true
+	}
+	if !closed {
+		c.logger.Printf("Error: close file that does not exist [%s]\n", filename)
 		return FileDoesNotExistError(filename)
-	} else {
-		log.Printf("Closing file [%s]\n", filename)
-		c.files[filename].isOpen = false
-		return nil
+	}
+	c.logger.Printf("Closing file [%s]\n", filename)
+	return nil
+}
+
+// forgetFile marks a handle closed and removes it from the mount's open files.
+func (c *DFSConnection) forgetFile(file *File) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	file.isOpen = false
+	delete(c.files, file)
+}
+
+// renewLeases extends the write leases of the open files, after the server
+// acknowledged a heartbeat sent at sentAt. Leases that have already lapsed stay lapsed.
+func (c *DFSConnection) renewLeases(sentAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for file := range c.files {
+		if file.mode != WRITE || !time.Now().Before(file.leaseExpiry) {continue}
+		file.leaseExpiry = sentAt.Add(file.lease.Duration)
 	}
 }
 
@@ -153,138 +299,188 @@ func (c *DFSConnection) closeFile(filename string) error {
 // ^ todo - it should not fail on connection issue
 func (c *DFSConnection) Connect() error {
 
-	server, err := rpc.Dial("tcp", c.serverAddr.String())
+	server, err := c.link.dial()
 	if err != nil {
-		if c.currentMode == DREAD {
-			log.Printf("Cannot reach server, continuing in disconnected mode.\n")
-			return nil
-		}
-		log.Println("Error connecting to server")
-		return err
+		// Files can still be opened in DREAD mode
+		c.logger.Printf("Cannot reach server, continuing in disconnected mode.\n")
+		return nil
 	}
 
 	// Establish bi-directional RPC connection
 	tcpAddr := c.acceptServerRPC()
 	c.localAddr, err = net.ResolveTCPAddr("tcp", tcpAddr)
 	if err != nil {
-		log.Println("Error ")
+		c.logger.Println("Error ")
 		return err
 	}
 
+	registered, err := c.registerWithLeader(server)
+	if !registered {return err}
 
+	// Start sending heartbeat to server
+	c.setShouldSendPing(true)
+	go c.sendHeartbeat()
+
+	// Writes made while disconnected can now be replayed
+	c.reconcileAll()
+
+	return nil
+}
+
+// register identifies this client to a newly dialed server, which is then used
+// for all further calls. Returns false if the server did not accept the client.
+func (c *DFSConnection) register(server *rpc.Client) (registered bool, err error) {
 	cidFromDisk, err := c.getClientIdFromDisk()
 	if err != nil {
-		log.Println("Error retrieving client ID from disk")
-		return err
+		c.logger.Println("Error retrieving client ID from disk")
+		return false, err
 	}
 
 	args := shared.ClientRegistrationRequest{
 		ClientId: cidFromDisk,
 		ClientAddress: c.localAddr.String(),
 		LatestHeartbeat: time.Now().UTC(),
+		Inventory: c.buildInventory(),
 		}
 
-	var cidResponse int
+	var resp shared.ClientRegistrationResponse
+
+	err = server.Call("Server.RegisterClient", args, &resp)
+	if err != nil {return false, err}
+	cidResponse := resp.ClientId
+	if cidResponse == shared.UnsetClientId {return false, nil}
 
-	err = server.Call("Server.RegisterClient", args, &cidResponse)
-	if cidResponse == shared.UnsetClientId || err != nil {return err}
+	for _, conflict := range resp.Conflicts {
+		c.logger.Printf("Conflict: file [%s] chunk [%d] is at ver [%d] locally but the server had ver [%d]\n",
+			conflict.Filename, conflict.ChunkNum, conflict.LocalVersion, conflict.ServerVersion)
+		// The server never committed the local version, so the local copy is not taken for it
+		chunk := shared.Chunk{ChunkNum: conflict.ChunkNum}
+		err = c.forgetChunkVersions(getFilePath(c.localPath, conflict.Filename), []shared.Chunk{chunk})
+		if err != nil {c.logger.Println(err)}
+	}
+	// Files deleted, renamed or truncated while this client was away
+	for _, change := range resp.Changes {
+		c.applyFileChange(change)
+	}
 
 	if cidFromDisk == UnsetClientID {
 		c.storeClientIdToDisk(cidResponse)
 	}
+	// The server has not promised this client any callbacks yet
+	c.cache.clear()
 
-	c.rpcClient = server
-	c.clientId = cidResponse
+	c.link.setRegistration(server, cidResponse)
 
-
-	// Start sending heartbeat to server
-	c.shouldSendPing = true
-	go c.sendHeartbeat()
-
-	return nil
+	return true, nil
 }
 
 
 // acceptServerRPC listens for RPC calls from server
 func (c *DFSConnection) acceptServerRPC() (ipAddr string) {
-	diskService := DiskService{c: *c}
+	diskService := DiskService{c: c}
 
 	server := rpc.NewServer()
 	server.Register(&diskService)
 
-	log.Printf("LocalAddr: %s\n", c.localAddr.String())
+	c.logger.Printf("LocalAddr: %s\n", c.localAddr.String())
 
 	a, e :=net.ResolveTCPAddr("tcp", c.localAddr.String())
 
 	if e != nil {
-		log.Println("Error resolving IP address")
-		log.Println(e)
+		c.logger.Println("Error resolving IP address")
+		c.logger.Println(e)
 		return
 	}
 
 	tcpListener, err := net.ListenTCP("tcp", a)
+	if err != nil {
+		c.logger.Println("Error accepting server RPC")
+		c.logger.Println(err)
+		return
+	}
+	c.listener = tcpListener
 
 	ipAddr = tcpListener.Addr().String()
 
-	log.Printf("tcpListner addr: [%s]\n", ipAddr)
+	c.logger.Printf("tcpListner addr: [%s]\n", ipAddr)
 
 	go func() {
-		if err == nil {
-			log.Printf("Listening for server RPC calls at client address [%s]\n", ipAddr)
-			for {
-				conn, err := tcpListener.Accept()
-				if err != nil {
-					log.Printf("Error: failed to start server at [%s]\n", ipAddr)
-					return
-				}
-				log.Printf("Client at [%s] accepted connection from [%s]", ipAddr, conn.RemoteAddr())
-				go server.ServeConn(conn)
+		c.logger.Printf("Listening for server RPC calls at client address [%s]\n", ipAddr)
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				// The listener is closed on unmount
+				c.logger.Printf("Stopped listening for server RPC calls at [%s]\n", ipAddr)
+				return
 			}
-		} else {
-			log.Println("Failed to start server")
-			log.Println(err)
+			c.logger.Printf("Client at [%s] accepted connection from [%s]", ipAddr, conn.RemoteAddr())
+			c.lock.Lock()
+			c.serverConns = append(c.serverConns, conn)
+			c.lock.Unlock()
+			go server.ServeConn(conn)
 		}
 	}()
 
-	if err != nil {
-		log.Println("Error accepting server RPC")
-		log.Println(err)
-		return
-	} else {
-		return
-	}
+	return
 }
 
+// sendHeartbeat pings the server every HeartbeatPeriod until the mount is unmounted.
 func (c *DFSConnection) sendHeartbeat() {
 	for {
-		if c.shouldSendPing {
+		if c.getShouldSendPing() {
 			c.PingServer()
 		}
-		time.Sleep(2 * time.Second)
+		select {
+		case <-c.stopHeartbeat:
+			return
+		case <-time.After(HeartbeatPeriod):
+		}
 	}
 }
 
+func (c *DFSConnection) getShouldSendPing() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.shouldSendPing
+}
+
+func (c *DFSConnection) setShouldSendPing(shouldSendPing bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.shouldSendPing = shouldSendPing && !c.isUnmounted
+	// Callbacks are missed while disconnected
+	if !c.shouldSendPing {c.cache.clear()}
+}
+
 func (c *DFSConnection) isConnected() bool {
-	return c.shouldSendPing && c.PingServer() > 0
+	return c.getShouldSendPing() && c.PingServer() > 0
 }
 
 // PingServer sends heartbeats to the server to keep the connection alive
 func (c *DFSConnection) PingServer() int {
 
-	args := shared.ClientHeartbeat{ClientId: c.clientId, Timestamp: time.Now().UTC()}
+	sentAt := time.Now()
+	server, clientId := c.link.client(), c.link.getClientId()
+	args := shared.ClientHeartbeat{ClientId: clientId, Timestamp: sentAt.UTC()}
 	var pingReply int
-	err := c.rpcClient.Call("Server.PingServer", args, &pingReply)
-	if err != nil {
-		log.Println("Server stopped responding")
-		c.shouldSendPing = false
-		c.rpcClient.Close()
-		return 0
-	} else if pingReply != c.clientId {
-		log.Printf("Server rejected ping for client %d", c.clientId)
-		c.shouldSendPing = false
-		c.rpcClient.Close()
+	err := server.Call("Server.PingServer", args, &pingReply)
+	if err != nil || pingReply != clientId {
+		if err != nil {
+			c.logger.Println("Server stopped responding")
+		} else {
+			c.logger.Printf("Server rejected ping for client %d", clientId)
+		}
+		server.Close()
+		if c.failover(server) {
+			// Registering with the new server renewed the leases
+			c.renewLeases(sentAt)
+			return c.link.getClientId()
+		}
+		c.setShouldSendPing(false)
 		return 0
 	}
+	// The server renews this client's leases on every heartbeat
+	c.renewLeases(sentAt)
 	return pingReply
 }
 
@@ -315,29 +511,114 @@ func convertMode(mode FileMode) shared.FileMode {
 }
 
 // Create a file on disk filled with zeros, if a file does not exist already.
-// Does nothing if the file already exists.
-func (c *DFSConnection) createLocalEmptyFile(filename string) {
+// Does nothing if the file already exists. A chunk size other than the default
+// is recorded in a layout file next to it.
+func (c *DFSConnection) createLocalEmptyFile(filename string, layout shared.FileLayout) {
 	filePath := getFilePath(c.localPath, filename)
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
+		if layout.ChunkSize != shared.BytesPerChunk {
+			err = writeFileHeader(filePath, fileHeader{ChunkSize: layout.ChunkSize})
+			if err != nil {
+				c.logger.Printf("Error: cannot write layout of file %s\n", filename)
+			}
+		}
 		f, err := os.Create(filePath)
 		if err != nil {
-			log.Printf("Error: cannot create file %s\n", filename)
+			c.logger.Printf("Error: cannot create file %s\n", filename)
+			return
 		}
-		emptyArr := make([]byte, shared.BytesPerChunk * shared.ChunksPerFile)
-		_, err = f.WriteAt(emptyArr, 0)
+		err = f.Truncate(getByteOffset(layout.NumChunks, layout.ChunkSize))
 		if err != nil {
-			log.Printf("Error: cannot write to file %s\n", filename)
+			c.logger.Printf("Error: cannot write to file %s\n", filename)
 		}
 		f.Close()
 	}
 }
 
-func (c DFSConnection) createFileInstance(filename string, isConnected bool) (f *File, err error) {
+// localLayout returns the layout of the local copy of a file. Its chunk size
+// is read from the layout file, if any, and its chunk count from its size.
+func (c *DFSConnection) localLayout(filename string) shared.FileLayout {
+	filePath := getFilePath(c.localPath, filename)
+	layout := shared.DefaultLayout
+	layout.ChunkSize = readFileHeader(filePath).ChunkSize
+	info, err := os.Stat(filePath)
+	if err != nil {return layout}
+	size := uint64(layout.ChunkSize)
+	layout.NumChunks = (uint64(info.Size()) + size - 1) / size
+	return layout
+}
+
+// serverLayout returns the layout of a file as the server knows it, or the
+// default layout if the server does not know it or cannot be reached.
+func (c *DFSConnection) serverLayout(filename string) shared.FileLayout {
+	stat, err := c.Stat(filename)
+	if err != nil {return shared.DefaultLayout}
+	return shared.FileLayout{ChunkSize: stat.ChunkSize, NumChunks: stat.NumChunks}
+}
+
+// fileHeader is what the layout file of a local file records about it. Files
+// without one have the default chunk size and an unknown ID.
+type fileHeader struct {
+	ChunkSize int
+	// FileId is the server's ID of the file the local copy was taken from
+	FileId uint64
+}
+
+// readFileHeader reads the layout file of the local file at filePath.
+func readFileHeader(filePath string) fileHeader {
+	header := fileHeader{ChunkSize: shared.BytesPerChunk, FileId: shared.UnsetFileId}
+	data, err := ioutil.ReadFile(getLayoutFilePath(filePath))
+	if err != nil {return header}
+	var recorded fileHeader
+	if json.Unmarshal(data, &recorded) != nil {return header}
+	if (shared.FileLayout{ChunkSize: recorded.ChunkSize}).IsValid() {header.ChunkSize = recorded.ChunkSize}
+	header.FileId = recorded.FileId
+	return header
+}
+
+// writeFileHeader replaces the layout file of the local file at filePath.
+func writeFileHeader(filePath string, header fileHeader) error {
+	data, err := json.Marshal(header)
+	if err != nil {return err}
+	return writeFileAtomically(getLayoutFilePath(filePath), data)
+}
+
+// localFileId returns the ID of the file the local copy of filename was taken
+// from, or shared.UnsetFileId if it is not known.
+func (c *DFSConnection) localFileId(filename string) uint64 {
+	return readFileHeader(getFilePath(c.localPath, filename)).FileId
+}
+
+// recordFileId records that the local copy of filename was taken from the file
+// with ID fileId. Nothing is recorded if the file is not held locally.
+func (c *DFSConnection) recordFileId(filename string, fileId uint64) {
+	if fileId == shared.UnsetFileId {return}
+	c.metadataLock.Lock()
+	defer c.metadataLock.Unlock()
+	filePath := getFilePath(c.localPath, filename)
+	if _, err := os.Stat(filePath); err != nil {return}
+	header := readFileHeader(filePath)
+	if header.FileId == fileId {return}
+	header.FileId = fileId
+	err := writeFileHeader(filePath, header)
+	if err != nil {c.logger.Printf("Error: cannot write layout of file %s\n", filename)}
+}
+
+// Returns the path of the file recording the layout of the file at filePath
+func getLayoutFilePath(filePath string) string {
+	return strings.TrimSuffix(filePath, shared.FileExtension) + LayoutFileExtension
+}
+
+func (c *DFSConnection) createFileInstance(filename string, mode FileMode, handleId int,
+	chunks shared.ChunkRange, layout shared.FileLayout) (f *File, err error) {
 	if !isFileNameValid(filename) {return nil, BadFilenameError(filename)}
 
-	f = &File{filename, &c, true}
-	c.files[filename] = f
+	f = &File{filename: filename, c: c, isOpen: true, mode: mode, handleId: handleId, chunks: chunks,
+		layout: layout}
+	c.lock.Lock()
+	c.files[f] = true
+	c.lock.Unlock()
 	return
 }
 
@@ -350,6 +631,8 @@ func getFilePath(localPath string, filename string) string {
 	}
 }
 
-func getByteOffsetFromChunkNum(chunkNum uint8) int64 {
-	return int64(chunkNum) * int64(shared.BytesPerChunk)
+// Returns the offset of a chunk in a file with chunks of chunkSize bytes. Chunk
+// numbers are checked against the layout's MaxChunks first, so it cannot overflow.
+func getByteOffset(chunkNum uint64, chunkSize int) int64 {
+	return int64(chunkNum) * int64(chunkSize)
 }
\ No newline at end of file
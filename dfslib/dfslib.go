@@ -14,10 +14,15 @@ import (
 	"net"
 	"log"
 	"../shared"
+	"io"
 	"io/ioutil"
+	"strings"
+	"time"
 )
 
-// A Chunk is the unit of reading/writing in DFS.
+// A Chunk is the unit of reading/writing in DFS files with the default chunk
+// size. Files created with another chunk size are read and written with
+// ReadChunk and WriteChunk.
 type Chunk [32]byte
 
 // Represents a type of file access.
@@ -32,12 +37,122 @@ const (
 
 	// Disconnected read mode.
 	DREAD
+
+	// Disconnected write mode. Writes are made to the local copy and
+	// journaled, then replayed against the server later.
+	DWRITE
 )
 
-// todo - turn off logs
+// How current a chunk read from a file is.
+type Freshness int
+
+const (
+	// The chunk is the current version: it was read from the server, or
+	// the server promised to call back when it changes.
+	Fresh Freshness = iota
+
+	// No newer version is known, but the server did not confirm the
+	// chunk is current.
+	PossiblyStale
+
+	// The server reported a newer version than the chunk.
+	KnownStale
+)
+
+// A ChunkStatus describes a chunk returned by ReadWithStatus.
+type ChunkStatus struct {
+	Freshness Freshness
+	// LocalVersion is the version read, NoVersion if it is unknown
+	LocalVersion int
+	// LatestVersion is the newest version the server reported, NoVersion if none
+	LatestVersion int
+	// SyncedAt is when the server last confirmed LocalVersion was current; zero if never
+	SyncedAt time.Time
+}
+
+// A FileStat describes a file as the server knows it, returned by Stat.
+type FileStat struct {
+	Filename  string
+	ChunkSize int
+	NumChunks uint64
+	// ChunkVersions maps every chunk that has been written to its current
+	// version; its length is the number of chunks ever written
+	ChunkVersions map[uint64]int
+	// LastWriter is the client that last wrote to the file, UnsetClientID if unknown
+	LastWriter int
+	// LastModified is when the file was last written to; zero if unknown
+	LastModified time.Time
+	// LockHolders holds the clients with a write lock on part of the file
+	LockHolders []LockHolder
+	// AvailableChunks is how many of the written chunks have an online owner
+	// of their current version, or are kept by a server started with
+	// -store-chunks. Opening the file in READ or WRITE mode fails with
+	// FileUnavailableError if none is available.
+	AvailableChunks int
+}
+
+// A LocalFileStat describes the local copy of a file, as read in DREAD mode,
+// returned by ListLocalFiles.
+type LocalFileStat struct {
+	Filename  string
+	ChunkSize int
+	NumChunks uint64
+	// ChunkVersions maps every chunk held locally at a known version to it
+	ChunkVersions map[uint64]int
+	// StaleChunks is how many chunks the server reported a newer version of
+	StaleChunks int
+	// PendingChunks is how many chunks were written in DWRITE mode and not
+	// replayed yet
+	PendingChunks int
+}
+
+// A LockHolder is a client holding a write lock on chunks of a file.
+type LockHolder struct {
+	ClientId int
+	Address  string
+	Chunks   []shared.ChunkRange
+	// Since is when the client acquired the lock
+	Since time.Time
+}
+
+// How a conflicting DWRITE write is settled.
+type Resolution int
+
+const (
+	// Write the journaled chunk over the current version.
+	KeepMine Resolution = iota
+
+	// Drop the journaled chunk and keep the current version.
+	KeepTheirs
+
+	// Write the merged chunk returned by the resolver over the current version.
+	Merge
+)
+
+// A WriteConflict is a chunk written in DWRITE mode whose version on the server
+// moved on from the one the write was based on (NoVersion if the chunk had
+// never been written to).
+type WriteConflict struct {
+	Filename     string
+	ChunkNum     uint64
+	Mine         []byte
+	Theirs       []byte
+	BaseVersion  int
+	TheirVersion int
+}
+
+// A ConflictResolver settles a conflict, returning the merged chunk with Merge.
+// The merged chunk is padded with zeros or cut to the file's chunk size.
+type ConflictResolver func(conflict WriteConflict) (resolution Resolution, merged []byte)
+
+// LoggingOn sends each mount's log to stderr, prefixed with the mount's local path.
 const LoggingOn = false
 const UnsetClientID = -1
+const NoVersion = shared.NoVersion
 const ClientIdFileName = "clientInfo.txt"
+const VersionFileExtension = ".ver"
+const JournalFileExtension = ".journal"
+const LayoutFileExtension = ".layout"
 
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <ERROR DEFINITIONS>
@@ -58,17 +173,34 @@ func (e DisconnectedError) Error() string {
 }
 
 // Contains chunkNum that is unavailable
-type ChunkUnavailableError uint8
+type ChunkUnavailableError uint64
 
 func (e ChunkUnavailableError) Error() string {
-	return fmt.Sprintf("DFS: Latest verson of chunk [%s] unavailable", string(e))
+	return fmt.Sprintf("DFS: Latest verson of chunk [%d] unavailable", uint64(e))
 }
 
-// Contains filename
-type OpenWriteConflictError string
+// Contains filename, and the client holding (or waiting for) the lock that conflicted
+type OpenWriteConflictError struct {
+	Filename string
+	// LockHolder is UnsetClientID if the lock was released before it could be described
+	LockHolder    int
+	HolderAddress string
+	// Since is when the holder acquired the lock, or started waiting for it
+	Since time.Time
+	// IsWaiting is set if the holder does not hold the lock yet but is waiting for it ahead of this client
+	IsWaiting bool
+}
 
 func (e OpenWriteConflictError) Error() string {
-	return fmt.Sprintf("DFS: Filename [%s] is opened for writing by another client", string(e))
+	if e.LockHolder == UnsetClientID {
+		return fmt.Sprintf("DFS: Filename [%s] is opened for writing by another client", e.Filename)
+	}
+	if e.IsWaiting {
+		return fmt.Sprintf("DFS: Filename [%s] is awaited for writing by client [%d] at [%s] since %s",
+			e.Filename, e.LockHolder, e.HolderAddress, e.Since.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("DFS: Filename [%s] is opened for writing by client [%d] at [%s] since %s",
+		e.Filename, e.LockHolder, e.HolderAddress, e.Since.Format(time.RFC3339))
 }
 
 // Contains file mode that is bad.
@@ -85,6 +217,49 @@ func (e WriteModeTimeoutError) Error() string {
 	return fmt.Sprintf("DFS: Write access to filename [%s] has timed out; reopen the file", string(e))
 }
 
+// Contains chunkNum that is outside the range locked by the file
+type ChunkNotLockedError uint64
+
+func (e ChunkNotLockedError) Error() string {
+	return fmt.Sprintf("DFS: Chunk [%d] is outside the range locked when the file was opened", uint64(e))
+}
+
+// Contains the chunk size that is bad
+type BadChunkSizeError int
+
+func (e BadChunkSizeError) Error() string {
+	return fmt.Sprintf("DFS: Chunk size [%d] is not the file's chunk size, or not between 1 and %d bytes",
+		int(e), shared.MaxChunkSize)
+}
+
+// Contains the chunk number that is past the largest file size
+type BadChunkNumError uint64
+
+func (e BadChunkNumError) Error() string {
+	return fmt.Sprintf("DFS: Chunk [%d] is past the largest file size of %d bytes", uint64(e), shared.MaxFileSize)
+}
+
+// Contains the range of chunks that is empty
+type BadChunkRangeError shared.ChunkRange
+
+func (e BadChunkRangeError) Error() string {
+	return fmt.Sprintf("DFS: Chunk range [%d, %d] is empty", e.First, e.Last)
+}
+
+// Contains filename
+type OpenWaitTimeoutError string
+
+func (e OpenWaitTimeoutError) Error() string {
+	return fmt.Sprintf("DFS: Timed out waiting to open filename [%s] for writing", string(e))
+}
+
+// Contains filename
+type OpenWaitCancelledError string
+
+func (e OpenWaitCancelledError) Error() string {
+	return fmt.Sprintf("DFS: Stopped waiting to open filename [%s] for writing", string(e))
+}
+
 // Contains filename
 type BadFilenameError string
 
@@ -106,6 +281,27 @@ func (e LocalPathError) Error() string {
 	return fmt.Sprintf("DFS: Cannot access local path [%s]", string(e))
 }
 
+// Contains filename
+type FileExistsError string
+
+func (e FileExistsError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] already exists", string(e))
+}
+
+// Contains filename
+type FileNotFoundError string
+
+func (e FileNotFoundError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] does not exist on the server", string(e))
+}
+
+// Contains the pattern that is malformed
+type BadPatternError string
+
+func (e BadPatternError) Error() string {
+	return fmt.Sprintf("DFS: Pattern [%s] is malformed", string(e))
+}
+
 // Contains filename
 type FileDoesNotExistError string
 
@@ -124,19 +320,77 @@ type DFSFile interface {
 	// Can return the following errors:
 	// - DisconnectedError (in READ,WRITE modes)
 	// - ChunkUnavailableError (in READ,WRITE modes)
+	// - BadChunkSizeError (if the file's chunks are not 32 bytes long)
 	Read(chunkNum uint8, chunk *Chunk) (err error)
 
+	// Reads chunk number chunkNum into chunk, which must be ChunkSize()
+	// bytes long. Chunks past the end of the file read as zeros.
+	//
+	// Can return the errors of Read, and:
+	// - BadChunkNumError (if the chunk is past shared.MaxFileSize)
+	ReadChunk(chunkNum uint64, chunk []byte) (err error)
+
+	// Reads a chunk like ReadChunk, and describes how current it is. In READ
+	// and WRITE modes chunks are always Fresh; in DREAD and DWRITE modes
+	// the local copy is returned along with what is known of newer versions.
+	//
+	// Can return the errors of Read.
+	ReadWithStatus(chunkNum uint64, chunk []byte) (status ChunkStatus, err error)
+
 	// Writes chunk number chunkNum from storage pointed to by
 	// chunk. Returns a non-nil error if the write was unsuccessful.
 	//
 	// Can return the following errors:
 	// - BadFileModeError (in READ,DREAD modes)
-	// - DisconnectedError (in WRITE mode)
+	// - DisconnectedError (in WRITE mode, or DWRITE once closed)
 	// - WriteModeTimeoutError (in WRITE mode)
+	// - ChunkNotLockedError (in WRITE mode, if opened with OpenRange)
+	// - BadChunkSizeError (if the file's chunks are not 32 bytes long)
 	Write(chunkNum uint8, chunk *Chunk) (err error)
 
-	// Closes the file/cleans up. Can return the following errors:
+	// Writes chunk, which must be ChunkSize() bytes long, to chunk number
+	// chunkNum. Writing past the end of the file grows it, up to
+	// shared.MaxFileSize bytes.
+	//
+	// Can return the errors of Write, and:
+	// - BadChunkNumError (if the chunk is past shared.MaxFileSize)
+	WriteChunk(chunkNum uint64, chunk []byte) (err error)
+
+	// Returns the size of the file's chunks in bytes.
+	ChunkSize() int
+
+	// Returns the number of chunks in the file, as known to this handle.
+	NumChunks() uint64
+
+	// Turns write-back buffering on or off; it is off when a file is
+	// opened. While it is on, Write only stages chunks locally, and they
+	// are committed to the server together by Flush, Sync or Close. Read
+	// returns staged chunks. Turning buffering off flushes first.
+	//
+	// Can return the errors of Flush, and:
+	// - BadFileModeError (in READ,DREAD modes)
+	SetBuffered(buffered bool) (err error)
+
+	// Commits the staged writes to the server in one batch, then to the
+	// local copy of the file. Either every staged write is committed or
+	// none is; staged writes that could not be committed are discarded.
+	// If the write lease lapsed before the flush, WriteModeTimeoutError is
+	// returned and the file must be reopened before the writes are redone.
+	//
+	// Can return the following errors:
+	// - DisconnectedError (in WRITE mode)
+	// - WriteModeTimeoutError (in WRITE mode)
+	Flush() (err error)
+
+	// Flushes, then forces the local copy of the file to stable storage.
+	//
+	// Can return the errors of Flush.
+	Sync() (err error)
+
+	// Closes the file/cleans up, syncing first if writes are buffered.
+	// Can return the following errors:
 	// - DisconnectedError
+	// - WriteModeTimeoutError (in WRITE mode, if buffered writes could not be committed)
 	Close() (err error)
 }
 
@@ -156,6 +410,40 @@ type DFS interface {
 	// - DisconnectedError
 	GlobalFileExists(fname string) (exists bool, err error)
 
+	// Describes a file from the server's metadata, without opening it.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	// - FileNotFoundError
+	// - DisconnectedError
+	Stat(fname string) (stat FileStat, err error)
+
+	// Lists the files on the server whose names start with prefix (every
+	// file if it is empty), in name order, described as by Stat.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if prefix contains non alpha-numeric chars or is more than 16 chars long)
+	// - DisconnectedError
+	ListFiles(prefix string) (files []FileStat, err error)
+
+	// Lists the files on the server whose names start with prefix and, unless
+	// pattern is empty, match pattern (in the syntax of path.Match, e.g.
+	// "log*"), a page at a time. Returns at most limit files (or
+	// shared.MaxListFilesPage if limit is 0 or more) whose names sort after
+	// after; next is the after of the next page, or "" once every file was listed.
+	//
+	// Can return the errors of ListFiles, and:
+	// - BadPatternError (if pattern is malformed)
+	ListFilesPage(prefix string, pattern string, after string, limit int) (files []FileStat, next string, err error)
+
+	// Lists the local copies of files whose names start with prefix, which
+	// can be opened in DREAD mode, in name order. Does not contact the server.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if prefix contains non alpha-numeric chars or is more than 16 chars long)
+	// - LocalPathError
+	ListLocalFiles(prefix string) (files []LocalFileStat, err error)
+
 	// Opens a filename with name fname using mode. Creates the file
 	// in READ/WRITE modes if it does not exist. Returns a handle to
 	// the file through which other operations on this file can be
@@ -167,21 +455,114 @@ type DFS interface {
 	// - FileUnavailableError (in READ,WRITE modes)
 	// - FileDoesNotExistError (in DREAD mode)
 	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	//
+	// DWRITE mode does not need the server: the file is created locally if
+	// needed (with the server's chunk size, if connected), and its writes are
+	// replayed when the handle is closed while connected, or when the DFS next
+	// connects. Replayed chunks that do not fit the server's chunk size are
+	// dropped.
 	Open(fname string, mode FileMode) (f DFSFile, err error)
 
+	// Creates a file with chunks of chunkSize bytes, initially numChunks
+	// chunks long. Files created by Open have 256 chunks of 32 bytes.
+	// Creating a file that exists with the same chunk size does nothing.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	// - BadChunkSizeError (if chunkSize is not between 1 and shared.MaxChunkSize)
+	// - BadChunkNumError (if numChunks chunks are more than shared.MaxFileSize bytes)
+	// - FileExistsError (if the file exists with another chunk size)
+	// - DisconnectedError
+	CreateFile(fname string, chunkSize int, numChunks uint64) (err error)
+
+	// Deletes a file from the DFS and from the local path of every client
+	// that holds it; clients that are disconnected delete their copy when
+	// they connect again. Handles on the file are closed, and its pending
+	// DWRITE writes are dropped.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	// - FileNotFoundError
+	// - OpenWriteConflictError (if another client has the file open in WRITE mode, or is waiting to)
+	// - DisconnectedError
+	DeleteFile(fname string) (err error)
+
+	// Gives a file the new name newFname, on the server and on every client
+	// that holds it, like DeleteFile. Handles on the file are closed.
+	//
+	// Can return the errors of DeleteFile, and:
+	// - BadFilenameError (if newFname is not a valid filename)
+	// - FileExistsError (if a file named newFname exists)
+	RenameFile(fname string, newFname string) (err error)
+
+	// Sets the number of chunks in a file to numChunks, on the server and on
+	// every client that holds it, like DeleteFile. The chunks past the new
+	// end are dropped; chunks added by growing the file read as zeros. Open
+	// handles stay open.
+	//
+	// Can return the errors of DeleteFile, and:
+	// - BadChunkNumError (if numChunks chunks are more than shared.MaxFileSize bytes)
+	// OpenWriteConflictError is only returned for locks on the dropped chunks.
+	TruncateFile(fname string, numChunks uint64) (err error)
+
+	// Opens a filename in WRITE mode like Open, but only locks chunks
+	// firstChunk to lastChunk (inclusive), so other clients can open
+	// disjoint ranges of the same file for writing at the same time.
+	// Writes to chunks outside the range fail.
+	//
+	// Can return the errors of Open in WRITE mode, and:
+	// - BadChunkRangeError (if firstChunk is after lastChunk)
+	OpenRange(fname string, firstChunk uint64, lastChunk uint64) (f DFSFile, err error)
+
+	// Opens a file like Open, but in WRITE mode waits for the file's write
+	// lock instead of failing if another client holds it. Clients waiting
+	// for a file get its lock in the order they asked for it. A timeout of
+	// zero waits until the wait is cancelled with CancelWait.
+	//
+	// Can return the errors of Open other than OpenWriteConflictError, and:
+	// - OpenWaitTimeoutError (in WRITE mode)
+	// - OpenWaitCancelledError (in WRITE mode)
+	OpenWithWait(fname string, mode FileMode, timeout time.Duration) (f DFSFile, err error)
+
+	// Returns the position of this DFS's earliest pending OpenWithWait on
+	// fname in the file's wait queue (1 is next in line), or 0 if it is not
+	// waiting for fname.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	// - DisconnectedError
+	WaitPosition(fname string) (position int, err error)
+
+	// Cancels this DFS's pending OpenWithWait calls on fname, which then
+	// return OpenWaitCancelledError.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	// - DisconnectedError
+	CancelWait(fname string) (err error)
+
+	// Sets the function that settles the conflicts found when replaying
+	// DWRITE writes, then replays them if connected. Without a resolver,
+	// conflicting writes stay journaled until one is set.
+	//
+	// Can return the following errors:
+	// - DisconnectedError (if the server stopped answering during the replay)
+	SetConflictResolver(resolver ConflictResolver) (err error)
+
 	// Disconnects from the server. Can return the following errors:
 	// - DisconnectedError
 	UMountDFS() (err error)
 }
 
 // The constructor for a new DFS object instance. Takes the server's
-// IP:port address string as parameter, the localIP to use to
+// IP:port address string as parameter (optionally followed by backup
+// servers' addresses, comma-separated, to fail over to in order), the localIP to use to
 // establish the connection to the server, and a localPath path on the
 // local filesystem where the client has allocated storage (and
 // possibly existing state) for this DFS.
 //
-// The returned dfs instance is singleton: an application is expected
-// to interact with just one dfs at a time.
+// Every call returns an independent dfs instance, so an application can mount
+// several DFS servers, or the same server with different local paths, at once.
 //
 // This call should succeed regardless of whether the server is
 // reachable. Otherwise, applications cannot access (local) files
@@ -191,31 +572,40 @@ type DFS interface {
 // - LocalPathError
 // - Networking errors related to localIP or serverAddr
 func MountDFS(serverAddr string, localIP string, localPath string) (dfs DFS, err error) {
-	if !LoggingOn {
-		log.SetOutput(ioutil.Discard)
-	}
+	logger := newLogger(localPath)
 
 	e := CheckLocalPath(localPath)
-	if e != nil {return nil, e}
+	if e != nil {
+		logger.Println("Bad local path")
+		return nil, e
+	}
 
-	serverTCPAddr, e := net.ResolveTCPAddr("tcp", serverAddr)
-	if e != nil {err = e}
+	// Backup servers may follow the primary, separated by commas
+	link := &serverLink{clientId: shared.UnsetClientId, logger: logger}
+	for _, addr := range strings.Split(serverAddr, ",") {
+		serverTCPAddr, e := net.ResolveTCPAddr("tcp", strings.TrimSpace(addr))
+		if e != nil {
+			err = e
+			continue
+		}
+		link.addrs = append(link.addrs, serverTCPAddr)
+	}
 
 	tcpAddr := localIP + ":0"
 
 	localTCPAddr, e := net.ResolveTCPAddr("tcp", tcpAddr)
 	if e != nil {err = e}
 
-	conn := DFSConnection{
-		shared.UnsetClientId,
-		serverTCPAddr,
-		localTCPAddr,
-		localPath,
-		nil,
-		DREAD,
-		false,
-		make(map[string]*File),
-		}
+	conn := &DFSConnection{
+		link:          link,
+		localAddr:     localTCPAddr,
+		localPath:     localPath,
+		files:         make(map[*File]bool),
+		waitTickets:   make(map[int]string),
+		cache:         newChunkCache(),
+		logger:        logger,
+		stopHeartbeat: make(chan struct{}),
+	}
 	networkErr := conn.Connect()
 	if err == nil && networkErr != nil {err = networkErr}
 
@@ -230,7 +620,14 @@ func CheckLocalPath(localPath string) error {
 		// Directory already exists
 		return nil
 	} else {
-		log.Println("Bad local path")
 		return LocalPathError(localPath)
 	}
 }
+
+// newLogger returns the logger of the mount at localPath. Its output is discarded
+// unless LoggingOn is set.
+func newLogger(localPath string) *log.Logger {
+	var out io.Writer = ioutil.Discard
+	if LoggingOn {out = os.Stderr}
+	return log.New(out, "[dfs " + localPath + "] ", log.LstdFlags)
+}
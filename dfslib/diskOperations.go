@@ -2,20 +2,30 @@ package dfslib
 
 import (
 	"../shared"
-	"log"
 	"os"
 	"strconv"
+	"strings"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
 )
 
+// DiskService serves the DFS server's calls to a mount's local disk.
 type DiskService struct {
-	c DFSConnection
+	c *DFSConnection
 }
 
 // FetchChunk gets a file chunk from local disk and sends it to the server.
 func (service *DiskService) FetchChunk(req *shared.FetchChunkRequest, reply *shared.FetchChunkResponse) error {
-	log.Printf("Server requested file [%s] chunk [%d]\n", req.Filename, req.ChunkNum)
+	c := service.c
+	c.logger.Printf("Server requested file [%s] chunk [%d]\n", req.Filename, req.ChunkNum)
 
-	chunk, err := ReadChunkFromDisk(getFilePath(service.c.localPath, req.Filename), req.ChunkNum)
+	// Servers that predate file layouts do not send the chunk size
+	chunkSize := req.ChunkSize
+	if chunkSize == 0 {chunkSize = shared.BytesPerChunk}
+	chunk, err := c.readChunkFromDisk(getFilePath(c.localPath, req.Filename), req.ChunkNum, chunkSize)
 
 	if err != nil {return err}
 
@@ -23,58 +33,343 @@ func (service *DiskService) FetchChunk(req *shared.FetchChunkRequest, reply *sha
 	return nil
 }
 
-func ReadChunkFromDisk(filePath string, chunkNum uint8) (shared.Chunk, error) {
-	diskFile, err := os.Open(filePath)
-	if err != nil {
-		log.Printf("Error: cannot open file [%s]\n", filePath)
-		return shared.Chunk{}, err
+// StoreChunk saves a chunk version pushed by the server to local disk, making this
+// client one of its owners. A version older than the one held locally is refused.
+func (service *DiskService) StoreChunk(req *shared.StoreChunkRequest, reply *shared.StoreChunkResponse) error {
+	c := service.c
+	c.logger.Printf("Server pushed file [%s] chunk [%d] ver [%d]\n",
+		req.Filename, req.ChunkData.ChunkNum, req.ChunkData.Version)
+
+	c.createLocalEmptyFile(req.Filename, layoutOfChunkSize(len(req.ChunkData.Data)))
+	c.recordFileId(req.Filename, req.FileId)
+	stored, err := c.storeChunkToDisk(req.ChunkData, getFilePath(c.localPath, req.Filename))
+	if err != nil {return err}
+	if !stored {
+		c.logger.Printf("Refused file [%s] chunk [%d] ver [%d]: a newer version is held locally\n",
+			req.Filename, req.ChunkData.ChunkNum, req.ChunkData.Version)
 	}
 
-	buffer := make([]byte, 32)
+	*reply = shared.StoreChunkResponse{Success: stored}
+	return nil
+}
+
+// layoutOfChunkSize returns the layout of a file known only by the size of one
+// of its chunks. Files with the default chunk size start at the default length.
+func layoutOfChunkSize(chunkSize int) shared.FileLayout {
+	if chunkSize == shared.BytesPerChunk || chunkSize == 0 {return shared.DefaultLayout}
+	return shared.FileLayout{ChunkSize: chunkSize}
+}
+
+// ChangeFile is the server's call when another client deleted, renamed or
+// truncated a file. The local copy is changed the same way.
+func (service *DiskService) ChangeFile(req *shared.FileChange, reply *bool) error {
+	c := service.c
+	c.logger.Printf("Server changed file [%s]\n", req.Filename)
+	c.applyFileChange(*req)
+	*reply = true
+	return nil
+}
 
-	_, err = diskFile.Seek(getByteOffsetFromChunkNum(chunkNum),0)
+// InvalidateChunk is the server's callback when a newer version of a chunk becomes
+// current. The local copy of the chunk is read from the server again from then on.
+func (service *DiskService) InvalidateChunk(req *shared.InvalidateChunkRequest, reply *bool) error {
+	c := service.c
+	c.logger.Printf("Server invalidated file [%s] chunk [%d], now at ver [%d]\n",
+		req.Filename, req.ChunkNum, req.Version)
+	c.cache.invalidate(req.Filename, req.ChunkNum, req.Version)
+	err := c.recordLatestVersion(getFilePath(c.localPath, req.Filename), req.ChunkNum, req.Version)
+	if err != nil {c.logger.Println(err)}
+	*reply = true
+	return nil
+}
+
+// readChunkFromDisk reads a chunk of chunkSize bytes from the local file at filePath.
+// Chunks past the end of the local file, which has not grown to hold them yet, are
+// all zeros.
+func (c *DFSConnection) readChunkFromDisk(filePath string, chunkNum uint64, chunkSize int) (shared.Chunk, error) {
+	diskFile, err := os.Open(filePath)
 	if err != nil {
-		log.Printf("Error: cannot read file [%s]\n", filePath)
+		c.logger.Printf("Error: cannot open file [%s]\n", filePath)
 		return shared.Chunk{}, err
 	}
+	defer diskFile.Close()
 
-	log.Printf("Disk read: file [%s], chunk [%d] (offset = %d bytes)\n",
-		filePath, chunkNum, getByteOffsetFromChunkNum(chunkNum))
+	buffer := make([]byte, chunkSize)
+	offset := getByteOffset(chunkNum, chunkSize)
 
-	_, err = diskFile.Read(buffer)
+	c.logger.Printf("Disk read: file [%s], chunk [%d] (offset = %d bytes)\n", filePath, chunkNum, offset)
 
-	if err != nil {
-		log.Printf("Error: cannot read file [%s]\n", filePath)
+	_, err = diskFile.ReadAt(buffer, offset)
+	if err != nil && err != io.EOF {
+		c.logger.Printf("Error: cannot read file [%s]\n", filePath)
 		return shared.Chunk{}, err
 	}
 
-	diskFile.Close()
-	var d [32]byte
-	copy(d[:], buffer[:])
-	chunk := shared.Chunk{ChunkNum: chunkNum, Data: d}
+	return shared.Chunk{ChunkNum: chunkNum, Data: buffer}, nil
+}
 
-	return chunk, nil
+// writeChunksToDisk writes chunks to the local file at filePath and records their
+// versions. The versions they overwrite are forgotten before the data is written,
+// and the new ones recorded once it is on stable storage, so after a crash the
+// version file never names a version the local file may not hold.
+func (c *DFSConnection) writeChunksToDisk(chunks []shared.Chunk, filePath string) error {
+	c.diskLock.Lock()
+	defer c.diskLock.Unlock()
+	return c.writeChunksLocked(chunks, filePath)
 }
 
-func WriteChunksToDisk(chunks []shared.Chunk, filePath string) error {
+// storeChunkToDisk writes a chunk version pushed by the server like
+// writeChunksToDisk, unless a newer version is held locally: the push may have
+// been overtaken by a write of this client, which it must not overwrite. Returns
+// false if the chunk was not stored.
+func (c *DFSConnection) storeChunkToDisk(chunk shared.Chunk, filePath string) (stored bool, err error) {
+	c.diskLock.Lock()
+	defer c.diskLock.Unlock()
+	if c.localChunkVersion(filePath, chunk.ChunkNum) > chunk.Version {return false, nil}
+	return true, c.writeChunksLocked([]shared.Chunk{chunk}, filePath)
+}
+
+// writeChunksLocked is writeChunksToDisk, with diskLock held.
+func (c *DFSConnection) writeChunksLocked(chunks []shared.Chunk, filePath string) error {
+	err := c.forgetChunkVersions(filePath, chunks)
+	if err != nil {return err}
+
 	diskFile, err := os.OpenFile(filePath, os.O_WRONLY, 0666)
 	if err != nil {
-		log.Printf("Error: cannot open file [%s]\n", filePath)
+		c.logger.Printf("Error: cannot open file [%s]\n", filePath)
 		return err
 	}
 
 	for _, chunk := range chunks {
-		_, err = diskFile.WriteAt(chunk.Data[:], getByteOffsetFromChunkNum(chunk.ChunkNum))
+		_, err = diskFile.WriteAt(chunk.Data, getByteOffset(chunk.ChunkNum, len(chunk.Data)))
 		if err != nil {
-			log.Printf("Error: cannot write to file [%s]\n", filePath)
+			diskFile.Close()
+			c.logger.Printf("Error: cannot write to file [%s]\n", filePath)
 			return err
 		}
 	}
 
-	diskFile.Sync()
-	diskFile.Close()
+	err = diskFile.Sync()
+	closeErr := diskFile.Close()
+	if err == nil {err = closeErr}
+	if err != nil {
+		c.logger.Printf("Error: cannot sync file [%s]\n", filePath)
+		return err
+	}
 
-	return nil
+	return c.recordChunkVersions(filePath, chunks)
+}
+
+// chunkMetadata is what the version file records about a chunk held locally.
+type chunkMetadata struct {
+	// Version is the version held locally, NoVersion if it is unknown
+	Version int
+	// SyncedAt is when the server last confirmed Version was current
+	SyncedAt time.Time
+	// LatestVersion is the newest version the server reported, which may be newer than Version
+	LatestVersion int
+}
+
+// latestVersion returns the newest version of the chunk known to exist.
+func (m chunkMetadata) latestVersion() int {
+	if m.LatestVersion > m.Version {return m.LatestVersion}
+	return m.Version
+}
+
+// Returns the path of the file that records which version of each chunk is held in
+// the local file at filePath, and when it was last synced with the server.
+func getVersionFilePath(filePath string) string {
+	return strings.TrimSuffix(filePath, shared.FileExtension) + VersionFileExtension
+}
+
+// localChunkVersion returns the version of a chunk held in the local file at
+// filePath, or shared.NoVersion if it is unknown.
+func (c *DFSConnection) localChunkVersion(filePath string, chunkNum uint64) int {
+	return c.localChunkMetadata(filePath, chunkNum).Version
+}
+
+// localChunkMetadata returns the recorded metadata of a chunk of the local file at
+// filePath; its versions are NoVersion if none are known.
+func (c *DFSConnection) localChunkMetadata(filePath string, chunkNum uint64) chunkMetadata {
+	metadata, _ := c.readChunkMetadata(filePath)
+	meta, exists := metadata[chunkNum]
+	if !exists {return chunkMetadata{Version: shared.NoVersion, LatestVersion: shared.NoVersion}}
+	return meta
+}
+
+// readChunkVersions returns the version of each chunk held in the local file at filePath.
+// Chunks whose version is unknown are not included.
+func (c *DFSConnection) readChunkVersions(filePath string) (map[uint64]int, error) {
+	versions := make(map[uint64]int)
+	metadata, err := c.readChunkMetadata(filePath)
+	for chunkNum, meta := range metadata {
+		if meta.Version == shared.NoVersion {continue}
+		versions[chunkNum] = meta.Version
+	}
+	return versions, err
+}
+
+// readChunkMetadata returns the recorded metadata of each chunk held in the local
+// file at filePath. Version files written before sync times were recorded only
+// hold versions; their chunks have a zero SyncedAt.
+func (c *DFSConnection) readChunkMetadata(filePath string) (map[uint64]chunkMetadata, error) {
+	metadata := make(map[uint64]chunkMetadata)
+
+	data, err := ioutil.ReadFile(getVersionFilePath(filePath))
+	if os.IsNotExist(err) {return metadata, nil}
+	if err != nil {
+		c.logger.Printf("Error: cannot read version file for [%s]\n", filePath)
+		return metadata, err
+	}
+
+	err = json.Unmarshal(data, &metadata)
+	if err == nil {return metadata, nil}
+
+	versions := make(map[uint64]int)
+	if json.Unmarshal(data, &versions) != nil {
+		c.logger.Printf("Error: cannot parse version file for [%s]\n", filePath)
+		return make(map[uint64]chunkMetadata), err
+	}
+	for chunkNum, ver := range versions {
+		metadata[chunkNum] = chunkMetadata{Version: ver, LatestVersion: ver}
+	}
+	return metadata, nil
+}
+
+// recordChunkVersions records the versions of the given chunks, which must already
+// have been written to the local file at filePath, as synced now.
+func (c *DFSConnection) recordChunkVersions(filePath string, chunks []shared.Chunk) error {
+	c.metadataLock.Lock()
+	defer c.metadataLock.Unlock()
+	metadata, _ := c.readChunkMetadata(filePath)
+
+	changed := false
+	now := time.Now()
+	for _, chunk := range chunks {
+		if chunk.Version == shared.NoVersion {continue}
+		meta, exists := metadata[chunk.ChunkNum]
+		if !exists || meta.LatestVersion < chunk.Version {meta.LatestVersion = chunk.Version}
+		meta.Version = chunk.Version
+		meta.SyncedAt = now
+		metadata[chunk.ChunkNum] = meta
+		changed = true
+	}
+	if !changed {return nil}
+	return c.writeChunkMetadata(filePath, metadata)
+}
+
+// forgetChunkVersions drops the recorded versions of the given chunks of the local
+// file at filePath, before their local copies are overwritten.
+func (c *DFSConnection) forgetChunkVersions(filePath string, chunks []shared.Chunk) error {
+	c.metadataLock.Lock()
+	defer c.metadataLock.Unlock()
+	metadata, err := c.readChunkMetadata(filePath)
+	if err != nil {return err}
+
+	changed := false
+	for _, chunk := range chunks {
+		meta, exists := metadata[chunk.ChunkNum]
+		if !exists || meta.Version == shared.NoVersion {continue}
+		meta.LatestVersion = meta.latestVersion()
+		meta.Version = shared.NoVersion
+		meta.SyncedAt = time.Time{}
+		metadata[chunk.ChunkNum] = meta
+		changed = true
+	}
+	if !changed {return nil}
+	return c.writeChunkMetadata(filePath, metadata)
+}
+
+// recordLatestVersion records that the server reported ver as the current version
+// of a chunk of the local file at filePath. Nothing is recorded if the file is
+// not held locally.
+func (c *DFSConnection) recordLatestVersion(filePath string, chunkNum uint64, ver int) error {
+	c.metadataLock.Lock()
+	defer c.metadataLock.Unlock()
+	if _, err := os.Stat(filePath); err != nil {return nil}
+	metadata, err := c.readChunkMetadata(filePath)
+	if err != nil {return err}
+	meta, exists := metadata[chunkNum]
+	if !exists {meta = chunkMetadata{Version: shared.NoVersion, LatestVersion: shared.NoVersion}}
+	if meta.latestVersion() >= ver {return nil}
+	meta.LatestVersion = ver
+	metadata[chunkNum] = meta
+	return c.writeChunkMetadata(filePath, metadata)
+}
+
+// writeChunkMetadata replaces the version file of the local file at filePath.
+func (c *DFSConnection) writeChunkMetadata(filePath string, metadata map[uint64]chunkMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {return err}
+
+	err = writeFileAtomically(getVersionFilePath(filePath), data)
+	if err != nil {
+		c.logger.Printf("Error: cannot write version file for [%s]\n", filePath)
+	}
+	return err
+}
+
+// writeFileAtomically replaces the file at path with data, so that after a crash
+// it holds either its old contents or all of data.
+func writeFileAtomically(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {return err}
+
+	_, err = tmpFile.Write(data)
+	if err == nil {err = tmpFile.Sync()}
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {return err}
+
+	// The rename itself is durable once the directory is synced
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {return err}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// buildInventory lists every DFS file in the local path along with the version of
+// each chunk held locally, so the server can learn what this client owns.
+func (c *DFSConnection) buildInventory() []shared.FileInventory {
+	var inventory []shared.FileInventory
+
+	filenames, err := c.localFileNames()
+	if err != nil {
+		c.logger.Printf("Error: cannot list local path [%s]\n", c.localPath)
+		return inventory
+	}
+
+	for _, filename := range filenames {
+		versions, err := c.readChunkVersions(getFilePath(c.localPath, filename))
+		if err != nil {c.logger.Println(err)}
+		inventory = append(inventory, shared.FileInventory{
+			Filename:      filename,
+			FileId:        c.localFileId(filename),
+			ChunkVersions: versions,
+			Layout:        c.localLayout(filename),
+		})
+	}
+	return inventory
+}
+
+// localFileNames returns the name of every DFS file in the local path, in name order.
+func (c *DFSConnection) localFileNames() ([]string, error) {
+	entries, err := ioutil.ReadDir(c.localPath)
+	if err != nil {return nil, err}
+
+	var filenames []string
+	for _, entry := range entries {
+		filename := strings.TrimSuffix(entry.Name(), shared.FileExtension)
+		if entry.IsDir() || filename == entry.Name() || !isFileNameValid(filename) {continue}
+		filenames = append(filenames, filename)
+	}
+	return filenames, nil
 }
 
 // Gets the cached client ID from disk, if one exists.
@@ -89,7 +384,7 @@ func (c *DFSConnection) getClientIdFromDisk() (int, error) {
 
 	idFile, err := os.Open(cidFilePath)
 	if err != nil {
-		log.Printf("Error: cannot open file [%s]\n", cidFilePath)
+		c.logger.Printf("Error: cannot open file [%s]\n", cidFilePath)
 		return UnsetClientID, err
 	}
 
@@ -98,17 +393,17 @@ func (c *DFSConnection) getClientIdFromDisk() (int, error) {
 	cidBytes := buffer[:n]
 
 	if err != nil {
-		log.Printf("Error: cannot read file [%s]\n", cidFilePath)
+		c.logger.Printf("Error: cannot read file [%s]\n", cidFilePath)
 		return UnsetClientID, err
 	}
 
 	cid, err := strconv.Atoi(string(cidBytes))
 	if err != nil {
-		log.Printf("Error: cannot parse client ID file [%s]\n", cidFilePath)
+		c.logger.Printf("Error: cannot parse client ID file [%s]\n", cidFilePath)
 		return UnsetClientID, err
 	}
 
-	log.Printf("Cliend ID retrieved from disk: [%d]\n", cid)
+	c.logger.Printf("Cliend ID retrieved from disk: [%d]\n", cid)
 
 	idFile.Close()
 
@@ -123,20 +418,20 @@ func (c *DFSConnection) storeClientIdToDisk(cid int) error {
 	if os.IsNotExist(err) {
 		f, err := os.Create(cidFilePath)
 		if err != nil {
-			log.Printf("Error: cannot create file %s\n", cidFilePath)
+			c.logger.Printf("Error: cannot create file %s\n", cidFilePath)
 		}
 		f.Close()
 	}
 
 	cidFile, err := os.OpenFile(cidFilePath, os.O_WRONLY, 0666)
 	if err != nil {
-		log.Printf("Error: cannot open file [%s]\n", cidFilePath)
+		c.logger.Printf("Error: cannot open file [%s]\n", cidFilePath)
 		return err
 	}
 
 	_, err = cidFile.WriteString(strconv.Itoa(cid))
 	if err != nil {
-		log.Printf("Error: cannot write to file [%s]\n", cidFilePath)
+		c.logger.Printf("Error: cannot write to file [%s]\n", cidFilePath)
 		return err
 	}
 
@@ -3,14 +3,35 @@ package dfslib
 import (
 	"../shared"
 	"os"
-	"log"
+	"sort"
 	"strings"
+	"time"
 )
 
+// File is a handle on an open DFS file. Each handle has its own mode, so a mount
+// can have several files (or the same file several times) open in different modes.
 type File struct {
 	filename string
 	c *DFSConnection
+	// isOpen is cleared by the connection when the server drops the handle, so it
+	// is guarded by c.lock
 	isOpen bool
+	mode FileMode
+	// handleId identifies the handle to the server; shared.UnsetHandleId if it was opened without the server
+	handleId int
+	// chunks is the range of chunks the handle may write in WRITE mode
+	chunks shared.ChunkRange
+	// layout is the file's chunk size, and the number of chunks it held when
+	// opened, grown by the handle's own writes
+	layout shared.FileLayout
+	// lease is the write lease granted on Open in WRITE mode. It lapses at leaseExpiry
+	// unless renewed by a heartbeat. Both are guarded by c.lock.
+	lease shared.Lease
+	leaseExpiry time.Time
+	// isBuffered is set by SetBuffered; staged then holds the writes not
+	// flushed yet, by chunk number. Both are guarded by c.lock.
+	isBuffered bool
+	staged map[uint64][]byte
 }
 
 
@@ -20,27 +41,55 @@ type File struct {
 // Can return the following errors:
 // - DisconnectedError (in READ,WRITE modes)
 // - ChunkUnavailableError (in READ,WRITE modes)
-func (f File) Read(chunkNum uint8, chunk *Chunk) (err error) {
+// - BadChunkSizeError (if the file's chunks are not 32 bytes long)
+func (f *File) Read(chunkNum uint8, chunk *Chunk) (err error) {
+	return f.ReadChunk(uint64(chunkNum), chunk[:])
+}
+
+// Reads chunk number chunkNum into data, which must be ChunkSize() bytes long.
+//
+// Can return the errors of Read, and:
+// - BadChunkNumError (if the chunk is past shared.MaxFileSize)
+func (f *File) ReadChunk(chunkNum uint64, chunk []byte) (err error) {
+	if len(chunk) != f.layout.ChunkSize {return BadChunkSizeError(len(chunk))}
+	if chunkNum >= f.layout.MaxChunks() {return BadChunkNumError(chunkNum)}
+	chunkSize := f.layout.ChunkSize
+
 	var resp shared.GetLatestChunkResponse
 	req := shared.GetLatestChunkRequest{
-		ClientId: f.c.clientId,
+		ClientId: f.c.link.getClientId(),
 		Filename: f.filename,
 		ChunkNum: chunkNum,
-		Mode: convertMode(f.c.currentMode),
+		Mode: convertMode(f.mode),
+		LocalVersion: shared.NoVersion,
+	}
+
+	// A handle reads its own buffered writes
+	if staged, exists := f.stagedChunk(chunkNum); exists {
+		copy(chunk, staged)
+		return nil
 	}
 
-	if f.c.currentMode == DREAD {
+	if f.mode == DWRITE {
+		journaled, err := f.c.readJournaledChunk(f.filename, chunkNum, chunkSize)
+		if err != nil {return err}
+		copy(chunk, journaled.Data)
+		return nil
+	}
+
+	if f.mode == DREAD {
 		chunkRetrieved := false
 
 		if f.c.isConnected() {
 			// Get best-effort version of chunk
-			err = f.c.rpcClient.Call("Server.ReadChunk", req, &resp)
+			err = f.c.link.client().Call("Server.ReadChunk", req, &resp)
 			if err == nil && resp.Success {
-				copy(chunk[:], resp.ChunkData.Data[:])
+				resp.ChunkData.Data = wholeChunk(resp.ChunkData.Data, chunkSize)
+				copy(chunk, resp.ChunkData.Data)
 				chunkRetrieved = true
 
 				c := []shared.Chunk{resp.ChunkData}
-				err = WriteChunksToDisk(c, f.getFilePath())
+				err = f.c.writeChunksToDisk(c, f.getFilePath())
 				if err != nil {return err}
 				return nil
 			}
@@ -48,34 +97,60 @@ func (f File) Read(chunkNum uint8, chunk *Chunk) (err error) {
 
 		if !chunkRetrieved {
 			// Retrieve chunk from disk
-			chunkFromDisk, err := ReadChunkFromDisk(f.getFilePath(), chunkNum)
-			if err != nil {log.Println(err)}
-			copy(chunk[:], chunkFromDisk.Data[:])
+			chunkFromDisk, err := f.c.readChunkFromDisk(f.getFilePath(), chunkNum, chunkSize)
+			if err != nil {f.c.logger.Println(err)}
+			copyChunk(chunk, chunkFromDisk.Data)
 			return nil
 		}
 		return nil
 	} else {
-		if !f.isOpen || !f.c.isConnected() {
-			f.isOpen = false
-			return DisconnectedError(f.c.serverAddr.String())
+		// The server calls back when a cached chunk changes, so it is read locally
+		if f.getIsOpen() && f.c.getShouldSendPing() && f.c.cache.has(f.filename, chunkNum) {
+			cached, err := f.c.readChunkFromDisk(f.getFilePath(), chunkNum, chunkSize)
+			if err == nil {
+				copy(chunk, cached.Data)
+				return nil
+			}
 		}
 
-		err = f.c.rpcClient.Call("Server.ReadChunk", req, &resp)
+		if !f.getIsOpen() || !f.c.isConnected() {
+			f.markClosed()
+			return DisconnectedError(f.c.link.addr().String())
+		}
+
+		// The server does not send the chunk back if the local copy is current
+		req.LocalVersion = f.c.localChunkVersion(f.getFilePath(), chunkNum)
+		generation := f.c.cache.currentGeneration()
+		err = f.c.link.client().Call("Server.ReadChunk", req, &resp)
 		if err != nil {return err}
 
 		if !resp.Success {
-			log.Printf("Chunk [%d] of file [%s] is unavailable\n", chunkNum, f.filename)
+			f.c.logger.Printf("Chunk [%d] of file [%s] is unavailable\n", chunkNum, f.filename)
 			return ChunkUnavailableError(chunkNum)
 		}
 
+		if resp.NotModified {
+			local, err := f.c.readChunkFromDisk(f.getFilePath(), chunkNum, chunkSize)
+			if err != nil {return err}
+			copy(chunk, local.Data)
+			// The server just confirmed the local copy is current
+			err = f.c.recordChunkVersions(f.getFilePath(), []shared.Chunk{resp.ChunkData})
+			if err != nil {return err}
+			f.c.cache.put(f.filename, chunkNum, resp.ChunkData.Version, generation)
+			return nil
+		}
+
+		// Chunks that were never written to come back without data
+		resp.ChunkData.Data = wholeChunk(resp.ChunkData.Data, chunkSize)
 		c := []shared.Chunk{resp.ChunkData}
 
-		copy(chunk[:], resp.ChunkData.Data[:])
+		copy(chunk, resp.ChunkData.Data)
 
 		if c != nil {
 			// Only update chunk locally if non-trivial data returned from server
-			err = WriteChunksToDisk(c, f.getFilePath())
+			err = f.c.writeChunksToDisk(c, f.getFilePath())
 			if err != nil {return err}
+			f.c.cache.put(f.filename, chunkNum, resp.ChunkData.Version, generation)
 
 		} else {
 			return nil
@@ -84,6 +159,35 @@ func (f File) Read(chunkNum uint8, chunk *Chunk) (err error) {
 	}
 }
 
+// Reads a chunk like ReadChunk, and describes how current it is.
+//
+// Can return the errors of Read.
+func (f *File) ReadWithStatus(chunkNum uint64, chunk []byte) (status ChunkStatus, err error) {
+	err = f.ReadChunk(chunkNum, chunk)
+	if err != nil {return ChunkStatus{}, err}
+
+	meta := f.c.localChunkMetadata(f.getFilePath(), chunkNum)
+	status = ChunkStatus{
+		LocalVersion:  meta.Version,
+		LatestVersion: meta.latestVersion(),
+		SyncedAt:      meta.SyncedAt,
+	}
+	switch {
+	case f.mode == READ || f.mode == WRITE:
+		status.Freshness = Fresh
+	case f.mode == DWRITE && f.c.isJournaled(f.filename, chunkNum):
+		// The chunk was changed locally; it is only current once replayed
+		status.Freshness = PossiblyStale
+	case f.c.getShouldSendPing() && f.c.cache.has(f.filename, chunkNum):
+		status.Freshness = Fresh
+	case status.LatestVersion > status.LocalVersion:
+		status.Freshness = KnownStale
+	default:
+		status.Freshness = PossiblyStale
+	}
+	return status, nil
+}
+
 // Writes chunk number chunkNum from storage pointed to by
 // chunk. Returns a non-nil error if the write was unsuccessful.
 //
@@ -91,24 +195,62 @@ func (f File) Read(chunkNum uint8, chunk *Chunk) (err error) {
 // - BadFileModeError (in READ,DREAD modes)
 // - DisconnectedError (in WRITE mode)
 // - WriteModeTimeoutError (in WRITE mode)
+// - ChunkNotLockedError (in WRITE mode)
+// - BadChunkSizeError (if the file's chunks are not 32 bytes long)
+func (f *File) Write(chunkNum uint8, chunk *Chunk) (err error) {
+	return f.WriteChunk(uint64(chunkNum), chunk[:])
+}
+
+// Writes data, which must be ChunkSize() bytes long, to chunk number chunkNum.
+// Writing past the end of the file grows it, up to shared.MaxFileSize bytes.
+//
+// Can return the errors of Write, and:
+// - BadChunkNumError (if the chunk is past shared.MaxFileSize)
 // NOTE - assumes file exists locally as a result of Open().
-func (f File) Write(chunkNum uint8, chunk *Chunk) (err error) {
-	if f.c.currentMode != WRITE {return BadFileModeError(f.c.currentMode)}
-	if !f.isOpen || !f.c.isConnected() {
-		f.isOpen = false
-		return DisconnectedError(f.c.serverAddr.String())
+func (f *File) WriteChunk(chunkNum uint64, chunk []byte) (err error) {
+	if len(chunk) != f.layout.ChunkSize {return BadChunkSizeError(len(chunk))}
+	// Checked before the server commits the write, which the local copy could not hold
+	if chunkNum >= f.layout.MaxChunks() {return BadChunkNumError(chunkNum)}
+	if f.mode == DWRITE {
+		if !f.getIsOpen() {return DisconnectedError(f.c.link.addr().String())}
+		err = f.c.journalChunk(f.filename, newChunk(chunkNum, chunk))
+		if err == nil {f.grow(chunkNum)}
+		return err
+	}
+	if f.mode != WRITE {return BadFileModeError(f.mode)}
+	if !f.chunks.Contains(chunkNum) {return ChunkNotLockedError(chunkNum)}
+	token, isLeaseValid := f.leaseToken()
+	if !isLeaseValid {
+		f.c.logger.Printf("Lease on file [%s] has lapsed\n", f.filename)
+		f.takeStaged()
+		return WriteModeTimeoutError(f.filename)
+	}
+	if f.getIsBuffered() {
+		if !f.getIsOpen() {return DisconnectedError(f.c.link.addr().String())}
+		f.stageChunk(chunkNum, newChunk(chunkNum, chunk).Data)
+		f.grow(chunkNum)
+		return nil
+	}
+	if !f.getIsOpen() || !f.c.isConnected() {
+		f.markClosed()
+		return DisconnectedError(f.c.link.addr().String())
 	}
 
 	request := shared.WriteChunkRequest{
-		ClientId:  f.c.clientId,
-		Filename:  f.filename,
-		ChunkNum:  chunkNum,
+		ClientId:   f.c.link.getClientId(),
+		Filename:   f.filename,
+		ChunkNum:   chunkNum,
+		ChunkData:  newChunk(chunkNum, chunk),
+		LeaseToken: token,
 	}
 	var response shared.WriteChunkResponse
-	err = f.c.rpcClient.Call("Server.WriteChunk", request, &response)
+	// The local copy is out of date until the write is committed locally
+	f.c.cache.forget(f.filename, chunkNum)
+	generation := f.c.cache.currentGeneration()
+	err = f.c.link.client().Call("Server.WriteChunk", request, &response)
 	if err != nil {
-		log.Println("Error with RPC call to server")
-		log.Println(err)
+		f.c.logger.Println("Error with RPC call to server")
+		f.c.logger.Println(err)
 		return err
 	}
 
@@ -117,52 +259,232 @@ func (f File) Write(chunkNum uint8, chunk *Chunk) (err error) {
 		return WriteModeTimeoutError(f.filename)
 	}
 	// Commit write locally
-	diskFile, err := os.OpenFile(f.getFilePath(), os.O_WRONLY, 0666)
+	written := request.ChunkData
+	written.Version = response.Version
+	err = f.c.writeChunksToDisk([]shared.Chunk{written}, f.getFilePath())
+	if err != nil {return err}
+	f.c.cache.put(f.filename, chunkNum, response.Version, generation)
+	f.grow(chunkNum)
+	return nil
+}
+
+// Returns the size of the file's chunks in bytes.
+func (f *File) ChunkSize() int {
+	return f.layout.ChunkSize
+}
+
+// Returns the number of chunks in the file, as of when it was opened and
+// the writes made through this handle since.
+func (f *File) NumChunks() uint64 {
+	return f.layout.NumChunks
+}
+
+// grow extends the handle's view of the file to include chunkNum.
+func (f *File) grow(chunkNum uint64) {
+	if chunkNum >= f.layout.NumChunks {f.layout.NumChunks = chunkNum + 1}
+}
+
+// Turns write-back buffering on or off, flushing when it is turned off.
+// Can return the errors of Flush, and:
+// - BadFileModeError (in READ,DREAD modes)
+func (f *File) SetBuffered(buffered bool) (err error) {
+	if f.mode != WRITE {return BadFileModeError(f.mode)}
+	if !buffered {
+		err = f.Flush()
+	}
+	f.c.lock.Lock()
+	f.isBuffered = buffered
+	f.c.lock.Unlock()
+	return err
+}
+
+// Commits the staged writes to the server in one batch, then to the local copy
+// of the file. The staged writes are discarded whether or not they could be
+// committed.
+//
+// Can return the following errors:
+// - DisconnectedError (in WRITE mode)
+// - WriteModeTimeoutError (in WRITE mode)
+func (f *File) Flush() (err error) {
+	staged := f.takeStaged()
+	if len(staged) == 0 {return nil}
+
+	token, isLeaseValid := f.leaseToken()
+	if !isLeaseValid {
+		f.c.logger.Printf("Lease on file [%s] lapsed before a flush\n", f.filename)
+		return WriteModeTimeoutError(f.filename)
+	}
+	if !f.getIsOpen() || !f.c.isConnected() {
+		f.markClosed()
+		return DisconnectedError(f.c.link.addr().String())
+	}
+
+	var chunks []shared.Chunk
+	for chunkNum, data := range staged {
+		chunks = append(chunks, shared.Chunk{ChunkNum: chunkNum, Data: data})
+		// The local copy is out of date until the write is committed locally
+		f.c.cache.forget(f.filename, chunkNum)
+	}
+	sort.Slice(chunks, func(i, j int) bool {return chunks[i].ChunkNum < chunks[j].ChunkNum})
+
+	request := shared.WriteChunksRequest{
+		ClientId:   f.c.link.getClientId(),
+		Filename:   f.filename,
+		Chunks:     chunks,
+		LeaseToken: token,
+	}
+	var response shared.WriteChunksResponse
+	generation := f.c.cache.currentGeneration()
+	err = f.c.link.client().Call("Server.WriteChunks", request, &response)
 	if err != nil {
-		log.Printf("Error: cannot open file [%s]\n", f.filename)
-		return err
+		f.c.logger.Println("Error with RPC call to server")
+		f.c.logger.Println(err)
+		return DisconnectedError(f.c.link.addr().String())
 	}
+	if !response.Success {
+		return WriteModeTimeoutError(f.filename)
+	}
+
+	for i := range chunks {
+		chunks[i].Version = response.Versions[i]
+	}
+	err = f.c.writeChunksToDisk(chunks, f.getFilePath())
+	if err != nil {return err}
+	for _, chunk := range chunks {
+		f.c.cache.put(f.filename, chunk.ChunkNum, chunk.Version, generation)
+	}
+	return nil
+}
 
-	_, err = diskFile.WriteAt(chunk[:], getByteOffsetFromChunkNum(chunkNum))
+// Flushes, then forces the local copy of the file to stable storage.
+// Can return the errors of Flush.
+func (f *File) Sync() (err error) {
+	err = f.Flush()
+	if err != nil || f.mode != WRITE {return err}
+
+	diskFile, err := os.OpenFile(f.getFilePath(), os.O_WRONLY, 0666)
 	if err != nil {
-		log.Printf("Error: cannot write to file [%s]\n", f.filename)
+		f.c.logger.Printf("Error: cannot open file [%s]\n", f.filename)
 		return err
 	}
+	defer diskFile.Close()
+	return diskFile.Sync()
+}
 
-	diskFile.Sync()
-	diskFile.Close()
-
+// Closes the file/cleans up, syncing first if writes are buffered. The file is
+// closed even if the sync fails. Can return the following errors:
+// - DisconnectedError (in READ/WRITE)
+// - WriteModeTimeoutError (in WRITE mode)
+func (f *File) Close() (err error) {
+	var syncErr error
+	if f.getIsBuffered() && f.getIsOpen() {
+		syncErr = f.Sync()
+	}
+	err = f.closeHandle()
+	if err == nil {err = syncErr}
 	return err
 }
 
-// Closes the file/cleans up. Can return the following errors:
-// - DisconnectedError (in READ/WRITE)
-func (f File) Close() (err error) {
-	if f.c.currentMode == DREAD {
-		f.isOpen = false
+// closeHandle tells the server the handle is closed.
+func (f *File) closeHandle() error {
+	if f.mode == DWRITE {
+		f.c.forgetFile(f)
+		// Failed replays are retried when the DFS next connects
+		if f.c.getShouldSendPing() {
+			err := f.c.reconcileFile(f.filename)
+			if err != nil {f.c.logger.Println(err)}
+		}
 		return nil
 	}
-	if f.isOpen {
+	if f.mode == DREAD && (!f.getIsOpen() || f.handleId == shared.UnsetHandleId) {
+		f.c.forgetFile(f)
+		return nil
+	}
+	if f.getIsOpen() {
 		req := shared.CloseFileRequest{
-			ClientId: f.c.clientId, Filename: f.filename, Mode: convertMode(f.c.currentMode)}
+			ClientId: f.c.link.getClientId(), Filename: f.filename, Mode: convertMode(f.mode), HandleId: f.handleId}
 		var res shared.CloseFileResponse
-		err := f.c.rpcClient.Call("Server.CloseFile", req, &res)
+		err := f.c.link.client().Call("Server.CloseFile", req, &res)
+		f.c.forgetFile(f)
+		// A DREAD handle closes even if the server cannot be told
+		if f.mode == DREAD {return nil}
 		if err != nil || !res.Success {
-			log.Printf("Error: failed to close file [%s]\n", f.filename)
-			log.Println(err)
-			f.isOpen = false
-			return DisconnectedError(f.c.serverAddr.String())
+			f.c.logger.Printf("Error: failed to close file [%s]\n", f.filename)
+			f.c.logger.Println(err)
+			return DisconnectedError(f.c.link.addr().String())
 		} else {
-			f.isOpen = false
 			return nil
 		}
 	} else {
-		return DisconnectedError(f.c.serverAddr.String())
+		return DisconnectedError(f.c.link.addr().String())
 	}
 }
 
+// grantLease records the lease granted when the file was opened, counting its
+// duration from grantedAt (when the request was sent).
+func (f *File) grantLease(lease shared.Lease, grantedAt time.Time) {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	f.lease = lease
+	f.leaseExpiry = grantedAt.Add(lease.Duration)
+}
+
+// leaseToken returns the fencing token of the file's write lease, and false if
+// the lease has lapsed.
+func (f *File) leaseToken() (int, bool) {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	return f.lease.Token, time.Now().Before(f.leaseExpiry)
+}
+
+// getIsOpen reports whether the handle is still open.
+func (f *File) getIsOpen() bool {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	return f.isOpen
+}
+
+// markClosed marks the handle closed once the server can no longer be reached.
+func (f *File) markClosed() {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	f.isOpen = false
+}
+
+// getIsBuffered reports whether writes are staged until the next flush.
+func (f *File) getIsBuffered() bool {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	return f.isBuffered
+}
+
+// stageChunk stages a buffered write of a chunk, replacing an earlier one.
+func (f *File) stageChunk(chunkNum uint64, data []byte) {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	if f.staged == nil {f.staged = make(map[uint64][]byte)}
+	f.staged[chunkNum] = data
+}
+
+// stagedChunk returns the staged write of a chunk, and false if there is none.
+func (f *File) stagedChunk(chunkNum uint64) ([]byte, bool) {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	data, exists := f.staged[chunkNum]
+	return data, exists
+}
+
+// takeStaged removes the staged writes from the handle and returns them.
+func (f *File) takeStaged() map[uint64][]byte {
+	f.c.lock.Lock()
+	defer f.c.lock.Unlock()
+	staged := f.staged
+	f.staged = nil
+	return staged
+}
+
 // Returns the absolute path for the file
-func (f File) getFilePath() string {
+func (f *File) getFilePath() string {
 	if strings.HasSuffix(f.c.localPath, "/") {
 		return f.c.localPath + f.filename + shared.FileExtension
 	} else {
@@ -170,10 +492,25 @@ func (f File) getFilePath() string {
 	}
 }
 
-// Convert dfslib.Chunk into a type shareable between server and client
-func convertChunkToChunk(chunk *Chunk) shared.Chunk {
-	var d [32]byte
-	copy(d[:], chunk[:])
-	return shared.Chunk{Data: d}
+// Copy chunk data into a type shareable between server and client
+func newChunk(chunkNum uint64, data []byte) shared.Chunk {
+	d := make([]byte, len(data))
+	copy(d, data)
+	return shared.Chunk{ChunkNum: chunkNum, Data: d}
+}
+
+// wholeChunk returns data as a whole chunk of chunkSize bytes, padded with zeros.
+func wholeChunk(data []byte, chunkSize int) []byte {
+	if len(data) == chunkSize {return data}
+	whole := make([]byte, chunkSize)
+	copy(whole, data)
+	return whole
+}
 
+// copyChunk copies src into dst, and zeros the rest of dst.
+func copyChunk(dst []byte, src []byte) {
+	n := copy(dst, src)
+	for i := n; i < len(dst); i++ {
+		dst[i] = 0
+	}
 }
@@ -0,0 +1,249 @@
+package dfslib
+
+import (
+	"../shared"
+	"encoding/json"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Number of times conflicting chunks are replayed again after being settled,
+// since the server's version may move on again in the meantime
+const MaxReconcileRounds = 3
+
+func (c *DFSConnection) SetConflictResolver(resolver ConflictResolver) (err error) {
+	c.lock.Lock()
+	c.resolver = resolver
+	c.lock.Unlock()
+
+	if !c.getShouldSendPing() {return nil}
+	return c.reconcileAll()
+}
+
+func (c *DFSConnection) getConflictResolver() ConflictResolver {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.resolver
+}
+
+// Returns the path of the journal of the chunks of the local file at filePath
+// written in DWRITE mode and not replayed yet.
+func getJournalFilePath(filePath string) string {
+	return strings.TrimSuffix(filePath, shared.FileExtension) + JournalFileExtension
+}
+
+// journalChunk writes a chunk to the local copy of a file in DWRITE mode and
+// journals it for replay. The chunk keeps the base version of its first
+// journaled write.
+func (c *DFSConnection) journalChunk(filename string, chunk shared.Chunk) error {
+	c.journalLock.Lock()
+	defer c.journalLock.Unlock()
+	filePath := getFilePath(c.localPath, filename)
+	chunkNum := chunk.ChunkNum
+
+	journal, err := c.readJournal(filePath)
+	if err != nil {return err}
+	entry, exists := journal[chunkNum]
+	if !exists {
+		entry.BaseVersion = c.localChunkVersion(filePath, chunkNum)
+	}
+	// Journaled chunks have no version until the server accepts them
+	entry.ChunkData = chunk
+	entry.ChunkData.Version = shared.NoVersion
+	journal[chunkNum] = entry
+	err = c.writeJournal(filePath, journal)
+	if err != nil {return err}
+
+	// The local copy no longer holds a version the server knows
+	c.cache.forget(filename, chunkNum)
+	return c.writeChunksToDisk([]shared.Chunk{entry.ChunkData}, filePath)
+}
+
+// readJournaledChunk returns the journaled chunk of a file if there is one, or
+// else the chunk held in its local copy.
+func (c *DFSConnection) readJournaledChunk(filename string, chunkNum uint64, chunkSize int) (shared.Chunk, error) {
+	c.journalLock.Lock()
+	defer c.journalLock.Unlock()
+	filePath := getFilePath(c.localPath, filename)
+
+	journal, err := c.readJournal(filePath)
+	if err != nil {return shared.Chunk{}, err}
+	if entry, exists := journal[chunkNum]; exists {return entry.ChunkData, nil}
+	return c.readChunkFromDisk(filePath, chunkNum, chunkSize)
+}
+
+// isJournaled reports whether a chunk of a file is journaled, waiting for a replay.
+func (c *DFSConnection) isJournaled(filename string, chunkNum uint64) bool {
+	c.journalLock.Lock()
+	defer c.journalLock.Unlock()
+	journal, _ := c.readJournal(getFilePath(c.localPath, filename))
+	_, exists := journal[chunkNum]
+	return exists
+}
+
+// readJournal returns the journaled chunks of the local file at filePath.
+func (c *DFSConnection) readJournal(filePath string) (map[uint64]shared.JournalChunk, error) {
+	journal := make(map[uint64]shared.JournalChunk)
+
+	data, err := ioutil.ReadFile(getJournalFilePath(filePath))
+	if os.IsNotExist(err) {return journal, nil}
+	if err != nil {
+		c.logger.Printf("Error: cannot read journal for [%s]\n", filePath)
+		return journal, err
+	}
+
+	err = json.Unmarshal(data, &journal)
+	if err != nil {
+		c.logger.Printf("Error: cannot parse journal for [%s]\n", filePath)
+		return make(map[uint64]shared.JournalChunk), err
+	}
+	return journal, nil
+}
+
+// writeJournal replaces the journal of the local file at filePath, removing it
+// once it is empty.
+func (c *DFSConnection) writeJournal(filePath string, journal map[uint64]shared.JournalChunk) error {
+	if len(journal) == 0 {
+		err := os.Remove(getJournalFilePath(filePath))
+		if os.IsNotExist(err) {return nil}
+		return err
+	}
+
+	data, err := json.Marshal(journal)
+	if err != nil {return err}
+
+	err = writeFileAtomically(getJournalFilePath(filePath), data)
+	if err != nil {
+		c.logger.Printf("Error: cannot write journal for [%s]\n", filePath)
+	}
+	return err
+}
+
+// reconcileAll replays the journal of every local file. A file that cannot be
+// replayed does not hold up the others, unless the server stopped answering.
+func (c *DFSConnection) reconcileAll() error {
+	entries, err := ioutil.ReadDir(c.localPath)
+	if err != nil {
+		c.logger.Printf("Error: cannot list local path [%s]\n", c.localPath)
+		return nil
+	}
+
+	for _, entry := range entries {
+		filename := strings.TrimSuffix(entry.Name(), JournalFileExtension)
+		if entry.IsDir() || filename == entry.Name() || !isFileNameValid(filename) {continue}
+
+		err = c.reconcileFile(filename)
+		if _, isDisconnected := err.(DisconnectedError); isDisconnected {return err}
+		if err != nil {c.logger.Printf("Error: cannot replay journal of [%s]: %s\n", filename, err)}
+	}
+	return nil
+}
+
+// reconcileFile replays the journal of a file. Chunks the server accepts are
+// dropped from the journal, and conflicts are settled by the resolver. Chunks
+// stay journaled, to be replayed again later, if another client holds a lock on
+// them or their conflict could not be settled. Chunks the server refuses (e.g.
+// of another chunk size than the file's) would never be accepted, so they are
+// dropped.
+func (c *DFSConnection) reconcileFile(filename string) error {
+	c.journalLock.Lock()
+	defer c.journalLock.Unlock()
+	filePath := getFilePath(c.localPath, filename)
+
+	for round := 0; round < MaxReconcileRounds; round++ {
+		journal, err := c.readJournal(filePath)
+		if err != nil || len(journal) == 0 {return err}
+
+		req := shared.ReconcileRequest{ClientId: c.link.getClientId(), Filename: filename, Layout: c.localLayout(filename)}
+		for _, entry := range journal {
+			req.Chunks = append(req.Chunks, entry)
+		}
+		sort.Slice(req.Chunks, func(i, j int) bool {
+			return req.Chunks[i].ChunkData.ChunkNum < req.Chunks[j].ChunkData.ChunkNum
+		})
+		var resp shared.ReconcileResponse
+		err = c.link.client().Call("Server.Reconcile", req, &resp)
+		if err != nil {
+			c.logger.Println(err)
+			// The server answered, so it may take the other files' replays
+			if _, isServerError := err.(rpc.ServerError); isServerError {return err}
+			return DisconnectedError(c.link.addr().String())
+		}
+		if resp.IsLocked {
+			c.logger.Printf("File [%s] is locked by another client; replay postponed\n", filename)
+			return nil
+		}
+		c.recordFileId(filename, resp.FileId)
+
+		// This client now owns the written versions
+		var written []shared.Chunk
+		for _, chunk := range resp.Written {
+			chunk.Data = journal[chunk.ChunkNum].ChunkData.Data
+			written = append(written, chunk)
+			delete(journal, chunk.ChunkNum)
+		}
+		for _, chunkNum := range resp.Refused {
+			c.logger.Printf("Error: server refused file [%s] chunk [%d]; dropped from the journal\n", filename, chunkNum)
+			delete(journal, chunkNum)
+		}
+		isRebased, theirs := c.resolveConflicts(filename, journal, resp.Conflicts)
+
+		err = c.writeJournal(filePath, journal)
+		if err != nil {return err}
+		written = append(written, theirs...)
+		if len(written) > 0 {
+			err = c.writeChunksToDisk(written, filePath)
+			if err != nil {return err}
+		}
+		if !isRebased {return nil}
+	}
+	return nil
+}
+
+// resolveConflicts asks the resolver to settle each conflict. Kept and merged
+// chunks are rebased in the journal onto the current version, and returns true
+// if there are any. Chunks settled with the current version are dropped from the
+// journal and returned, to be stored locally.
+func (c *DFSConnection) resolveConflicts(filename string, journal map[uint64]shared.JournalChunk,
+	conflicts []shared.ChunkConflict) (isRebased bool, theirs []shared.Chunk) {
+	resolver := c.getConflictResolver()
+
+	for _, conflict := range conflicts {
+		if resolver == nil || conflict.IsUnavailable {
+			c.logger.Printf("Conflict: file [%s] chunk [%d] is now at ver [%d]; left unsettled\n",
+				filename, conflict.ChunkNum, conflict.Current.Version)
+			continue
+		}
+
+		entry := journal[conflict.ChunkNum]
+		chunkSize := len(entry.ChunkData.Data)
+		// Chunks that were never written to come back without data
+		conflict.Current.Data = wholeChunk(conflict.Current.Data, chunkSize)
+		writeConflict := WriteConflict{
+			Filename:     filename,
+			ChunkNum:     conflict.ChunkNum,
+			Mine:         newChunk(conflict.ChunkNum, entry.ChunkData.Data).Data,
+			Theirs:       newChunk(conflict.ChunkNum, conflict.Current.Data).Data,
+			BaseVersion:  entry.BaseVersion,
+			TheirVersion: conflict.Current.Version,
+		}
+
+		resolution, merged := resolver(writeConflict)
+		switch resolution {
+		case KeepTheirs:
+			delete(journal, conflict.ChunkNum)
+			theirs = append(theirs, conflict.Current)
+			continue
+		case Merge:
+			entry.ChunkData = newChunk(conflict.ChunkNum, wholeChunk(merged, chunkSize))
+			entry.ChunkData.Version = shared.NoVersion
+		}
+		entry.BaseVersion = conflict.Current.Version
+		journal[conflict.ChunkNum] = entry
+		isRebased = true
+	}
+	return isRebased, theirs
+}
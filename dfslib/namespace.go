@@ -0,0 +1,165 @@
+package dfslib
+
+import (
+	"os"
+	"../shared"
+)
+
+func (c *DFSConnection) DeleteFile(fname string) (err error) {
+	if !isFileNameValid(fname) {return BadFilenameError(fname)}
+	req := shared.DeleteFileRequest{ClientId: c.link.getClientId(), Filename: fname}
+	return c.changeFile("Server.DeleteFile", req, shared.FileChange{Op: shared.DeleteChange, Filename: fname})
+}
+
+func (c *DFSConnection) RenameFile(fname string, newFname string) (err error) {
+	if !isFileNameValid(fname) {return BadFilenameError(fname)}
+	if !isFileNameValid(newFname) {return BadFilenameError(newFname)}
+	req := shared.RenameFileRequest{ClientId: c.link.getClientId(), Filename: fname, NewFilename: newFname}
+	change := shared.FileChange{Op: shared.RenameChange, Filename: fname, NewFilename: newFname}
+	return c.changeFile("Server.RenameFile", req, change)
+}
+
+func (c *DFSConnection) TruncateFile(fname string, numChunks uint64) (err error) {
+	if !isFileNameValid(fname) {return BadFilenameError(fname)}
+	// Too large whatever the chunk size; the server checks against the file's own
+	if numChunks > shared.MaxFileSize {return BadChunkNumError(numChunks - 1)}
+	req := shared.TruncateFileRequest{ClientId: c.link.getClientId(), Filename: fname, NumChunks: numChunks}
+	change := shared.FileChange{Op: shared.TruncateChange, Filename: fname, NumChunks: numChunks}
+	return c.changeFile("Server.TruncateFile", req, change)
+}
+
+// changeFile asks the server to make a change to a file with method, then makes
+// it to the local copy. The server tells the other clients itself.
+func (c *DFSConnection) changeFile(method string, req interface{}, change shared.FileChange) error {
+	if !c.isConnected() {return DisconnectedError(c.link.addr().String())}
+
+	var resp shared.FileChangeResponse
+	err := c.link.client().Call(method, req, &resp)
+	if err != nil {return DisconnectedError(c.link.addr().String())}
+	if resp.NotFound {return FileNotFoundError(change.Filename)}
+	if resp.Exists {return FileExistsError(change.NewFilename)}
+	if resp.TooLarge {return BadChunkNumError(change.NumChunks - 1)}
+	if resp.ConflictError {
+		c.logger.Printf("Error: Write conflict: [%s]\n", change.Filename)
+		return newWriteConflictError(change.Filename, resp.Conflict)
+	}
+
+	c.applyFileChange(change)
+	return nil
+}
+
+// applyFileChange makes a change the server made to a file to its local copy.
+// Handles on a deleted or renamed file are closed, whatever their mode; handles
+// on a truncated file stay open, and read zeros past its new end.
+func (c *DFSConnection) applyFileChange(change shared.FileChange) {
+	switch change.Op {
+	case shared.DeleteChange:
+		c.dropHandles(change.Filename)
+		c.removeLocalFile(change.Filename)
+	case shared.RenameChange:
+		c.dropHandles(change.Filename)
+		c.dropHandles(change.NewFilename)
+		c.renameLocalFile(change.Filename, change.NewFilename)
+	case shared.TruncateChange:
+		c.truncateLocalFile(change.Filename, change.NumChunks)
+	}
+}
+
+// dropHandles closes every handle on filename without telling the server, which
+// has already released them.
+func (c *DFSConnection) dropHandles(filename string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for file := range c.files {
+		if file.filename != filename {continue}
+		file.isOpen = false
+		delete(c.files, file)
+	}
+}
+
+// localFilePaths returns the paths of the local file at filePath and of the files
+// kept next to it. The journal comes first, so that a journal is never replayed
+// for a file that was removed.
+func localFilePaths(filePath string) []string {
+	return []string{
+		getJournalFilePath(filePath),
+		filePath,
+		getVersionFilePath(filePath),
+		getLayoutFilePath(filePath),
+	}
+}
+
+// removeLocalFile removes the local copy of a file, along with its journal.
+func (c *DFSConnection) removeLocalFile(filename string) {
+	c.journalLock.Lock()
+	defer c.journalLock.Unlock()
+	c.metadataLock.Lock()
+	defer c.metadataLock.Unlock()
+
+	c.cache.forgetFile(filename)
+	for _, path := range localFilePaths(getFilePath(c.localPath, filename)) {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {c.logger.Printf("Error: cannot remove [%s]\n", path)}
+	}
+}
+
+// renameLocalFile moves the local copy of a file, along with its journal, to a
+// new name. Whatever was held locally under the new name is removed first.
+func (c *DFSConnection) renameLocalFile(filename string, newFilename string) {
+	c.journalLock.Lock()
+	defer c.journalLock.Unlock()
+	c.metadataLock.Lock()
+	defer c.metadataLock.Unlock()
+
+	c.cache.forgetFile(filename)
+	c.cache.forgetFile(newFilename)
+	oldPaths := localFilePaths(getFilePath(c.localPath, filename))
+	newPaths := localFilePaths(getFilePath(c.localPath, newFilename))
+	for i := range newPaths {
+		err := os.Remove(newPaths[i])
+		if err != nil && !os.IsNotExist(err) {c.logger.Printf("Error: cannot remove [%s]\n", newPaths[i])}
+	}
+	// The journal moves last, so that it is never replayed under the old name
+	// for a file that has moved
+	for i := len(oldPaths) - 1; i >= 0; i-- {
+		err := os.Rename(oldPaths[i], newPaths[i])
+		if err != nil && !os.IsNotExist(err) {c.logger.Printf("Error: cannot move [%s]\n", oldPaths[i])}
+	}
+}
+
+// truncateLocalFile cuts or grows the local copy of a file to numChunks chunks.
+// The versions and journaled writes of the chunks past its new end are dropped.
+func (c *DFSConnection) truncateLocalFile(filename string, numChunks uint64) {
+	c.journalLock.Lock()
+	defer c.journalLock.Unlock()
+	c.metadataLock.Lock()
+	defer c.metadataLock.Unlock()
+
+	c.cache.forgetFile(filename)
+	filePath := getFilePath(c.localPath, filename)
+	if _, err := os.Stat(filePath); err != nil {return}
+	err := os.Truncate(filePath, getByteOffset(numChunks, c.localLayout(filename).ChunkSize))
+	if err != nil {c.logger.Printf("Error: cannot truncate file [%s]\n", filename)}
+
+	metadata, err := c.readChunkMetadata(filePath)
+	if err == nil {
+		changed := false
+		for chunkNum := range metadata {
+			if chunkNum < numChunks {continue}
+			delete(metadata, chunkNum)
+			changed = true
+		}
+		if changed {c.writeChunkMetadata(filePath, metadata)}
+	}
+
+	journal, err := c.readJournal(filePath)
+	if err == nil {
+		changed := false
+		for chunkNum := range journal {
+			if chunkNum < numChunks {continue}
+			delete(journal, chunkNum)
+			changed = true
+		}
+		if changed {c.writeJournal(filePath, journal)}
+	}
+}
@@ -0,0 +1,189 @@
+package dfslib
+
+import (
+	"log"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+	"../shared"
+)
+
+// Number of times a registration is retried with the leader a Raft follower points to
+const MaxLeaderRedirects = 5
+// How long to wait for a Raft cluster that is electing a leader before retrying
+const LeaderElectionWait = 500 * time.Millisecond
+// Number of passes a failover makes over the servers, FailoverRetryWait apart. A standby
+// only takes over once the primary has been silent for a few seconds, so it may refuse
+// the client on the first pass.
+const FailoverPasses = 5
+const FailoverRetryWait = 1 * time.Second
+
+// serverLink is the RPC connection to the DFS server, shared by every open File
+// of a mount, so that after a failover to a backup server all of them talk to the
+// new server.
+type serverLink struct {
+	// addrs lists the servers to use, primary first
+	addrs     []*net.TCPAddr
+	current   int
+	rpcClient *rpc.Client
+	// clientId is the ID the server in use registered the mount under
+	clientId  int
+	// stateLock guards addrs, current, rpcClient and clientId, which a failover
+	// changes while Files are calling the server
+	stateLock sync.Mutex
+	// lock serializes failovers
+	lock      sync.Mutex
+	logger    *log.Logger
+}
+
+// addr returns the address of the server currently in use.
+func (l *serverLink) addr() *net.TCPAddr {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	if len(l.addrs) == 0 {return nil}
+	return l.addrs[l.current]
+}
+
+// servers returns the servers to use and the index of the one currently in use.
+func (l *serverLink) servers() ([]*net.TCPAddr, int) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	return append([]*net.TCPAddr(nil), l.addrs...), l.current
+}
+
+// setCurrent makes the server at index idx the one in use.
+func (l *serverLink) setCurrent(idx int) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	l.current = idx
+}
+
+// client returns the RPC client of the server the mount is registered with.
+func (l *serverLink) client() *rpc.Client {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	return l.rpcClient
+}
+
+// getClientId returns the ID the mount is registered under.
+func (l *serverLink) getClientId() int {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	return l.clientId
+}
+
+// setRegistration records the server the mount registered with and its ID there.
+func (l *serverLink) setRegistration(server *rpc.Client, clientId int) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	l.rpcClient = server
+	l.clientId = clientId
+}
+
+// dial connects to the first reachable server, starting from the current one.
+func (l *serverLink) dial() (*rpc.Client, error) {
+	addrs, current := l.servers()
+	err := error(DisconnectedError(l.addr().String()))
+	for i := 0; i < len(addrs); i++ {
+		idx := (current + i) % len(addrs)
+		var server *rpc.Client
+		server, err = rpc.Dial("tcp", addrs[idx].String())
+		if err == nil {
+			l.setCurrent(idx)
+			return server, nil
+		}
+		l.logger.Printf("Cannot reach server [%s]\n", addrs[idx])
+	}
+	return nil, err
+}
+
+// useAddr makes addr the server in use, adding it to the list if needed.
+func (l *serverLink) useAddr(addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {return err}
+
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	for i, known := range l.addrs {
+		if known.String() == tcpAddr.String() {
+			l.current = i
+			return nil
+		}
+	}
+	l.addrs = append(l.addrs, tcpAddr)
+	l.current = len(l.addrs) - 1
+	return nil
+}
+
+// isNotLeaderError reports whether err is a Raft follower refusing a call, and
+// if so, the address of the leader it points to ("" if there is none yet).
+func isNotLeaderError(err error) (bool, string) {
+	if err == nil || !strings.HasPrefix(err.Error(), shared.NotLeaderErrorPrefix) {return false, ""}
+	return true, strings.TrimPrefix(err.Error(), shared.NotLeaderErrorPrefix)
+}
+
+// registerWithLeader registers with a newly dialed server. If the server is a Raft
+// follower, registration is retried with the leader it points to.
+func (c *DFSConnection) registerWithLeader(server *rpc.Client) (registered bool, err error) {
+	for i := 0; i < MaxLeaderRedirects; i++ {
+		registered, err = c.register(server)
+		notLeader, leaderAddr := isNotLeaderError(err)
+		if registered {return true, nil}
+		if !notLeader {
+			server.Close()
+			return false, err
+		}
+
+		if leaderAddr == "" {
+			// An election is in progress; ask the same server again once it is over
+			time.Sleep(LeaderElectionWait)
+			continue
+		}
+
+		c.logger.Printf("Redirected to leader [%s]\n", leaderAddr)
+		server.Close()
+		err = c.link.useAddr(leaderAddr)
+		if err != nil {return false, err}
+		server, err = rpc.Dial("tcp", leaderAddr)
+		if err != nil {return false, err}
+	}
+	server.Close()
+	return false, err
+}
+
+// failover re-registers this client with the next reachable server once the
+// current one stops answering (or, in a Raft cluster, stops being the leader).
+// failed is the RPC client that stopped answering; if another caller has
+// already replaced it, there is nothing left to do.
+// The server that failed is tried last. Returns false if no server accepted the client.
+func (c *DFSConnection) failover(failed *rpc.Client) bool {
+	l := c.link
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.client() != failed {return true}
+
+	addrs, failedIdx := l.servers()
+	if len(addrs) < 2 {return false}
+	for pass := 0; pass < FailoverPasses; pass++ {
+		if pass > 0 {time.Sleep(FailoverRetryWait)}
+		for i := 1; i <= len(addrs); i++ {
+			idx := (failedIdx + i) % len(addrs)
+			server, err := rpc.Dial("tcp", addrs[idx].String())
+			if err != nil {continue}
+
+			l.setCurrent(idx)
+			registered, err := c.registerWithLeader(server)
+			if registered {
+				c.logger.Printf("Client [%d] failed over from server [%s] to [%s]\n",
+					l.getClientId(), addrs[failedIdx], l.addr())
+				go c.reconcileAll()
+				return true
+			}
+			if err != nil {c.logger.Printf("Server [%s] refused client: %s", addrs[idx], err)}
+		}
+	}
+	l.setCurrent(failedIdx)
+	return false
+}
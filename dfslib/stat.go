@@ -0,0 +1,115 @@
+package dfslib
+
+import (
+	"strings"
+	"../shared"
+)
+
+func (c *DFSConnection) Stat(fname string) (stat FileStat, err error) {
+	if !isFileNameValid(fname) {return FileStat{}, BadFilenameError(fname)}
+	if !c.isConnected() {return FileStat{}, DisconnectedError(c.link.addr().String())}
+
+	req := shared.StatRequest{Filename: fname}
+	var resp shared.StatResponse
+	err = c.link.client().Call("Server.Stat", req, &resp)
+	if err != nil {return FileStat{}, DisconnectedError(c.link.addr().String())}
+	if !resp.Exists {return FileStat{}, FileNotFoundError(fname)}
+	return convertFileStat(resp.Stat), nil
+}
+
+// Convert the server's description of a file into a FileStat
+func convertFileStat(s shared.FileStat) FileStat {
+	layout := s.Layout
+	if !layout.IsValid() {layout = shared.DefaultLayout}
+	stat := FileStat{
+		Filename:        s.Filename,
+		ChunkSize:       layout.ChunkSize,
+		NumChunks:       layout.NumChunks,
+		ChunkVersions:   s.ChunkVersions,
+		LastWriter:      s.LastWriter,
+		LastModified:    s.LastModified,
+		AvailableChunks: s.AvailableChunks,
+	}
+	if stat.ChunkVersions == nil {stat.ChunkVersions = make(map[uint64]int)}
+	for _, lock := range s.Locks {
+		stat.LockHolders = append(stat.LockHolders, LockHolder{
+			ClientId: lock.ClientId,
+			Address:  lock.ClientAddress,
+			Chunks:   lock.Ranges,
+			Since:    lock.Since,
+		})
+	}
+	return stat
+}
+
+func (c *DFSConnection) ListFiles(prefix string) (files []FileStat, err error) {
+	after := ""
+	for {
+		page, next, err := c.ListFilesPage(prefix, "", after, 0)
+		if err != nil {return nil, err}
+		files = append(files, page...)
+		if next == "" {return files, nil}
+		after = next
+	}
+}
+
+func (c *DFSConnection) ListFilesPage(prefix string, pattern string, after string, limit int) (
+	files []FileStat, next string, err error) {
+	if !isPrefixValid(prefix) {return nil, "", BadFilenameError(prefix)}
+	if !c.isConnected() {return nil, "", DisconnectedError(c.link.addr().String())}
+
+	req := shared.ListFilesRequest{Prefix: prefix, Pattern: pattern, After: after, Limit: limit}
+	var resp shared.ListFilesResponse
+	err = c.link.client().Call("Server.ListFiles", req, &resp)
+	if err != nil {return nil, "", DisconnectedError(c.link.addr().String())}
+	if resp.BadPattern {return nil, "", BadPatternError(pattern)}
+
+	for _, stat := range resp.Files {
+		files = append(files, convertFileStat(stat))
+	}
+	return files, resp.Next, nil
+}
+
+func (c *DFSConnection) ListLocalFiles(prefix string) (files []LocalFileStat, err error) {
+	if !isPrefixValid(prefix) {return nil, BadFilenameError(prefix)}
+	filenames, err := c.localFileNames()
+	if err != nil {return nil, LocalPathError(c.localPath)}
+
+	for _, filename := range filenames {
+		if !strings.HasPrefix(filename, prefix) {continue}
+		files = append(files, c.localFileStat(filename))
+	}
+	return files, nil
+}
+
+// localFileStat describes the local copy of a file from its version file and journal.
+func (c *DFSConnection) localFileStat(filename string) LocalFileStat {
+	filePath := getFilePath(c.localPath, filename)
+	layout := c.localLayout(filename)
+	stat := LocalFileStat{
+		Filename:      filename,
+		ChunkSize:     layout.ChunkSize,
+		NumChunks:     layout.NumChunks,
+		ChunkVersions: make(map[uint64]int),
+	}
+
+	c.metadataLock.Lock()
+	metadata, err := c.readChunkMetadata(filePath)
+	c.metadataLock.Unlock()
+	if err != nil {c.logger.Println(err)}
+	for chunkNum, meta := range metadata {
+		if meta.Version != shared.NoVersion {stat.ChunkVersions[chunkNum] = meta.Version}
+		if meta.latestVersion() > meta.Version {stat.StaleChunks++}
+	}
+
+	c.journalLock.Lock()
+	journal, _ := c.readJournal(filePath)
+	c.journalLock.Unlock()
+	stat.PendingChunks = len(journal)
+	return stat
+}
+
+// Prefixes of valid filenames, including the empty prefix, are valid
+func isPrefixValid(prefix string) bool {
+	return prefix == "" || isFileNameValid(prefix)
+}
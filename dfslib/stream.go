@@ -0,0 +1,113 @@
+package dfslib
+
+import (
+	"fmt"
+	"io"
+)
+
+// Contains the offset that is before the start of the file
+type OffsetOutOfRangeError int64
+
+func (e OffsetOutOfRangeError) Error() string {
+	return fmt.Sprintf("DFS: Offset [%d] is before the start of the file", int64(e))
+}
+
+// FileStream is a byte-stream view of an open DFSFile, so it can be used with
+// the io package and the libraries built on it. It implements io.Reader,
+// io.ReaderAt, io.Writer, io.WriterAt and io.Seeker.
+//
+// Reads and writes at any offset are split into the chunks they cover, and
+// chunks that are only partly written are read first. Writing past the end of
+// the file grows it by whole chunks. Errors of the DFSFile
+// (e.g. ChunkUnavailableError, WriteModeTimeoutError) are returned as they are.
+// Like the DFSFile it wraps, a FileStream is not safe for concurrent use.
+type FileStream struct {
+	file   DFSFile
+	offset int64
+}
+
+// NewFileStream returns a stream over file, positioned at its start.
+func NewFileStream(file DFSFile) *FileStream {
+	return &FileStream{file: file}
+}
+
+// ReadAt reads len(p) bytes from offset off. It returns io.EOF if the file ends first.
+func (s *FileStream) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {return 0, OffsetOutOfRangeError(off)}
+
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= s.size() {return n, io.EOF}
+
+		chunkNum, inChunk := s.chunkAt(pos)
+		chunk := make([]byte, s.file.ChunkSize())
+		err = s.file.ReadChunk(chunkNum, chunk)
+		if err != nil {return n, err}
+		n += copy(p[n:], chunk[inChunk:])
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset off, growing the file if it ends before all of p
+// is written.
+func (s *FileStream) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {return 0, OffsetOutOfRangeError(off)}
+
+	for n < len(p) {
+		pos := off + int64(n)
+		chunkNum, inChunk := s.chunkAt(pos)
+		chunk := make([]byte, s.file.ChunkSize())
+		if (inChunk != 0 || len(p) - n < len(chunk)) && pos < s.size() {
+			// The rest of the chunk is kept as it is
+			err = s.file.ReadChunk(chunkNum, chunk)
+			if err != nil {return n, err}
+		}
+		written := copy(chunk[inChunk:], p[n:])
+		err = s.file.WriteChunk(chunkNum, chunk)
+		if err != nil {return n, err}
+		n += written
+	}
+	return n, nil
+}
+
+// Read reads up to len(p) bytes from the current offset, and advances it.
+func (s *FileStream) Read(p []byte) (n int, err error) {
+	n, err = s.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	return n, err
+}
+
+// Write writes p at the current offset, and advances it.
+func (s *FileStream) Write(p []byte) (n int, err error) {
+	n, err = s.WriteAt(p, s.offset)
+	s.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset of the next Read or Write, relative to the start of the
+// file, the current offset or the end of the file, depending on whence.
+func (s *FileStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size()
+	default:
+		return s.offset, fmt.Errorf("DFS: Invalid whence [%d]", whence)
+	}
+	if offset < 0 {return s.offset, OffsetOutOfRangeError(offset)}
+	s.offset = offset
+	return offset, nil
+}
+
+// size returns the number of bytes in the file.
+func (s *FileStream) size() int64 {
+	return getByteOffset(s.file.NumChunks(), s.file.ChunkSize())
+}
+
+// chunkAt returns the chunk holding the byte at offset pos, and the byte's offset in it.
+func (s *FileStream) chunkAt(pos int64) (chunkNum uint64, inChunk int) {
+	chunkSize := int64(s.file.ChunkSize())
+	return uint64(pos / chunkSize), int(pos % chunkSize)
+}
@@ -0,0 +1,102 @@
+package dfslib
+
+import (
+	"../shared"
+	"time"
+)
+
+func (c *DFSConnection) OpenWithWait(fname string, mode FileMode, timeout time.Duration) (f DFSFile, err error) {
+	f, err = c.Open(fname, mode)
+	if _, isConflict := err.(OpenWriteConflictError); !isConflict {return f, err}
+
+	enqueueReq := shared.EnqueueWriteRequest{ClientId: c.link.getClientId(), Filename: fname, Chunks: shared.WholeFile}
+	var position shared.WaitPosition
+	err = c.link.client().Call("Server.EnqueueWrite", enqueueReq, &position)
+	if err != nil || position.TicketId == shared.UnsetTicketId {
+		return nil, DisconnectedError(c.link.addr().String())
+	}
+	c.logger.Printf("Waiting for [%s] with ticket [%d] at position [%d]\n", fname, position.TicketId, position.Position)
+	c.addWaitTicket(position.TicketId, fname)
+	defer c.removeWaitTicket(position.TicketId)
+
+	awaitReq := shared.AwaitWriteLockRequest{
+		ClientId: c.link.getClientId(),
+		Filename: fname,
+		TicketId: position.TicketId,
+		Timeout:  timeout,
+	}
+	var resp shared.OpenFileResponse
+	generation := c.cache.currentGeneration()
+	err = c.link.client().Call("Server.AwaitWriteLock", awaitReq, &resp)
+	if err != nil {
+		return nil, DisconnectedError(c.link.addr().String())
+	}
+	if resp.WaitTimedOut {
+		c.logger.Printf("Error: timed out waiting for [%s]\n", fname)
+		return nil, OpenWaitTimeoutError(fname)
+	}
+	if resp.WaitCancelled {
+		if !c.isConnected() {return nil, DisconnectedError(c.link.addr().String())}
+		c.logger.Printf("Stopped waiting for [%s]\n", fname)
+		return nil, OpenWaitCancelledError(fname)
+	}
+
+	// The lease was granted at some point during the wait; count it from a
+	// heartbeat sent now, which renews it
+	grantedAt := time.Now()
+	if !c.isConnected() {return nil, DisconnectedError(c.link.addr().String())}
+	return c.openFromResponse(fname, mode, shared.WholeFile, &resp, grantedAt, generation)
+}
+
+func (c *DFSConnection) WaitPosition(fname string) (position int, err error) {
+	if !isFileNameValid(fname) {return 0, BadFilenameError(fname)}
+	if !c.isConnected() {return 0, DisconnectedError(c.link.addr().String())}
+
+	for _, ticketId := range c.waitTicketsFor(fname) {
+		req := shared.WaitTicketRequest{ClientId: c.link.getClientId(), Filename: fname, TicketId: ticketId}
+		var reply shared.WaitPosition
+		err = c.link.client().Call("Server.GetWaitPosition", req, &reply)
+		if err != nil {return 0, DisconnectedError(c.link.addr().String())}
+		if reply.Position > 0 && (position == 0 || reply.Position < position) {
+			position = reply.Position
+		}
+	}
+	return position, nil
+}
+
+func (c *DFSConnection) CancelWait(fname string) (err error) {
+	if !isFileNameValid(fname) {return BadFilenameError(fname)}
+	if !c.isConnected() {return DisconnectedError(c.link.addr().String())}
+
+	for _, ticketId := range c.waitTicketsFor(fname) {
+		req := shared.WaitTicketRequest{ClientId: c.link.getClientId(), Filename: fname, TicketId: ticketId}
+		var cancelled bool
+		err = c.link.client().Call("Server.CancelWait", req, &cancelled)
+		if err != nil {return DisconnectedError(c.link.addr().String())}
+	}
+	return nil
+}
+
+// addWaitTicket records a pending OpenWithWait on filename.
+func (c *DFSConnection) addWaitTicket(ticketId int, filename string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.waitTickets[ticketId] = filename
+}
+
+func (c *DFSConnection) removeWaitTicket(ticketId int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.waitTickets, ticketId)
+}
+
+// waitTicketsFor returns the tickets of this mount's pending OpenWithWait calls on filename.
+func (c *DFSConnection) waitTicketsFor(filename string) []int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var ticketIds []int
+	for ticketId, ticketFilename := range c.waitTickets {
+		if ticketFilename == filename {ticketIds = append(ticketIds, ticketId)}
+	}
+	return ticketIds
+}
@@ -6,10 +6,13 @@ import (
 	"net/rpc"
 	"os"
 	"./shared"
+	"sort"
 	"time"
 	"log"
 	"io/ioutil"
 	"flag"
+	"strings"
+	"sync"
 )
 
 const ClientTimeoutThreshold = 2.5
@@ -19,16 +22,53 @@ const FirstChunkVer = 0
 const LoggingOn = true
 
 // Contains filename.
-type AllChunksOfflineError uint8
+type AllChunksOfflineError uint64
 func (e AllChunksOfflineError) Error() string {
 	return fmt.Sprintf("All clients are offline for chunk [%d]\n", e)
 }
 
-type ChunkIsTrivialError uint8
+type ChunkIsTrivialError uint64
 func (e ChunkIsTrivialError) Error() string {
 	return fmt.Sprintf("Chunk [%d] has never been written to\n", e)
 }
 
+// Contains the size of the chunk that does not fit the file's layout.
+type ChunkSizeError int
+func (e ChunkSizeError) Error() string {
+	return fmt.Sprintf("Chunk of [%d] bytes does not fit the file's chunk size\n", int(e))
+}
+
+// Contains the layout that is invalid.
+type FileLayoutError shared.FileLayout
+func (e FileLayoutError) Error() string {
+	return fmt.Sprintf("Chunk size [%d] is not between 1 and %d bytes, or [%d] chunks are more than %d bytes\n",
+		e.ChunkSize, shared.MaxChunkSize, e.NumChunks, shared.MaxFileSize)
+}
+
+// Contains the chunk number that is past the largest file size.
+type ChunkNumError uint64
+func (e ChunkNumError) Error() string {
+	return fmt.Sprintf("Chunk [%d] is past the largest file size of %d bytes\n", uint64(e), shared.MaxFileSize)
+}
+
+// Contains the requested range of chunks.
+type ChunkRangeError shared.ChunkRange
+func (e ChunkRangeError) Error() string {
+	return fmt.Sprintf("Chunk range [%d, %d] is empty\n", e.First, e.Last)
+}
+
+// Contains the version of the chunk a client did not store.
+type ChunkRefusedError int
+func (e ChunkRefusedError) Error() string {
+	return fmt.Sprintf("Client holds a newer version than ver [%d]\n", int(e))
+}
+
+// Contains client ID.
+type ClientOfflineError int
+func (e ClientOfflineError) Error() string {
+	return fmt.Sprintf("Client [%d] is offline\n", e)
+}
+
 type ClientRegistrationInfo struct {
 	ClientId int
 	ClientAddress string
@@ -43,25 +83,110 @@ type ChunkInfo struct {
 }
 
 type FileInfo struct {
+	// Id tells the file apart from files that had its name before. It never changes.
+	Id uint64
+	// Layout is the size of the file's chunks, set when it is created, and how many
+	// it holds, which grows as chunks past the end are written
+	Layout shared.FileLayout
 	// ChunkInfo represents chunk ownership. Maps chunk # to client ID.
-	ChunkInfo map[uint8]*ChunkInfo
-	// LockHolder represents the Client ID of the client who is currently
-	// holding the write lock for the file.
-	LockHolder int
+	ChunkInfo map[uint64]*ChunkInfo
+	// Locks maps the Client ID of each client holding a write lock on part of
+	// the file to its lock. Locks held by different clients never overlap.
+	Locks map[int]*WriteLock
+	// LockToken is the fencing token of the latest lease on a write lock
+	LockToken int
+	// FirstVersion is the version of chunks written for the first time. It is raised
+	// past every version of the chunks a truncate drops, so they are never revived.
+	FirstVersion int
+	// LastWriter is the client that last wrote to the file, at LastModified.
+	// UnsetClientId if the file has not been written to since the server knew of it.
+	LastWriter   int
+	LastModified time.Time
+	// lock guards Layout, ChunkInfo, Locks, LockToken, FirstVersion, LastWriter and LastModified
+	lock sync.Mutex
+	// updateLock serializes RPCs that change the file based on its current metadata
+	updateLock sync.Mutex
+}
+
+// WriteLock is a client's write lock on ranges of a file's chunks, held under a lease.
+type WriteLock struct {
+	Ranges []shared.ChunkRange
+	// Token is the fencing token of the lease
+	Token int
+	// Since is when the client acquired the lock
+	Since time.Time
+	// leaseExpiry is when the lease lapses unless renewed (zero if not yet known)
+	leaseExpiry time.Time
 }
 type Server struct {
 	ConnectedClients, DisconnectedClients map[int]*ClientRegistrationInfo
 	Files map[string]*FileInfo
+	// Tombstones holds the names of deleted and renamed files, so that local copies
+	// of them are not mistaken for files lost by the server
+	Tombstones map[string]bool
 	NextClientId int
+	// metadataLog records every metadata mutation. Nil if the server runs without a data directory.
+	metadataLog *MetadataLog
+	// chunkStore holds the server's copy of every committed chunk version. Nil unless -store-chunks is set.
+	chunkStore *ChunkStore
+	// replicas is the number of clients each newly written chunk version is copied to
+	replicas int
+	// repairRate is the maximum number of chunk copies made per repair pass
+	repairRate int
+	repairStatus shared.RepairStatus
+	// backup streams every mutation to a standby server. Nil unless -backup is set.
+	backup *BackupLink
+	// isStandby is set on a server that follows a primary; isPromoted once it has taken over.
+	isStandby, isPromoted bool
+	// isFenced is set on a primary server once its standby has taken over
+	isFenced bool
+	// epoch counts the takeovers of standby servers from their primary (see PromoteOp)
+	epoch int
+	// lastPrimaryContact is when a standby server last heard from its primary
+	lastPrimaryContact time.Time
+	// epochLock guards isPromoted, isFenced, epoch and lastPrimaryContact
+	epochLock sync.Mutex
+	// raft replicates every mutation across a cluster of servers. Nil unless -peers is set.
+	raft *RaftNode
+	// handles maps handle ID to the files clients currently have open
+	handles      map[int]*HandleInfo
+	nextHandleId int
+	// waitQueues holds the clients waiting for each file's write lock
+	waitQueues   map[string]*WaitQueue
+	nextTicketId int
+	// auditLog records every lock released with ForceUnlock
+	auditLog     []shared.AuditRecord
+	// callbacks maps filename to the clients promised a callback when its chunks change
+	callbacks    map[string]map[int]bool
+
+	// See serverState.go for what each lock guards
+	clientsLock sync.RWMutex
+	filesLock   sync.RWMutex
+	commitLock  sync.Mutex
+	repairLock  sync.Mutex
+	handlesLock sync.Mutex
+	waitLock    sync.Mutex
+	auditLock   sync.Mutex
+	callbacksLock sync.Mutex
 }
 
 
 
 func main() {
 	isLoggingOn := flag.Bool("log", false, "a bool")
+	dataDir := flag.String("data-dir", "", "directory for the metadata log; metadata is kept in memory only if unset")
+	storeChunks := flag.Bool("store-chunks", false, "keep a copy of every written chunk in the data directory")
+	replicas := flag.Int("replicas", 1, "number of clients each written chunk is stored on")
+	repairRate := flag.Int("repair-rate", DefaultRepairRate, "maximum chunk copies per repair pass")
+	backupAddr := flag.String("backup", "", "address of a standby server to stream metadata to")
+	isStandby := flag.Bool("standby", false, "follow a primary server until a client fails over to this one")
+	peers := flag.String("peers", "", "comma-separated addresses of the servers in a Raft cluster; requires -data-dir")
 	flag.Parse()
-	if len(flag.Args()) != 1 {
-		fmt.Fprintln(os.Stderr, "./server [-log] [server-address]")
+	// A Raft node must not forget its votes and log across a restart
+	if len(flag.Args()) != 1 || (*storeChunks && *dataDir == "") || *replicas < 1 || *repairRate < 1 ||
+		(*peers != "" && (*backupAddr != "" || *isStandby || *dataDir == "")) {
+		fmt.Fprintln(os.Stderr, "./server [-log] [-data-dir dir [-store-chunks]] [-replicas N] [-repair-rate N]")
+		fmt.Fprintln(os.Stderr, "         [-backup address | -standby | -peers a,b,c] [server-address]")
 		os.Exit(1)
 	}
 	clientIncomingAddr := flag.Arg(0)
@@ -72,13 +197,56 @@ func main() {
 
 	newServer := rpc.NewServer()
 	server := &Server{
-		make(map[int]*ClientRegistrationInfo),
-		make(map[int]*ClientRegistrationInfo),
-		make(map[string]*FileInfo),
-		FirstClientId,
+		ConnectedClients:    make(map[int]*ClientRegistrationInfo),
+		DisconnectedClients: make(map[int]*ClientRegistrationInfo),
+		Files:               make(map[string]*FileInfo),
+		Tombstones:          make(map[string]bool),
+		NextClientId:        FirstClientId,
+		handles:             make(map[int]*HandleInfo),
+		nextHandleId:        FirstHandleId,
+		waitQueues:          make(map[string]*WaitQueue),
+		callbacks:           make(map[string]map[int]bool),
+		nextTicketId:        FirstTicketId,
+		replicas:            *replicas,
+		repairRate:          *repairRate,
+		isStandby:           *isStandby,
+		// A standby started while its primary is up waits to hear from it before taking over
+		lastPrimaryContact:  time.Now(),
+	}
+	if *peers != "" {
+		// The Raft log takes the place of the metadata log
+		raftNode, err := NewRaftNode(clientIncomingAddr, strings.Split(*peers, ","), *dataDir, server.apply)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot start Raft node: %s\n", err)
+			os.Exit(1)
+		}
+		server.raft = raftNode
+		newServer.RegisterName("Raft", raftNode)
+	} else if *dataDir != "" {
+		err := server.openMetadataLog(*dataDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open metadata log in [%s]: %s\n", *dataDir, err)
+			os.Exit(1)
+		}
+	}
+	if *storeChunks {
+		chunkStore, err := OpenChunkStore(*dataDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot open chunk store in [%s]: %s\n", *dataDir, err)
+			os.Exit(1)
+		}
+		server.chunkStore = chunkStore
+	}
+	if *backupAddr != "" {
+		server.backup = &BackupLink{addr: *backupAddr}
+		server.connectBackup()
+		go server.sendBackupHeartbeats()
 	}
 	newServer.Register(server)
 
+	go server.monitorClientConnections()
+	go server.repairChunks()
+
 	addr, err := net.ResolveTCPAddr("tcp", clientIncomingAddr)
 	if err != nil {
 		log.Println("Failed to resolve address: " + clientIncomingAddr)
@@ -108,84 +276,122 @@ func main() {
 // Adds clients to the connected clients list.
 // When a new client connects, assign a unique ClientID.
 // Restore client metadata if one reconnects.
-func (s *Server) RegisterClient(args *shared.ClientRegistrationRequest, reply *int) error {
+func (s *Server) RegisterClient(args *shared.ClientRegistrationRequest, reply *shared.ClientRegistrationResponse) error {
+	// A standby has to take over before it passes checkLeader
+	if err := s.promoteStandby(); err != nil {return err}
+	if err := s.checkLeader(); err != nil {return err}
 	var assignedClientId int
 
 	if args.ClientId == -1 {
 		// Case: new client
-		s.ConnectedClients[s.NextClientId] = &ClientRegistrationInfo{
-			ClientId:        args.ClientId,
-			ClientAddress:   args.ClientAddress,
-			LatestHeartbeat: args.LatestHeartbeat,
-		}
-		s.NextClientId = s.NextClientId + 1
-		assignedClientId = s.NextClientId - 1
-		*reply = s.NextClientId - 1
+		// The ID is logged before it is handed out so it is never reused after a restart
+		assignedClientId = s.allocateClientId()
+		err := s.commit(LogEntry{
+			Op: RegisterClientOp, ClientId: assignedClientId, ClientAddress: args.ClientAddress,
+		})
+		if err != nil {return err}
 		log.Printf("Client [%d] connected\n", assignedClientId)
 	} else {
 		// Case: reconnecting client
-		// remove from DisconnectedClients and add to ConnectedClients
-		s.ConnectedClients[args.ClientId] = &ClientRegistrationInfo{
-			ClientId:        args.ClientId,
-			ClientAddress:   args.ClientAddress,
-			LatestHeartbeat: args.LatestHeartbeat,
-		}
-		delete(s.DisconnectedClients, args.ClientId)
 		assignedClientId = args.ClientId
-		*reply = args.ClientId
 		log.Printf("Client [%d] reconnected\n", assignedClientId)
+		if s.reserveClientId(assignedClientId) {
+			// The server lost track of this client's ID; make sure it is not handed out again
+			err := s.commit(LogEntry{
+				Op: RegisterClientOp, ClientId: assignedClientId, ClientAddress: args.ClientAddress,
+			})
+			if err != nil {return err}
+		}
 	}
 
-	s.ConnectedClients[assignedClientId].ClientId = assignedClientId
+	// A client failing over to this server keeps its write leases
+	s.renewLeases(assignedClientId)
+
+	conflicts, changes, err := s.mergeInventory(assignedClientId, args.Inventory)
+	if err != nil {return err}
 
-	err := s.establishRPCConnection(assignedClientId)
+	client, err := s.establishRPCConnection(assignedClientId, args.ClientAddress)
 	if err != nil {return err}
 
+	// remove from DisconnectedClients and add to ConnectedClients
+	s.clientsLock.Lock()
+	previous, isConnected := s.ConnectedClients[assignedClientId]
+	if !isConnected {previous = s.DisconnectedClients[assignedClientId]}
+	s.ConnectedClients[assignedClientId] = &ClientRegistrationInfo{
+		ClientId:        assignedClientId,
+		ClientAddress:   args.ClientAddress,
+		LatestHeartbeat: args.LatestHeartbeat,
+		RPCConnection:   client,
+	}
+	delete(s.DisconnectedClients, assignedClientId)
+	s.clientsLock.Unlock()
+	// The connection made when the client last registered is not used again
+	if previous != nil && previous.RPCConnection != nil {previous.RPCConnection.Close()}
+
+	*reply = shared.ClientRegistrationResponse{ClientId: assignedClientId, Conflicts: conflicts, Changes: changes}
 	return nil
 }
 
 // DisconnectClient removes the client from online clients. Called by unmounting.
 func (s *Server) DisconnectClient(args *shared.ClientRegistrationRequest, reply *int) error {
+	if err := s.checkLeader(); err != nil {return err}
 	s.disconnectClient(args.ClientId)
 	*reply = args.ClientId
 	return nil
 }
 
-func (s *Server) establishRPCConnection(clientId int) error {
-	addr := s.ConnectedClients[clientId].ClientAddress
+func (s *Server) establishRPCConnection(clientId int, addr string) (*rpc.Client, error) {
 	client, err := rpc.Dial("tcp", addr)
 	if err != nil {
 		log.Printf("Error establishing RPC connection to [%s]\n", addr)
-		return err
+		return nil, err
 	} else {
 		log.Printf("Established RPC connection to client [%d] at [%s]\n", clientId, addr)
 	}
-
-	s.ConnectedClients[clientId].RPCConnection = client
-	return nil
+	return client, nil
 }
 
 // RPC call target. Checks if a file by some name has ever been created.
 // Does not care if any or all of that file is offline.
 func (s *Server) CheckFileExists(args *shared.FileExistsRequest, reply *bool) error {
+	if err := s.checkLeader(); err != nil {return err}
 	log.Printf("CheckFileExists: [%s]\n", args.Filename)
 	*reply = s.doesFileExist(args.Filename)
 	return nil
 }
 
+// checkLeader returns an error naming the leader if this server is a Raft follower.
+// Clients are served by the leader only. A primary server that its standby took
+// over from returns FencedError, which sends clients to the standby, and a standby
+// that has not taken over yet returns NotPromotedError.
+func (s *Server) checkLeader() error {
+	if err := s.checkFenced(); err != nil {return err}
+	if err := s.checkPromoted(); err != nil {return err}
+	if s.raft == nil {return nil}
+	isLeader, leaderAddr := s.raft.IsLeader()
+	if !isLeader {return NotLeaderError(leaderAddr)}
+	return nil
+}
+
 // doesFileExist checks if the filename has been seen by the server.
 // It does NOT check whether all the chunks are online.
 func (s *Server) doesFileExist(filename string) bool {
-	_, exists := s.Files[filename]
-	return exists
+	return s.getFile(filename) != nil
 }
 
 // PingServer is called remotely (RPC) by each connected client periodically
 // to tell the server that its connection is being maintained.
 func (s *Server) PingServer(args *shared.ClientHeartbeat, reply *int) error {
-	_, isClientConnected := s.ConnectedClients[args.ClientId]
+	if err := s.checkLeader(); err != nil {return err}
+	s.clientsLock.Lock()
+	info, isClientConnected := s.ConnectedClients[args.ClientId]
+	if isClientConnected {
+		info.LatestHeartbeat = args.Timestamp
+	}
+	s.clientsLock.Unlock()
+
 	if isClientConnected {
-		s.ConnectedClients[args.ClientId].LatestHeartbeat = args.Timestamp
+		s.renewLeases(args.ClientId)
 		*reply = args.ClientId
 	} else {
 		// A Ping may arrive after a client has already disconnected
@@ -195,86 +401,126 @@ func (s *Server) PingServer(args *shared.ClientHeartbeat, reply *int) error {
 }
 
 
-// OpenFile is an RPC target. If the mode is WRITE, if the file lock is available, it is
-// assigned to the calling client. If the file is already locked, the file is not opened.
+// OpenFile is an RPC target. If the mode is WRITE, if the requested chunks are not locked,
+// they are locked by the calling client. If another client has locked any of them, or other
+// clients are waiting for any of them (see AwaitWriteLock), the file is not opened.
 // Upon opening a file, it returns chunks of the file that are most recent AND online
 // (best effort) without guarantee that they are the most recent versions.
 func (s *Server) OpenFile(req *shared.OpenFileRequest, reply *shared.OpenFileResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
 	log.Printf("Open: client [%d], file [%s]", req.ClientId, req.Filename)
 
 	if !s.doesFileExist(req.Filename) {
 		// Filename has never been seen by server. Create new file.
-		s.createNewFile(req)
-		*reply = shared.OpenFileResponse{Chunks: nil, Success: true}
+		err := s.createNewFile(req.Filename, shared.DefaultLayout)
+		if err != nil {return err}
+	}
+	fileInfo := s.getFile(req.Filename)
+	if fileInfo == nil {
+		// Deleted or renamed in the meantime
+		*reply = shared.OpenFileResponse{UnavailableError: true}
 		return nil
-	} else {
-		if req.Mode == shared.WRITE {
-			if !s.isFileLockAvailable(req.Filename, req.ClientId) {
-				// Write access conflict occurs
-				log.Printf("Error: Write conflict for file [%s]\n", req.Filename)
-				*reply = shared.OpenFileResponse{
-					Chunks: nil, Success: false, ConflictError: true, UnavailableError: false,
-				}
-				return nil
-			} else {
-				s.Files[req.Filename].LockHolder = req.ClientId
-			}
-		}
+	}
 
-		fileInfo := s.Files[req.Filename]
-		if len(fileInfo.ChunkInfo) == 0 {
-			// File exists but it was never written to
-			*reply = shared.OpenFileResponse{Success: true}
+	var lease shared.Lease
+	if req.Mode == shared.WRITE {
+		if !req.Chunks.IsValid() {return ChunkRangeError(req.Chunks)}
+		token, acquired, err := s.acquireFileLock(fileInfo, req.Filename, req.ClientId, req.Chunks, shared.UnsetTicketId)
+		if err != nil {return err}
+		lease = shared.Lease{Token: token, Duration: LeaseDuration}
+		if !acquired {
+			// Write access conflict occurs
+			log.Printf("Error: Write conflict for file [%s]\n", req.Filename)
+			*reply = shared.OpenFileResponse{
+				Chunks: nil, Success: false, ConflictError: true, UnavailableError: false,
+				Conflict: s.describeConflict(req.Filename, fileInfo, req.ClientId, req.Chunks),
+			}
 			return nil
 		}
+	}
+	return s.openFileContents(req, fileInfo, lease, reply)
+}
 
-		// Best-effort file fetch from online clients
-		var chunks []shared.Chunk
-		for chunkNum := 0; chunkNum < shared.ChunksPerFile; chunkNum++ {
-			_, exists := fileInfo.ChunkInfo[uint8(chunkNum)]
-			if exists {
-				chunk, err := s.getChunkBestEffort(req.Filename, uint8(chunkNum))
-				if err == nil {
-					chunks = append(chunks, chunk)
-				} else {
-					log.Println(err)
-				}
-			}
+// openFileContents completes an OpenFile once the lock, if needed, is held.
+func (s *Server) openFileContents(req *shared.OpenFileRequest, fileInfo *FileInfo, lease shared.Lease,
+	reply *shared.OpenFileResponse) error {
+	// Promised before looking up versions, so that no newer version goes unannounced
+	s.addCallback(req.Filename, req.ClientId)
+	versions := fileInfo.currentVersions()
+	layout := fileInfo.layout()
+	if len(versions) == 0 {
+		// File exists but it was never written to
+		handleId := s.openHandle(req.ClientId, req.Filename, req.Mode)
+		*reply = shared.OpenFileResponse{
+			Success: true, HandleId: handleId, Lease: lease, Layout: layout, FileId: fileInfo.Id,
 		}
+		return nil
+	}
 
-		if len(fileInfo.ChunkInfo) > 0 && len(chunks) == 0 {
-			log.Printf("Error: file [%s] is non-trivial but no chunks are reachable\n", req.Filename)
-			*reply = shared.OpenFileResponse{
-				Chunks: nil, Success: false, ConflictError: false, UnavailableError: true,
-			}
-			return nil
+	// Best-effort file fetch from online clients
+	var chunkNums []uint64
+	for chunkNum := range versions {
+		chunkNums = append(chunkNums, chunkNum)
+	}
+	sort.Slice(chunkNums, func(i, j int) bool {return chunkNums[i] < chunkNums[j]})
+	var chunks []shared.Chunk
+	for _, chunkNum := range chunkNums {
+		chunk, err := s.getChunkBestEffort(req.Filename, chunkNum)
+		if err == nil {
+			chunks = append(chunks, chunk)
+		} else {
+			log.Println(err)
 		}
+	}
 
-		*reply = shared.OpenFileResponse{Chunks: chunks, Success: true}
-
-		// For each chunk fetched, the client is now included as an owner
-		for _, ci := range chunks {
-			chunkInfo := fileInfo.ChunkInfo[ci.ChunkNum]
-			chunkInfo.ChunkOwners[ci.Version] =
-				append(fileInfo.ChunkInfo[ci.ChunkNum].ChunkOwners[ci.Version], req.ClientId)
+	if len(chunks) == 0 {
+		log.Printf("Error: file [%s] is non-trivial but no chunks are reachable\n", req.Filename)
+		*reply = shared.OpenFileResponse{
+			Chunks: nil, Success: false, ConflictError: false, UnavailableError: true,
 		}
 		return nil
 	}
+
+	handleId := s.openHandle(req.ClientId, req.Filename, req.Mode)
+	*reply = shared.OpenFileResponse{
+		Chunks: chunks, Success: true, HandleId: handleId, Lease: lease, Layout: layout, FileId: fileInfo.Id,
+	}
+
+	// For each chunk fetched, the client is now included as an owner
+	for _, ci := range chunks {
+		err := s.addChunkOwner(req.Filename, ci.ChunkNum, ci.Version, req.ClientId)
+		if err != nil {return err}
+	}
+	return nil
 }
 
 // RPC target
-// CloseFile unlocks the file if the mode was WRITE
+// CloseFile closes a handle, and unlocks the file if it was the client's last
+// handle on the file in WRITE mode
 func (s *Server) CloseFile(req *shared.CloseFileRequest, res *shared.CloseFileResponse) error {
-	log.Printf("CloseFile: client [%d], filename [%s]\n", req.ClientId, req.Filename)
+	if err := s.checkLeader(); err != nil {return err}
+	log.Printf("CloseFile: client [%d], filename [%s], handle [%d]\n", req.ClientId, req.Filename, req.HandleId)
 
+	s.closeHandle(req.HandleId, req.ClientId, req.Filename)
 	if req.Mode != shared.WRITE {
 		*res = shared.CloseFileResponse{Success: true}
 		return nil
 	}
 
-	lockHolder := s.Files[req.Filename].LockHolder
-	if lockHolder == req.ClientId {
-		s.Files[req.Filename].LockHolder = shared.UnsetClientId
+	fileInfo := s.getFile(req.Filename)
+	if fileInfo != nil && s.hasWriteHandle(req.ClientId, req.Filename) {
+		// The client still has the file open for writing through another handle
+		*res = shared.CloseFileResponse{Success: fileInfo.holdsLock(req.ClientId)}
+		return nil
+	}
+
+	released := false
+	if fileInfo != nil {
+		var err error
+		released, err = s.releaseFileLock(fileInfo, req.Filename, req.ClientId)
+		if err != nil {return err}
+	}
+	if released {
 		log.Printf("Unlocked [%s.dfs]\n", req.Filename)
 		*res = shared.CloseFileResponse{Success: true}
 	} else {
@@ -288,6 +534,7 @@ func (s *Server) CloseFile(req *shared.CloseFileRequest, res *shared.CloseFileRe
 // ReadChunk: in READ or WRITE mode, fetches the newest version of the chunk or returns an error.
 // In DREAD mode, returns the 'best effort' version of the chunk.
 func (s *Server) ReadChunk(req *shared.GetLatestChunkRequest, resp *shared.GetLatestChunkResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
 	log.Printf("Read: ClientId: [%d], Filename [%s], Chunk [%d]",
 		req.ClientId, req.Filename, req.ChunkNum)
 
@@ -302,17 +549,31 @@ func (s *Server) ReadChunk(req *shared.GetLatestChunkRequest, resp *shared.GetLa
 		return nil
 	}
 
-	fileInfo := s.Files[req.Filename]
+	fileInfo := s.getFile(req.Filename)
+	if fileInfo == nil {
+		*resp = shared.GetLatestChunkResponse{Success: false}
+		return nil
+	}
 
-	chunkInfo, exists := fileInfo.ChunkInfo[req.ChunkNum]
+	s.addCallback(req.Filename, req.ClientId)
+	currentVersion, exists := fileInfo.currentVersion(req.ChunkNum)
 
 	if !exists {
 		// File exists but chunk has never been written to
-		*resp = shared.GetLatestChunkResponse{Success: true}
+		*resp = shared.GetLatestChunkResponse{
+			ChunkData: shared.Chunk{ChunkNum: req.ChunkNum, Version: shared.NoVersion}, Success: true,
+		}
 		return nil
 	}
 
-	currentVersion := chunkInfo.CurrentVersion
+	if req.LocalVersion == currentVersion {
+		// The client already holds the current version; no need to fetch it from an owner
+		*resp = shared.GetLatestChunkResponse{
+			ChunkData: shared.Chunk{ChunkNum: req.ChunkNum, Version: currentVersion}, Success: true, NotModified: true,
+		}
+		return s.addChunkOwner(req.Filename, req.ChunkNum, currentVersion, req.ClientId)
+	}
+
 	chunk, e := s.getChunkByVersion(req.Filename, req.ChunkNum, currentVersion)
 
 	if e != nil {
@@ -321,22 +582,24 @@ func (s *Server) ReadChunk(req *shared.GetLatestChunkRequest, resp *shared.GetLa
 	} else {
 		*resp = shared.GetLatestChunkResponse{ChunkData: chunk, Success: true}
 		// Add client to owners
-		fileInfo.ChunkInfo[chunk.ChunkNum].ChunkOwners[chunk.Version] =
-			append(fileInfo.ChunkInfo[chunk.ChunkNum].ChunkOwners[chunk.Version], req.ClientId)
+		return s.addChunkOwner(req.Filename, chunk.ChunkNum, chunk.Version, req.ClientId)
 	}
 	return nil
 }
 
 // Returns the latest reachable version of a chunk.
 // Returns an error if chunk has never been written, or all owners are offline.
-func (s *Server) getChunkBestEffort(filename string, chunkNum uint8) (chunk shared.Chunk, err error) {
-	chunkInfo, exists := s.Files[filename].ChunkInfo[chunkNum]
+func (s *Server) getChunkBestEffort(filename string, chunkNum uint64) (chunk shared.Chunk, err error) {
+	fileInfo := s.getFile(filename)
+	if fileInfo == nil {return shared.Chunk{}, ChunkIsTrivialError(chunkNum)}
+	currentVersion, exists := fileInfo.currentVersion(chunkNum)
 
 	// If chunk has never been written, return empty data
 	if !exists {return shared.Chunk{}, ChunkIsTrivialError(chunkNum)}
 
 	// Find online client with the latest version reachable
-	for ver := chunkInfo.CurrentVersion; ver >= FirstChunkVer; ver-- {
+	for _, ver := range fileInfo.chunkVersions(chunkNum) {
+		if ver > currentVersion {continue}
 		chunk, e := s.getChunkByVersion(filename, chunkNum, ver)
 		if e == nil {return chunk, nil}
 	}
@@ -345,22 +608,26 @@ func (s *Server) getChunkBestEffort(filename string, chunkNum uint8) (chunk shar
 	return shared.Chunk{}, AllChunksOfflineError(chunkNum)
 }
 
-func (s *Server) getChunkByVersion(filename string, chunkNum uint8, ver int) (chunk shared.Chunk, err error) {
-	chunkInfo := s.Files[filename].ChunkInfo[chunkNum]
+func (s *Server) getChunkByVersion(filename string, chunkNum uint64, ver int) (chunk shared.Chunk, err error) {
+	fileInfo := s.getFile(filename)
+	if fileInfo == nil {return shared.Chunk{}, AllChunksOfflineError(chunkNum)}
+	chunkSize := fileInfo.layout().ChunkSize
 
-	versionOwners := chunkInfo.ChunkOwners[ver]
-	for _, owner := range versionOwners {
-		if s.isClientConnected(owner) {
+	for _, owner := range fileInfo.chunkOwners(chunkNum, ver) {
+		client := s.clientConnection(owner)
+		if client != nil {
 			log.Printf("Fetch: owner ClientId: [%d], Filename [%s], Chunk [%d], Ver: [%d]\n",
 				owner, filename, chunkNum, ver)
 			req := shared.FetchChunkRequest{
-				Filename: filename,
-				ChunkNum: chunkNum,
+				Filename:  filename,
+				ChunkNum:  chunkNum,
+				ChunkSize: chunkSize,
 			}
 			var resp shared.FetchChunkResponse
-			err = s.ConnectedClients[owner].RPCConnection.Call("DiskService.FetchChunk", req, &resp)
-			if err != nil {
+			err = client.Call("DiskService.FetchChunk", req, &resp)
+			if err != nil || len(resp.ChunkData.Data) != chunkSize {
 				log.Print(err)
+				continue
 			}
 
 			resp.ChunkData.Version = ver
@@ -368,6 +635,15 @@ func (s *Server) getChunkByVersion(filename string, chunkNum uint8, ver int) (ch
 		}
 	}
 
+	// No owner is online; fall back to the server's own copy
+	if s.chunkStore != nil {
+		chunk, err = s.chunkStore.Get(fileInfo.Id, filename, chunkNum, ver, chunkSize)
+		if err == nil {
+			log.Printf("Fetch: chunk store, Filename [%s], Chunk [%d], Ver: [%d]\n", filename, chunkNum, ver)
+			return chunk, nil
+		}
+	}
+
 	return shared.Chunk{}, AllChunksOfflineError(chunkNum)
 }
 
@@ -375,42 +651,165 @@ func (s *Server) getChunkByVersion(filename string, chunkNum uint8, ver int) (ch
 // WriteChunk records a Write event in the file's metadata.
 // Cannot assume the client has the lock because they may have timed out.
 func (s *Server) WriteChunk(args *shared.WriteChunkRequest, reply *shared.WriteChunkResponse) error {
-	// Add client as newest chunk version owner and increment chunk version
-	fileInfo, exists := s.Files[args.Filename]
+	if err := s.checkLeader(); err != nil {return err}
+	// File open failed
+	fileInfo := s.getFile(args.Filename)
+	if fileInfo == nil {
+		*reply = shared.WriteChunkResponse{Success: false}
+		return nil
+	}
 
-	// File open failed, or write mode has timed out
-	if !exists || fileInfo.LockHolder != args.ClientId {
+	chunks := []shared.Chunk{{ChunkNum: args.ChunkNum, Data: args.ChunkData.Data}}
+	written, err := s.writeChunks(fileInfo, args.Filename, args.ClientId, args.LeaseToken, chunks)
+	if err != nil {return err}
+	if !written {
 		*reply = shared.WriteChunkResponse{Success: false}
 		return nil
 	}
+	s.acknowledgeWrites(args.Filename, args.ClientId, chunks)
 
-	if fileInfo.ChunkInfo[args.ChunkNum] == nil {
-		// Chunk has never been written to
-		owners := make(map[int][]int)
-		owners[0] = []int{args.ClientId}
-		fileInfo.ChunkInfo[args.ChunkNum] = &ChunkInfo{FirstChunkVer, owners}
-	} else {
-		nv := fileInfo.ChunkInfo[args.ChunkNum].CurrentVersion + 1
-		fileInfo.ChunkInfo[args.ChunkNum].CurrentVersion = nv
-		fileInfo.ChunkInfo[args.ChunkNum].ChunkOwners[nv] = []int{args.ClientId}
+	*reply = shared.WriteChunkResponse{Success: true, Version: chunks[0].Version}
+
+	return nil
+}
+
+// WriteChunks is an RPC target. It writes several chunks of a file in one call,
+// e.g. when a buffered client flushes. Either every chunk is written or none is.
+func (s *Server) WriteChunks(args *shared.WriteChunksRequest, reply *shared.WriteChunksResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	fileInfo := s.getFile(args.Filename)
+	if fileInfo == nil {
+		*reply = shared.WriteChunksResponse{Success: false}
+		return nil
+	}
+
+	chunks := append([]shared.Chunk(nil), args.Chunks...)
+	written, err := s.writeChunks(fileInfo, args.Filename, args.ClientId, args.LeaseToken, chunks)
+	if err != nil {return err}
+	if !written {
+		*reply = shared.WriteChunksResponse{Success: false}
+		return nil
+	}
+	s.acknowledgeWrites(args.Filename, args.ClientId, chunks)
+
+	versions := make([]int, len(chunks))
+	for i, chunk := range chunks {
+		versions[i] = chunk.Version
+	}
+	*reply = shared.WriteChunksResponse{Success: true, Versions: versions}
+	return nil
+}
+
+// writeChunks commits the next version of each chunk, setting its Version, as long
+// as the writer still holds a lock on every chunk under a valid lease with the same
+// fencing token (it may have timed out). Returns false, having written nothing, if
+// it does not.
+func (s *Server) writeChunks(fileInfo *FileInfo, filename string, clientId int, leaseToken int,
+	chunks []shared.Chunk) (written bool, err error) {
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+
+	if err := checkChunks(fileInfo, chunks); err != nil {return false, err}
+	held, isValid := fileInfo.writeLock(clientId)
+	isCovered := true
+	for _, chunk := range chunks {
+		isCovered = isCovered && held.covers(chunk.ChunkNum)
+	}
+	if !isValid || held.Token != leaseToken || !isCovered {
+		log.Printf("Error: rejected write by client [%d] to [%s] with token [%d]\n",
+			clientId, filename, leaseToken)
+		return false, nil
+	}
+
+	writtenAt := time.Now().UTC()
+	for i := range chunks {
+		// Chunk versions start at the file's first version when the chunk has never been written to
+		nv := fileInfo.firstVersion()
+		if ver, exists := fileInfo.currentVersion(chunks[i].ChunkNum); exists {
+			nv = ver + 1
+		}
+		chunks[i].Version = nv
+		// The data must be durable before the new version is, so it can always be served
+		if s.chunkStore != nil {
+			err = s.chunkStore.Put(fileInfo.Id, filename, chunks[i])
+			if err != nil {return false, err}
+		}
+		err = s.commit(LogEntry{
+			Op: WriteChunkOp, Filename: filename, ChunkNum: chunks[i].ChunkNum, Version: nv, ClientId: clientId,
+			Timestamp: writtenAt,
+		})
+		if err != nil {return false, err}
+	}
+	return true, nil
+}
+
+// checkChunks returns an error unless every chunk fits the file's chunk size and
+// lies within the largest file size.
+func checkChunks(fileInfo *FileInfo, chunks []shared.Chunk) error {
+	layout := fileInfo.layout()
+	for _, chunk := range chunks {
+		if len(chunk.Data) != layout.ChunkSize {return ChunkSizeError(len(chunk.Data))}
+		if chunk.ChunkNum >= layout.MaxChunks() {return ChunkNumError(chunk.ChunkNum)}
+	}
+	return nil
+}
+
+// acknowledgeWrites finishes writes committed by writeChunks before they are acknowledged.
+func (s *Server) acknowledgeWrites(filename string, clientId int, chunks []shared.Chunk) {
+	for _, chunk := range chunks {
+		log.Printf("Write: ClientId: [%d], Filename [%s], Chunk [%d], Ver: [%d]\n",
+			clientId, filename, chunk.ChunkNum, chunk.Version)
+
+		// The write is acknowledged only once the other replicas have stored it
+		if s.replicas > 1 {
+			s.replicateChunk(filename, chunk)
+		}
+		// ... and once no other client may still read an older version from its cache
+		s.breakCallbacks(filename, chunk.ChunkNum, chunk.Version, clientId)
 	}
+}
 
-	log.Printf("Write: ClientId: [%d], Filename [%s], Chunk [%d], Ver: [%d]\n",
-		args.ClientId, args.Filename, args.ChunkNum, fileInfo.ChunkInfo[args.ChunkNum].CurrentVersion)
+// CreateFile is an RPC target. It creates a file with the given layout, unless
+// the file already exists.
+func (s *Server) CreateFile(req *shared.CreateFileRequest, reply *shared.CreateFileResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	if !req.Layout.IsValid() {return FileLayoutError(req.Layout)}
 
-	*reply = shared.WriteChunkResponse{Success: true}
+	if fileInfo := s.getFile(req.Filename); fileInfo != nil {
+		*reply = shared.CreateFileResponse{Created: false, Layout: fileInfo.layout(), FileId: fileInfo.Id}
+		return nil
+	}
+	err := s.createNewFile(req.Filename, req.Layout)
+	if err != nil {return err}
+	// A file created in the meantime keeps the layout it was created with
+	fileInfo := s.getFile(req.Filename)
+	if fileInfo == nil {return s.CreateFile(req, reply)}
+	layout := fileInfo.layout()
+	*reply = shared.CreateFileResponse{
+		Created: layout.ChunkSize == req.Layout.ChunkSize, Layout: layout, FileId: fileInfo.Id,
+	}
+	return nil
+}
 
+// createNewFile adds a new file with the given layout to the server's file
+// metadata. There is no initial information about any chunk.
+func (s *Server) createNewFile(filename string, layout shared.FileLayout) error {
+	err := s.commit(LogEntry{
+		Op: CreateFileOp, Filename: filename, Layout: layout, FileId: newFileId(), Version: FirstChunkVer,
+	})
+	if err != nil {return err}
+	log.Printf("Created file: [%s]\n", filename)
 	return nil
 }
 
-// createNewFile adds a new file to the server's file metadata.
-// There is no initial information about any chunk.
-func (s *Server) createNewFile(args *shared.OpenFileRequest) {
-	fileInfo := FileInfo{make(map[uint8]*ChunkInfo), shared.UnsetClientId}
-	// Lock file if opened in WRITE mode
-	if args.Mode == shared.WRITE {fileInfo.LockHolder = args.ClientId}
-	s.Files[args.Filename] = &fileInfo
-	log.Printf("Created file: [%s]\n", args.Filename)
+// addChunkOwner records that clientId holds version ver of the chunk.
+// Nothing is logged if the client is already an owner of that version.
+func (s *Server) addChunkOwner(filename string, chunkNum uint64, ver int, clientId int) error {
+	fileInfo := s.getFile(filename)
+	if fileInfo == nil || isOwner(fileInfo.chunkOwners(chunkNum, ver), clientId) {return nil}
+	return s.commit(LogEntry{
+		Op: AddChunkOwnerOp, Filename: filename, ChunkNum: chunkNum, Version: ver, ClientId: clientId,
+	})
 }
 
 
@@ -420,40 +819,96 @@ func (s *Server) monitorClientConnections() {
 	for {
 		time.Sleep(ClientMonitorPeriod * time.Second)
 		timeNow := time.Now().UTC()
+		var timedOut []int
+		s.clientsLock.RLock()
 		for c, v := range s.ConnectedClients {
 			timeDiff := timeNow.Sub(v.LatestHeartbeat).Seconds()
 			if timeDiff > ClientTimeoutThreshold {
-				s.disconnectClient(c)
+				timedOut = append(timedOut, c)
 			}
 		}
+		s.clientsLock.RUnlock()
+		for _, c := range timedOut {
+			s.disconnectClient(c)
+		}
+		s.expireLeases()
 	}
 }
 
 func (s *Server) disconnectClient(clientId int) {
 	log.Printf("Client [%d] disconnected\n", clientId)
-	_, clientExists := s.ConnectedClients[clientId]
+	s.clientsLock.Lock()
+	info, clientExists := s.ConnectedClients[clientId]
 	if clientExists {
-		s.DisconnectedClients[clientId] = s.ConnectedClients[clientId]
+		s.DisconnectedClients[clientId] = info
 		delete(s.ConnectedClients, clientId)
 	}
+	s.clientsLock.Unlock()
+	s.closeClientHandles(clientId)
+	s.dropCallbacks(clientId)
+	s.leaveAllQueues(clientId)
 	s.unlockByClientId(clientId)
 }
 
 func (s *Server) unlockByClientId(clientId int) {
-	for fn, fi := range s.Files {
-		if fi.LockHolder == clientId {
-			fi.LockHolder = shared.UnsetClientId
-			log.Printf("Unlocked [%s.dfs]\n", fn)
-		}
+	for _, fn := range s.fileNames() {
+		fileInfo := s.getFile(fn)
+		if fileInfo == nil {continue}
+		released, err := s.releaseFileLock(fileInfo, fn, clientId)
+		if err != nil || !released {continue}
+		log.Printf("Unlocked [%s.dfs]\n", fn)
 	}
 }
 
 func (s *Server) isClientConnected(clientId int) bool {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
 	_, exists := s.ConnectedClients[clientId]
 	return exists
 }
 
-func (s *Server) isFileLockAvailable(filename string, clientId int) bool {
-	lockHolder := s.Files[filename].LockHolder
-	return lockHolder == shared.UnsetClientId || lockHolder == clientId
+// acquireFileLock gives clientId a lease on a write lock over chunks of the file,
+// unless another client holds a valid lease on any of them or is ahead of clientId
+// (or of its ticket, if it is waiting) in the file's wait queue for any of them.
+// A client already holding part of the file has the chunks added to its lock.
+// Returns the lease's fencing token, and false if the lock was not acquired.
+func (s *Server) acquireFileLock(fileInfo *FileInfo, filename string, clientId int, chunks shared.ChunkRange,
+	ticketId int) (token int, acquired bool, err error) {
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+
+	held, isHeld := fileInfo.writeLock(clientId)
+	if isHeld && held.includes(chunks) {
+		fileInfo.renewLease(clientId)
+		return held.Token, true, nil
+	}
+	lapsedHolders, isLocked := fileInfo.overlappingLocks(clientId, chunks)
+	if isLocked {return 0, false, nil}
+	if !s.isFirstInQueue(filename, clientId, chunks, ticketId) {return 0, false, nil}
+
+	// Lapsed leases are taken over with a new token, even by the client that held them
+	for _, lockHolder := range lapsedHolders {
+		err = s.commit(LogEntry{Op: UnlockChunksOp, Filename: filename, ClientId: lockHolder})
+		if err != nil {return 0, false, err}
+	}
+	token = held.Token
+	if !isHeld {token = fileInfo.lockToken() + 1}
+	err = s.commit(LogEntry{
+		Op: LockChunksOp, Filename: filename, ClientId: clientId,
+		ChunkNum: chunks.First, LastChunkNum: chunks.Last, Token: token, Timestamp: time.Now().UTC(),
+	})
+	if err != nil {return 0, false, err}
+	fileInfo.renewLease(clientId)
+	return token, true, nil
+}
+
+// releaseFileLock releases clientId's write lock on the file.
+// Returns false if it does not hold one.
+func (s *Server) releaseFileLock(fileInfo *FileInfo, filename string, clientId int) (bool, error) {
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+
+	if !fileInfo.holdsLock(clientId) {return false, nil}
+	err := s.commit(LogEntry{Op: UnlockChunksOp, Filename: filename, ClientId: clientId})
+	return err == nil, err
 }
\ No newline at end of file
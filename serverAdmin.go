@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+	"./shared"
+)
+
+// Administration
+//
+// Locks can be listed, and released by an administrator when a client is stuck
+// holding one. A forced release is committed like any other metadata change, so
+// its audit record is kept across restarts and replicated to standbys and peers.
+
+// ListLocks is an RPC target. It replies with every write lock held, on one file or on all of them.
+func (s *Server) ListLocks(req *shared.ListLocksRequest, reply *shared.ListLocksResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	filenames := s.fileNames()
+	if req.Filename != "" {filenames = []string{req.Filename}}
+	sort.Strings(filenames)
+
+	var locks []shared.LockInfo
+	for _, filename := range filenames {
+		fileInfo := s.getFile(filename)
+		if fileInfo == nil {continue}
+		locks = append(locks, s.fileLocks(filename, fileInfo)...)
+	}
+	*reply = shared.ListLocksResponse{Locks: locks}
+	return nil
+}
+
+// ForceUnlock is an RPC target. It releases a client's write lock on a file, or
+// every lock on it, and records who released it and why in the audit log. The
+// client's writes are rejected from then on, as if its lease had lapsed.
+func (s *Server) ForceUnlock(req *shared.ForceUnlockRequest, reply *shared.ForceUnlockResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	fileInfo := s.getFile(req.Filename)
+	if fileInfo == nil {
+		*reply = shared.ForceUnlockResponse{}
+		return nil
+	}
+
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+
+	var released []shared.LockInfo
+	for _, lock := range s.fileLocks(req.Filename, fileInfo) {
+		if req.ClientId != shared.UnsetClientId && lock.ClientId != req.ClientId {continue}
+		err := s.commit(LogEntry{
+			Op: ForceUnlockOp, Filename: req.Filename, ClientId: lock.ClientId, Token: lock.Token,
+			Timestamp: time.Now().UTC(), Operator: req.Operator, Reason: req.Reason,
+		})
+		if err != nil {return err}
+		released = append(released, lock)
+	}
+	*reply = shared.ForceUnlockResponse{Released: released}
+	return nil
+}
+
+// GetAuditLog is an RPC target. It replies with every forced lock release, oldest first.
+func (s *Server) GetAuditLog(req *shared.AuditLogRequest, reply *shared.AuditLogResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	s.auditLock.Lock()
+	records := append([]shared.AuditRecord(nil), s.auditLog...)
+	s.auditLock.Unlock()
+
+	sort.SliceStable(records, func(i, j int) bool {return records[i].Timestamp.Before(records[j].Timestamp)})
+	*reply = shared.AuditLogResponse{Records: records}
+	return nil
+}
+
+// fileLocks describes the write locks held on a file, by client ID.
+func (s *Server) fileLocks(filename string, fileInfo *FileInfo) []shared.LockInfo {
+	fileInfo.lock.Lock()
+	var locks []shared.LockInfo
+	for lockHolder, lock := range fileInfo.Locks {
+		locks = append(locks, shared.LockInfo{
+			Filename: filename,
+			ClientId: lockHolder,
+			Ranges:   append([]shared.ChunkRange(nil), lock.Ranges...),
+			Since:    lock.Since,
+			Token:    lock.Token,
+		})
+	}
+	fileInfo.lock.Unlock()
+
+	sort.Slice(locks, func(i, j int) bool {return locks[i].ClientId < locks[j].ClientId})
+	for i := range locks {
+		locks[i].ClientAddress = s.clientAddress(locks[i].ClientId)
+	}
+	return locks
+}
+
+// describeConflict reports the lock, or failing that the waiting client, that
+// kept clientId from locking chunks of the file.
+func (s *Server) describeConflict(filename string, fileInfo *FileInfo, clientId int,
+	chunks shared.ChunkRange) shared.LockInfo {
+	for _, lock := range s.fileLocks(filename, fileInfo) {
+		if lock.ClientId == clientId {continue}
+		for _, held := range lock.Ranges {
+			if held.Overlaps(chunks) {return lock}
+		}
+	}
+
+	ticket, isWaiting := s.firstWaiting(filename, clientId, chunks)
+	if !isWaiting {
+		// The lock was released in the meantime
+		log.Printf("Conflict on [%s.dfs] has already cleared\n", filename)
+		return shared.LockInfo{Filename: filename, ClientId: shared.UnsetClientId}
+	}
+	return shared.LockInfo{
+		Filename:      filename,
+		ClientId:      ticket.ClientId,
+		ClientAddress: s.clientAddress(ticket.ClientId),
+		Ranges:        []shared.ChunkRange{ticket.Chunks},
+		Since:         ticket.Since,
+		IsWaiting:     true,
+	}
+}
+
+// auditEntries returns the log entries that rebuild the file's audit records.
+func (s *Server) auditEntries(filename string) []LogEntry {
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+	var entries []LogEntry
+	for _, record := range s.auditLog {
+		if record.Filename != filename {continue}
+		entries = append(entries, LogEntry{
+			Op: ForceUnlockOp, Filename: filename, ClientId: record.ClientId, Token: record.Token,
+			Timestamp: record.Timestamp, Operator: record.Operator, Reason: record.Reason,
+		})
+	}
+	return entries
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sort"
+	"time"
+	"./shared"
+)
+
+const BackupRetryPeriod = 2
+// How long the primary waits for the standby to take an entry, and to take a snapshot.
+// Both are waited for under the commit lock, so a stuck standby is dropped rather than
+// holding up every mutation.
+const (
+	BackupCallTimeout = 1 * time.Second
+	BackupSyncTimeout = 10 * time.Second
+)
+// The primary lets an idle standby know it is alive every BackupHeartbeatPeriod. A
+// standby only takes over once it has not heard from the primary for PrimarySilenceTimeout.
+const (
+	BackupHeartbeatPeriod = 500 * time.Millisecond
+	PrimarySilenceTimeout = 3 * time.Second
+)
+
+// Contains the reason a standby server refused an update from the primary.
+type StandbyError string
+func (e StandbyError) Error() string {
+	return fmt.Sprintf("Standby refused update: %s\n", string(e))
+}
+
+// Contains the time since a standby asked to take over last heard from the primary.
+type PrimaryActiveError time.Duration
+func (e PrimaryActiveError) Error() string {
+	return fmt.Sprintf("Standby heard from the primary %s ago, not taking over\n", time.Duration(e))
+}
+
+// Contains the epoch at which the standby took over from a primary that is now fenced.
+type FencedError int
+func (e FencedError) Error() string {
+	return fmt.Sprintf("Server was taken over by its standby at epoch [%d]\n", int(e))
+}
+
+// Contains the epoch of the primary a standby follows until a client makes it take over.
+type NotPromotedError int
+func (e NotPromotedError) Error() string {
+	return fmt.Sprintf("Standby is following the primary at epoch [%d], not serving clients\n", int(e))
+}
+
+// LogSnapshot is a sequence of log entries that rebuilds a server's metadata from empty.
+type LogSnapshot struct {
+	// Epoch is the primary's epoch
+	Epoch   int
+	Entries []LogEntry
+}
+
+// ForwardedEntry is a mutation the primary at Epoch streams to its standby.
+type ForwardedEntry struct {
+	Epoch int
+	Entry LogEntry
+}
+
+// BackupReply is a standby's answer to its primary.
+type BackupReply struct {
+	// Applied is false if the standby has taken over from the primary
+	Applied bool
+	// Epoch is the standby's epoch; the primary is fenced if it is behind it
+	Epoch   int
+}
+
+// BackupLink streams the primary's metadata mutations to a standby server.
+type BackupLink struct {
+	addr        string
+	client      *rpc.Client
+	lastAttempt time.Time
+}
+
+// forwardToBackup sends a mutation to the standby before the primary applies it.
+// If the standby is unreachable or does not answer in time, the primary carries on
+// alone; the standby is brought back up to date with a full snapshot once it can be
+// reached again. Returns FencedError if the standby has taken over, in which case
+// the mutation must not be applied.
+// Called with s.commitLock held.
+func (s *Server) forwardToBackup(entry LogEntry) error {
+	return s.callStandby("Server.ApplyLogEntry", ForwardedEntry{Epoch: s.getEpoch(), Entry: entry})
+}
+
+// sendBackupHeartbeats lets the standby know the primary is alive while there are
+// no mutations to forward, and reconnects it once it can be reached again. It stops
+// once the primary is fenced.
+func (s *Server) sendBackupHeartbeats() {
+	for range time.Tick(BackupHeartbeatPeriod) {
+		s.commitLock.Lock()
+		err := s.callStandby("Server.PrimaryHeartbeat", s.getEpoch())
+		s.commitLock.Unlock()
+		if err != nil {return}
+	}
+}
+
+// callStandby makes an RPC to the standby, connecting it first if it was lost.
+// Returns FencedError if the standby has taken over.
+// Called with s.commitLock held.
+func (s *Server) callStandby(method string, args interface{}) error {
+	if err := s.checkFenced(); err != nil {return err}
+	b := s.backup
+	if b.client == nil {
+		if time.Since(b.lastAttempt) < BackupRetryPeriod*time.Second {return nil}
+		err := s.connectBackup()
+		if _, isFenced := err.(FencedError); isFenced {return err}
+		if err != nil {return nil}
+	}
+
+	var reply BackupReply
+	err := callBackup(b.client, method, args, &reply, BackupCallTimeout)
+	if err != nil {
+		log.Printf("Error: lost standby server [%s]: %s\n", b.addr, err)
+		b.client.Close()
+		b.client = nil
+		return nil
+	}
+	if !reply.Applied {
+		b.client.Close()
+		b.client = nil
+		return s.fence(reply.Epoch)
+	}
+	return nil
+}
+
+// fence stops the primary from taking mutations and serving clients once its standby
+// has taken over at epoch. The fence is logged, so the primary stays fenced after a
+// restart.
+// Called with s.commitLock held.
+func (s *Server) fence(epoch int) error {
+	log.Printf("Error: standby server [%s] took over at epoch [%d], no longer serving clients\n",
+		s.backup.addr, epoch)
+	entry := LogEntry{Op: FenceOp, Epoch: epoch}
+	if s.metadataLog != nil {
+		err := s.metadataLog.Append(entry)
+		if err != nil {log.Printf("Error: cannot append to metadata log: %s\n", err)}
+	}
+	s.apply(entry)
+	return FencedError(epoch)
+}
+
+// checkFenced returns FencedError if a standby has taken over from this server.
+func (s *Server) checkFenced() error {
+	s.epochLock.Lock()
+	defer s.epochLock.Unlock()
+	if s.isFenced {return FencedError(s.epoch)}
+	return nil
+}
+
+// checkPromoted returns NotPromotedError if this is a standby that has not taken
+// over yet. Only RegisterClient makes a standby take over.
+func (s *Server) checkPromoted() error {
+	if !s.isStandby {return nil}
+	s.epochLock.Lock()
+	defer s.epochLock.Unlock()
+	if !s.isPromoted {return NotPromotedError(s.epoch)}
+	return nil
+}
+
+// getEpoch returns the number of takeovers this server knows of.
+func (s *Server) getEpoch() int {
+	s.epochLock.Lock()
+	defer s.epochLock.Unlock()
+	return s.epoch
+}
+
+// connectBackup dials the standby and sends it a snapshot of the current metadata.
+// Returns FencedError if the standby has taken over.
+func (s *Server) connectBackup() error {
+	b := s.backup
+	b.lastAttempt = time.Now()
+
+	conn, err := net.DialTimeout("tcp", b.addr, BackupCallTimeout)
+	if err != nil {
+		log.Printf("Error: cannot reach standby server [%s]\n", b.addr)
+		return err
+	}
+	client := rpc.NewClient(conn)
+
+	var reply BackupReply
+	snapshot := LogSnapshot{Epoch: s.getEpoch(), Entries: s.snapshotEntries()}
+	err = callBackup(client, "Server.SyncFromPrimary", snapshot, &reply, BackupSyncTimeout)
+	if err != nil {
+		log.Printf("Error: cannot sync standby server [%s]: %s\n", b.addr, err)
+		client.Close()
+		return err
+	}
+	if !reply.Applied {
+		client.Close()
+		return s.fence(reply.Epoch)
+	}
+
+	log.Printf("Streaming metadata to standby server [%s]\n", b.addr)
+	b.client = client
+	return nil
+}
+
+// callBackup makes an RPC to the standby, giving up after timeout.
+func callBackup(client *rpc.Client, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	select {
+	case call := <-client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		return call.Error
+	case <-time.After(timeout):
+		return fmt.Errorf("%s timed out", method)
+	}
+}
+
+// snapshotEntries returns log entries that rebuild the server's current metadata from empty.
+func (s *Server) snapshotEntries() []LogEntry {
+	var entries []LogEntry
+
+	s.clientsLock.RLock()
+	for _, clients := range []map[int]*ClientRegistrationInfo{s.ConnectedClients, s.DisconnectedClients} {
+		for clientId, info := range clients {
+			entries = append(entries, LogEntry{
+				Op: RegisterClientOp, ClientId: clientId, ClientAddress: info.ClientAddress,
+			})
+		}
+	}
+	s.clientsLock.RUnlock()
+
+	// Tombstones first: deleting a file that does not exist only records its tombstone
+	s.filesLock.RLock()
+	for filename := range s.Tombstones {
+		entries = append(entries, LogEntry{Op: DeleteFileOp, Filename: filename})
+	}
+	s.filesLock.RUnlock()
+
+	for _, filename := range s.fileNames() {
+		fileInfo := s.getFile(filename)
+		if fileInfo == nil {continue}
+		lastWriter, lastModified := fileInfo.lastWrite()
+		entries = append(entries, LogEntry{
+			Op: CreateFileOp, Filename: filename, Layout: fileInfo.layout(), FileId: fileInfo.Id,
+			Version: fileInfo.firstVersion(), ClientId: lastWriter, Timestamp: lastModified,
+		})
+		// Lock tokens only grow, so replaying a release never releases a newer lock
+		entries = append(entries, s.auditEntries(filename)...)
+
+		fileInfo.lock.Lock()
+		for chunkNum, chunkInfo := range fileInfo.ChunkInfo {
+			// Oldest version first, so the current version is the last one written
+			var versions []int
+			for ver := range chunkInfo.ChunkOwners {
+				versions = append(versions, ver)
+			}
+			sort.Ints(versions)
+
+			for _, ver := range versions {
+				owners := chunkInfo.ChunkOwners[ver]
+				firstOwner := shared.UnsetClientId
+				if len(owners) > 0 {firstOwner = owners[0]}
+				entries = append(entries, LogEntry{
+					Op: WriteChunkOp, Filename: filename, ChunkNum: chunkNum, Version: ver, ClientId: firstOwner,
+				})
+				for _, owner := range owners[1:] {
+					entries = append(entries, LogEntry{
+						Op: AddChunkOwnerOp, Filename: filename, ChunkNum: chunkNum, Version: ver, ClientId: owner,
+					})
+				}
+			}
+		}
+
+		if fileInfo.LockToken > 0 {
+			// Carries the latest token over even if no lock is held
+			entries = append(entries, LogEntry{
+				Op: SetLockHolderOp, Filename: filename, ClientId: shared.UnsetClientId, Token: fileInfo.LockToken,
+			})
+		}
+		for lockHolder, lock := range fileInfo.Locks {
+			for _, chunks := range lock.Ranges {
+				entries = append(entries, LogEntry{
+					Op: LockChunksOp, Filename: filename, ClientId: lockHolder,
+					ChunkNum: chunks.First, LastChunkNum: chunks.Last, Token: lock.Token, Timestamp: lock.Since,
+				})
+			}
+		}
+		fileInfo.lock.Unlock()
+	}
+	return entries
+}
+
+// heardFromPrimary records a call from the primary at epoch and fills reply with
+// the standby's answer. Returns false if the standby has taken over.
+func (s *Server) heardFromPrimary(epoch int, reply *BackupReply) bool {
+	s.epochLock.Lock()
+	defer s.epochLock.Unlock()
+	if !s.isPromoted {
+		s.lastPrimaryContact = time.Now()
+		if epoch > s.epoch {s.epoch = epoch}
+	}
+	*reply = BackupReply{Applied: !s.isPromoted, Epoch: s.epoch}
+	return !s.isPromoted
+}
+
+// SyncFromPrimary is an RPC target on a standby server. It replaces the standby's
+// metadata with a snapshot of the primary's.
+func (s *Server) SyncFromPrimary(snapshot *LogSnapshot, reply *BackupReply) error {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	if !s.isStandby {return StandbyError("not started with -standby")}
+	if !s.heardFromPrimary(snapshot.Epoch, reply) {return nil}
+
+	if s.metadataLog != nil {
+		err := s.metadataLog.Rewrite(snapshot.Entries)
+		if err != nil {return err}
+	}
+
+	s.clientsLock.Lock()
+	s.DisconnectedClients = make(map[int]*ClientRegistrationInfo)
+	s.NextClientId = FirstClientId
+	s.clientsLock.Unlock()
+	s.filesLock.Lock()
+	s.Files = make(map[string]*FileInfo)
+	s.Tombstones = make(map[string]bool)
+	s.filesLock.Unlock()
+	s.auditLock.Lock()
+	s.auditLog = nil
+	s.auditLock.Unlock()
+	for _, entry := range snapshot.Entries {
+		s.apply(entry)
+	}
+
+	log.Printf("Synced %d files from primary\n", len(s.fileNames()))
+	return nil
+}
+
+// ApplyLogEntry is an RPC target on a standby server. The primary calls it with
+// every mutation it commits.
+func (s *Server) ApplyLogEntry(args *ForwardedEntry, reply *BackupReply) error {
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	if !s.isStandby {return StandbyError("not started with -standby")}
+	if !s.heardFromPrimary(args.Epoch, reply) {return nil}
+
+	return s.commitLocked(args.Entry)
+}
+
+// PrimaryHeartbeat is an RPC target on a standby server. The primary at epoch calls
+// it periodically to show it is alive.
+func (s *Server) PrimaryHeartbeat(epoch *int, reply *BackupReply) error {
+	if !s.isStandby {return StandbyError("not started with -standby")}
+	s.heardFromPrimary(*epoch, reply)
+	return nil
+}
+
+// promoteStandby makes a standby server stop following the primary. It is called
+// when a client registers, since clients only come to the standby after the primary
+// stopped answering them. A primary the standby heard from within PrimarySilenceTimeout
+// may still be serving other clients, so the standby does not take over from it.
+// The takeover is logged under a new epoch, which fences the primary: the standby
+// refuses its updates from then on, and the primary stops serving clients when it
+// is told of the new epoch.
+func (s *Server) promoteStandby() error {
+	if !s.isStandby {return nil}
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	s.epochLock.Lock()
+	isPromoted, silence, epoch := s.isPromoted, time.Since(s.lastPrimaryContact), s.epoch
+	s.epochLock.Unlock()
+	if isPromoted {return nil}
+	if silence < PrimarySilenceTimeout {return PrimaryActiveError(silence)}
+
+	err := s.commitLocked(LogEntry{Op: PromoteOp, Epoch: epoch + 1})
+	if err != nil {return err}
+	log.Printf("Standby server taking over from the primary at epoch [%d]\n", epoch+1)
+	return nil
+}
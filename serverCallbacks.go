@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+	"./shared"
+)
+
+// How long a client has to acknowledge an InvalidateChunk callback
+const CallbackTimeout = 1 * time.Second
+
+// Callbacks
+//
+// A client that opens or reads a file (in READ or WRITE mode) is promised a
+// callback on it: whenever a newer version of one of the file's chunks becomes
+// current, the server calls the client's DiskService.InvalidateChunk before
+// acknowledging the write, so the client can serve reads of chunks it already
+// holds from its local copy. A client that cannot be reached in time is
+// disconnected, as if it had stopped sending heartbeats, so that it stops
+// trusting its copy.
+//
+// Promises last until the client disconnects, and are not logged: a client
+// registering with a server, after a restart or a failover, drops everything it
+// had cached, so it never relies on a promise the server has forgotten.
+
+// addCallback promises clientId a callback when a chunk of filename changes.
+func (s *Server) addCallback(filename string, clientId int) {
+	s.callbacksLock.Lock()
+	defer s.callbacksLock.Unlock()
+	holders, exists := s.callbacks[filename]
+	if !exists {
+		holders = make(map[int]bool)
+		s.callbacks[filename] = holders
+	}
+	holders[clientId] = true
+}
+
+// dropCallbacks forgets every promise made to clientId.
+func (s *Server) dropCallbacks(clientId int) {
+	s.callbacksLock.Lock()
+	defer s.callbacksLock.Unlock()
+	for _, holders := range s.callbacks {
+		delete(holders, clientId)
+	}
+}
+
+// forgetCallbacks forgets every promise made on filename, once it is deleted or renamed.
+func (s *Server) forgetCallbacks(filename string) {
+	s.callbacksLock.Lock()
+	defer s.callbacksLock.Unlock()
+	delete(s.callbacks, filename)
+}
+
+// callbackHolders returns the clients promised a callback on filename.
+func (s *Server) callbackHolders(filename string) []int {
+	s.callbacksLock.Lock()
+	defer s.callbacksLock.Unlock()
+	var clientIds []int
+	for clientId := range s.callbacks[filename] {
+		clientIds = append(clientIds, clientId)
+	}
+	return clientIds
+}
+
+// breakCallbacks tells every client promised a callback on filename, other than
+// writerId, that version ver of chunkNum is now current. Returns once they all
+// acknowledged it or were disconnected.
+func (s *Server) breakCallbacks(filename string, chunkNum uint64, ver int, writerId int) {
+	req := shared.InvalidateChunkRequest{Filename: filename, ChunkNum: chunkNum, Version: ver}
+	var wg sync.WaitGroup
+	for _, clientId := range s.callbackHolders(filename) {
+		if clientId == writerId {continue}
+		client := s.clientConnection(clientId)
+		if client == nil {continue}
+
+		wg.Add(1)
+		go func(clientId int) {
+			defer wg.Done()
+			var reply bool
+			call := client.Go("DiskService.InvalidateChunk", req, &reply, make(chan *rpc.Call, 1))
+			select {
+			case <-call.Done:
+				if call.Error == nil {return}
+				log.Printf("Error: client [%d] did not take callback on [%s] chunk [%d]: %s\n",
+					clientId, filename, chunkNum, call.Error)
+			case <-time.After(CallbackTimeout):
+				log.Printf("Error: client [%d] did not take callback on [%s] chunk [%d] in time\n",
+					clientId, filename, chunkNum)
+			}
+			s.disconnectClient(clientId)
+		}(clientId)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"./shared"
+)
+
+const ChunkStoreDirName = "chunks"
+
+// ChunkStore keeps the server's own copy of every committed chunk version, so a
+// version stays readable after all of its owners have gone offline.
+// Each version is stored in its own file: <data-dir>/chunks/<file>/<chunk #>.<version>,
+// where <file> is "file-" followed by the file's ID in hex. File IDs are never
+// reused, so a name that is deleted and created again never finds the chunks of
+// the file it named before, and renaming a file leaves its chunks in place. Files
+// created before files had IDs keep their chunks under their name.
+//
+// The store is local to the server: it is not streamed to a standby server nor
+// replicated to Raft peers. After a failover, versions only the old server stored
+// can only be read from the clients that own them.
+type ChunkStore struct {
+	dir string
+}
+
+func OpenChunkStore(dataDir string) (*ChunkStore, error) {
+	dir := filepath.Join(dataDir, ChunkStoreDirName)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Printf("Error: cannot create chunk store [%s]\n", dir)
+		return nil, err
+	}
+	return &ChunkStore{dir: dir}, nil
+}
+
+// getFileDir returns the directory holding the chunks of the file with ID fileId,
+// currently named filename.
+func (cs *ChunkStore) getFileDir(fileId uint64, filename string) string {
+	if fileId == shared.UnsetFileId {return filepath.Join(cs.dir, filename)}
+	return filepath.Join(cs.dir, fmt.Sprintf("file-%016x", fileId))
+}
+
+func (cs *ChunkStore) getChunkPath(fileId uint64, filename string, chunkNum uint64, ver int) string {
+	return filepath.Join(cs.getFileDir(fileId, filename), fmt.Sprintf("%d.%d", chunkNum, ver))
+}
+
+// Put durably stores chunk.Data as version chunk.Version of chunk chunk.ChunkNum.
+// The data is written to a temporary file and renamed into place, so a crash never
+// leaves a partially written version behind.
+func (cs *ChunkStore) Put(fileId uint64, filename string, chunk shared.Chunk) error {
+	err := os.MkdirAll(cs.getFileDir(fileId, filename), 0755)
+	if err != nil {return err}
+
+	chunkPath := cs.getChunkPath(fileId, filename, chunk.ChunkNum, chunk.Version)
+	tmpFile, err := ioutil.TempFile(filepath.Dir(chunkPath), "tmp")
+	if err != nil {return err}
+
+	_, err = tmpFile.Write(chunk.Data[:])
+	if err == nil {err = tmpFile.Sync()}
+	tmpFile.Close()
+	if err == nil {err = os.Rename(tmpFile.Name(), chunkPath)}
+	if err != nil {
+		log.Printf("Error: cannot store file [%s] chunk [%d] ver [%d]\n", filename, chunk.ChunkNum, chunk.Version)
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	// The rename itself is durable once the directory is synced
+	dir, err := os.Open(filepath.Dir(chunkPath))
+	if err != nil {return err}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Get returns the stored copy of version ver of the chunk, which is chunkSize bytes long.
+func (cs *ChunkStore) Get(fileId uint64, filename string, chunkNum uint64, ver int, chunkSize int) (shared.Chunk, error) {
+	data, err := ioutil.ReadFile(cs.getChunkPath(fileId, filename, chunkNum, ver))
+	if err != nil || len(data) != chunkSize {
+		return shared.Chunk{}, AllChunksOfflineError(chunkNum)
+	}
+	return shared.Chunk{ChunkNum: chunkNum, Version: ver, Data: data}, nil
+}
+
+// Has reports whether version ver of the chunk is stored.
+func (cs *ChunkStore) Has(fileId uint64, filename string, chunkNum uint64, ver int) bool {
+	_, err := os.Stat(cs.getChunkPath(fileId, filename, chunkNum, ver))
+	return err == nil
+}
+
+// Remove drops every stored version of the file's chunks.
+func (cs *ChunkStore) Remove(fileId uint64, filename string) error {
+	return os.RemoveAll(cs.getFileDir(fileId, filename))
+}
+
+// Rename follows a file to its new name. Only the chunks of files without an ID
+// move; whatever is left under the new name belongs to a file deleted before.
+func (cs *ChunkStore) Rename(fileId uint64, filename string, newFilename string) error {
+	if fileId != shared.UnsetFileId {return nil}
+	err := cs.Remove(fileId, newFilename)
+	if err != nil {return err}
+	err = os.Rename(cs.getFileDir(fileId, filename), cs.getFileDir(fileId, newFilename))
+	if os.IsNotExist(err) {return nil}
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"./shared"
+)
+
+// Handle IDs start after shared.UnsetHandleId
+const FirstHandleId = 1
+
+// HandleInfo describes a file opened by a client. A client may hold several
+// handles at once, on the same or different files and in different modes.
+type HandleInfo struct {
+	ClientId int
+	Filename string
+	Mode shared.FileMode
+}
+
+// Handle IDs are not logged. A restarted server, or one that takes over, knows
+// none of the handles opened before, so closing a handle it does not know is
+// not an error.
+
+// openHandle records a newly opened file and returns its handle ID.
+func (s *Server) openHandle(clientId int, filename string, mode shared.FileMode) int {
+	s.handlesLock.Lock()
+	defer s.handlesLock.Unlock()
+	handleId := s.nextHandleId
+	s.nextHandleId++
+	s.handles[handleId] = &HandleInfo{ClientId: clientId, Filename: filename, Mode: mode}
+	return handleId
+}
+
+// closeHandle forgets a handle, as long as it was opened by clientId on filename.
+func (s *Server) closeHandle(handleId int, clientId int, filename string) {
+	s.handlesLock.Lock()
+	defer s.handlesLock.Unlock()
+	handle, exists := s.handles[handleId]
+	if exists && handle.ClientId == clientId && handle.Filename == filename {
+		delete(s.handles, handleId)
+	}
+}
+
+// hasWriteHandle reports whether clientId still has filename open in WRITE mode.
+func (s *Server) hasWriteHandle(clientId int, filename string) bool {
+	s.handlesLock.Lock()
+	defer s.handlesLock.Unlock()
+	for _, handle := range s.handles {
+		if handle.ClientId == clientId && handle.Filename == filename && handle.Mode == shared.WRITE {
+			return true
+		}
+	}
+	return false
+}
+
+// closeFileHandles forgets every handle on filename, once the file is deleted or renamed.
+func (s *Server) closeFileHandles(filename string) {
+	s.handlesLock.Lock()
+	defer s.handlesLock.Unlock()
+	for handleId, handle := range s.handles {
+		if handle.Filename == filename {delete(s.handles, handleId)}
+	}
+}
+
+// closeClientHandles forgets every handle held by clientId.
+func (s *Server) closeClientHandles(clientId int) {
+	s.handlesLock.Lock()
+	defer s.handlesLock.Unlock()
+	for handleId, handle := range s.handles {
+		if handle.ClientId == clientId {delete(s.handles, handleId)}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"./shared"
+)
+
+// mergeInventory folds the chunks a registering client holds locally into the
+// server's metadata.
+//
+// Files the server has no record of (e.g. after a restart without a metadata log)
+// are recovered with the client as owner of their chunks. A chunk held at a version
+// the server committed adds the client as an owner of that version. Any other
+// version of a file the server knows is reported as a conflict and left out: the
+// client's record of it (e.g. a stale or damaged version file) is not trusted over
+// the server's own.
+//
+// Copies of files deleted or renamed while the client was offline are not merged
+// as such; the changes the client must make to them are returned (see missedChanges).
+func (s *Server) mergeInventory(clientId int, inventory []shared.FileInventory) (
+	conflicts []shared.InventoryConflict, changes []shared.FileChange, err error) {
+	heldNames := make(map[string]bool)
+	for _, fileInv := range inventory {
+		heldNames[fileInv.Filename] = true
+	}
+
+	for _, fileInv := range inventory {
+		fileChanges, isDeleted := s.missedChanges(fileInv, heldNames)
+		if len(fileChanges) > 0 {
+			log.Printf("Client [%d] missed changes to file [%s]\n", clientId, fileInv.Filename)
+			changes = append(changes, fileChanges...)
+		}
+		if isDeleted {continue}
+		for _, change := range fileChanges {
+			if change.Op == shared.RenameChange {fileInv.Filename = change.NewFilename}
+		}
+
+		isRecovered := !s.doesFileExist(fileInv.Filename)
+		if isRecovered {
+			log.Printf("Recovered file [%s] from client [%d]\n", fileInv.Filename, clientId)
+			layout := fileInv.Layout
+			if !layout.IsValid() {layout = shared.DefaultLayout}
+			fileId := fileInv.FileId
+			if fileId == shared.UnsetFileId {fileId = newFileId()}
+			err = s.commit(LogEntry{
+				Op: CreateFileOp, Filename: fileInv.Filename, Layout: layout, FileId: fileId, Version: FirstChunkVer,
+			})
+			if err != nil {return nil, nil, err}
+		}
+
+		fileConflicts, err := s.mergeFileInventory(clientId, fileInv, isRecovered)
+		if err != nil {return nil, nil, err}
+		conflicts = append(conflicts, fileConflicts...)
+	}
+	return conflicts, changes, nil
+}
+
+// missedChanges works out whether a client's copy of a file is of a file that was
+// deleted or renamed, or that lost chunks to a truncate, while the client was
+// offline, and returns the changes to make to it in order:
+//
+//   - A copy of a file that now has another name is renamed, unless the client
+//     already holds a file by that name, in which case it is deleted.
+//   - A copy of a file that no longer exists is deleted, if its name was deleted
+//     or renamed, or now belongs to another file.
+//   - A copy that is longer than a truncated file is truncated.
+//   - A copy of a file the server has no trace of is recovered, keeping its ID.
+//
+// Copies whose file ID the client never learned (e.g. files created in DWRITE
+// mode) are taken to be of the file that has their name, and are recovered if
+// there is none.
+func (s *Server) missedChanges(fileInv shared.FileInventory, heldNames map[string]bool) (
+	changes []shared.FileChange, isDeleted bool) {
+	filename := fileInv.Filename
+	fileInfo := s.getFile(filename)
+	if fileInv.FileId != shared.UnsetFileId && (fileInfo == nil || fileInfo.Id != fileInv.FileId) {
+		newFilename, isRenamed := s.fileNameById(fileInv.FileId)
+		if isRenamed && !heldNames[newFilename] {
+			changes = append(changes, shared.FileChange{Op: shared.RenameChange, Filename: filename, NewFilename: newFilename})
+			filename = newFilename
+			fileInfo = s.getFile(filename)
+		} else if isRenamed || fileInfo != nil || s.isTombstoned(filename) {
+			return []shared.FileChange{{Op: shared.DeleteChange, Filename: filename}}, true
+		} else {
+			// The server lost track of the file; it is recovered from the copy
+			return nil, false
+		}
+	}
+
+	if fileInfo == nil {return changes, false}
+	layout := fileInfo.layout()
+	if fileInfo.firstVersion() > FirstChunkVer && fileInv.Layout.NumChunks > layout.NumChunks {
+		changes = append(changes, shared.FileChange{Op: shared.TruncateChange, Filename: filename, NumChunks: layout.NumChunks})
+	}
+	return changes, false
+}
+
+// mergeFileInventory merges the chunks of one file. Versions the server did not
+// commit are only taken if the file was just recovered from this client. Writes to
+// the file wait until it is done, so a version is never taken over one written in
+// the meantime.
+func (s *Server) mergeFileInventory(clientId int, fileInv shared.FileInventory, isRecovered bool) (
+	conflicts []shared.InventoryConflict, err error) {
+	fileInfo := s.getFile(fileInv.Filename)
+	if fileInfo == nil {return nil, nil}
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+
+	firstVersion := fileInfo.firstVersion()
+	for chunkNum, ver := range fileInv.ChunkVersions {
+		if ver == shared.NoVersion {continue}
+
+		currentVersion, exists := fileInfo.currentVersion(chunkNum)
+		// Versions older than the file's first version belong to chunks a truncate dropped
+		if ver < firstVersion && (!exists || currentVersion >= firstVersion) {continue}
+		if fileInfo.hasVersion(chunkNum, ver) {
+			err = s.addChunkOwner(fileInv.Filename, chunkNum, ver, clientId)
+			if err != nil {return nil, err}
+			continue
+		}
+
+		if !isRecovered || chunkNum >= fileInfo.layout().MaxChunks() {
+			log.Printf("Conflict: client [%d] holds file [%s] chunk [%d] ver [%d], never committed; server ver is [%d]\n",
+				clientId, fileInv.Filename, chunkNum, ver, currentVersion)
+			conflicts = append(conflicts, shared.InventoryConflict{
+				Filename:      fileInv.Filename,
+				ChunkNum:      chunkNum,
+				LocalVersion:  ver,
+				ServerVersion: currentVersion,
+			})
+			continue
+		}
+		log.Printf("Recovered file [%s] chunk [%d] ver [%d] from client [%d]\n",
+			fileInv.Filename, chunkNum, ver, clientId)
+		err = s.commit(LogEntry{
+			Op: WriteChunkOp, Filename: fileInv.Filename, ChunkNum: chunkNum, Version: ver, ClientId: clientId,
+		})
+		if err != nil {return nil, err}
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"time"
+	"./shared"
+)
+
+// How long a write lease lasts after it is granted or last renewed by a heartbeat
+const LeaseDuration = 5 * time.Second
+
+// Leases
+//
+// A client holding a write lock on a file holds it under a lease. Every heartbeat
+// from the client renews all of its leases. A lease that was not renewed in time
+// lapses: its writes are rejected, another client may lock its chunks, and the
+// lock is released by monitorClientConnections.
+//
+// Each new lock on a file gets the next fencing token (FileInfo.LockToken), and
+// writes carrying another token than their lock's are rejected, so a client that
+// lost its lease can never overwrite the next holder's writes.
+//
+// Expiry times are not logged. A server that has just restarted, or taken over
+// from another, gives the leases it inherits a full LeaseDuration to be renewed.
+
+// covers reports whether the lock includes chunkNum.
+func (l *WriteLock) covers(chunkNum uint64) bool {
+	for _, chunks := range l.Ranges {
+		if chunks.Contains(chunkNum) {return true}
+	}
+	return false
+}
+
+// includes reports whether one of the lock's ranges includes all of chunks.
+func (l *WriteLock) includes(chunks shared.ChunkRange) bool {
+	for _, held := range l.Ranges {
+		if held.Includes(chunks) {return true}
+	}
+	return false
+}
+
+// overlaps reports whether the lock includes any of chunks.
+func (l *WriteLock) overlaps(chunks shared.ChunkRange) bool {
+	for _, held := range l.Ranges {
+		if held.Overlaps(chunks) {return true}
+	}
+	return false
+}
+
+// leaseLapsed reports whether the lease on a lock has run out.
+// Must be called with the file's lock held.
+func (l *WriteLock) leaseLapsed(now time.Time) bool {
+	return !l.leaseExpiry.IsZero() && now.After(l.leaseExpiry)
+}
+
+// writeLock returns a copy of clientId's write lock on the file, and whether it
+// holds one under a valid lease.
+func (fi *FileInfo) writeLock(clientId int) (WriteLock, bool) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	lock, exists := fi.Locks[clientId]
+	if !exists {return WriteLock{}, false}
+	copied := *lock
+	copied.Ranges = append([]shared.ChunkRange(nil), lock.Ranges...)
+	return copied, !lock.leaseLapsed(time.Now())
+}
+
+// overlappingLocks returns the other clients whose lapsed locks overlap chunks,
+// and true if another client holds a valid lock on any of them.
+func (fi *FileInfo) overlappingLocks(clientId int, chunks shared.ChunkRange) (lapsedHolders []int, isLocked bool) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	now := time.Now()
+	for lockHolder, lock := range fi.Locks {
+		if lockHolder == clientId || !lock.overlaps(chunks) {continue}
+		if !lock.leaseLapsed(now) {return nil, true}
+		lapsedHolders = append(lapsedHolders, lockHolder)
+	}
+	return lapsedHolders, false
+}
+
+// renewLease extends clientId's lease on the file by LeaseDuration, if it holds a
+// lock. A lease that has already lapsed stays lapsed, even before expireLeases
+// releases its lock: its holder's writes may already have been fenced off.
+func (fi *FileInfo) renewLease(clientId int) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	lock, exists := fi.Locks[clientId]
+	if !exists {return}
+	now := time.Now()
+	if lock.leaseLapsed(now) {return}
+	lock.leaseExpiry = now.Add(LeaseDuration)
+}
+
+// renewLeases extends every lease held by clientId.
+func (s *Server) renewLeases(clientId int) {
+	for _, filename := range s.fileNames() {
+		fileInfo := s.getFile(filename)
+		if fileInfo != nil {fileInfo.renewLease(clientId)}
+	}
+}
+
+// expireLeases releases the locks whose lease has lapsed.
+func (s *Server) expireLeases() {
+	now := time.Now()
+	for _, filename := range s.fileNames() {
+		fileInfo := s.getFile(filename)
+		if fileInfo == nil {continue}
+
+		var lapsedHolders []int
+		fileInfo.lock.Lock()
+		for lockHolder, lock := range fileInfo.Locks {
+			if lock.leaseExpiry.IsZero() {
+				// Inherited lease; give its holder time to renew it with this server
+				lock.leaseExpiry = now.Add(LeaseDuration)
+			}
+			if lock.leaseLapsed(now) {lapsedHolders = append(lapsedHolders, lockHolder)}
+		}
+		fileInfo.lock.Unlock()
+
+		for _, lockHolder := range lapsedHolders {
+			released, err := s.revokeLapsedLease(fileInfo, filename, lockHolder)
+			if err == nil && released {
+				log.Printf("Lease of client [%d] on [%s.dfs] expired\n", lockHolder, filename)
+			}
+		}
+	}
+}
+
+// revokeLapsedLease releases clientId's lock on the file if it is still held under a lapsed lease.
+func (s *Server) revokeLapsedLease(fileInfo *FileInfo, filename string, clientId int) (bool, error) {
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+
+	_, isValid := fileInfo.writeLock(clientId)
+	if !fileInfo.holdsLock(clientId) || isValid {return false, nil}
+	err := s.commit(LogEntry{Op: UnlockChunksOp, Filename: filename, ClientId: clientId})
+	return err == nil, err
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"./shared"
+)
+
+const MetadataLogFileName = "metadata.log"
+
+// LogOp identifies the kind of metadata mutation recorded in a LogEntry.
+type LogOp int
+
+const (
+	// A new client was assigned ClientId.
+	RegisterClientOp LogOp = iota
+
+	// Filename was added to Server.Files with Layout and ID FileId. Chunks written
+	// to it for the first time get version Version. In snapshots, ClientId last
+	// wrote to it at Timestamp.
+	CreateFileOp
+
+	// ClientId wrote Version of chunk ChunkNum at Timestamp. It becomes the only owner
+	// of that version. Timestamp is zero for versions recovered from client inventories
+	// or snapshots, which do not change the file's last write.
+	WriteChunkOp
+
+	// ClientId now holds Version of chunk ChunkNum.
+	AddChunkOwnerOp
+
+	// ClientId now holds a write lock on the whole of Filename, under fencing token
+	// Token. If ClientId is UnsetClientId, every lock on Filename is released.
+	// Only written with UnsetClientId since locks cover ranges of chunks.
+	SetLockHolderOp
+
+	// This standby server took over from its primary under epoch Epoch.
+	PromoteOp
+
+	// This primary server's standby took over from it under epoch Epoch; the primary
+	// no longer serves clients.
+	FenceOp
+
+	// Changes nothing. A newly elected Raft leader appends one to commit earlier entries.
+	NoOp
+
+	// ClientId now holds a write lock on chunks ChunkNum to LastChunkNum of Filename,
+	// under fencing token Token. They are added to ClientId's lock if it holds one
+	// under the same token, which they replace otherwise.
+	LockChunksOp
+
+	// ClientId released its write lock on Filename.
+	UnlockChunksOp
+
+	// Operator released ClientId's write lock on Filename, if it is still held under
+	// Token, for Reason. Recorded in the audit log either way.
+	ForceUnlockOp
+
+	// Filename was removed from Server.Files, and its name kept as a tombstone.
+	// Only records the tombstone if Filename does not exist.
+	DeleteFileOp
+
+	// Filename was renamed NewFilename, releasing its write locks, and its old name
+	// kept as a tombstone. Does nothing if NewFilename exists.
+	RenameFileOp
+
+	// Filename now holds ChunkNum chunks. Chunks from ChunkNum on are dropped, and
+	// chunks written for the first time from then on get a newer version than any
+	// of them had.
+	TruncateFileOp
+)
+
+// LogEntry is a single mutation of the server's metadata. Fields that do not
+// apply to an Op are left at their zero value.
+type LogEntry struct {
+	Op            LogOp
+	ClientId      int
+	ClientAddress string
+	Filename      string
+	ChunkNum      uint64
+	Version       int
+	Token         int
+	Epoch         int
+	LastChunkNum  uint64
+	NewFilename   string
+	FileId        uint64
+	Layout        shared.FileLayout
+	Timestamp     time.Time
+	Operator      string
+	Reason        string
+}
+
+// MetadataLog is an append-only file of LogEntry records, one JSON object per line.
+// Each append is synced to disk before it returns.
+type MetadataLog struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// OpenMetadataLog opens (or creates) the log in dataDir and returns the entries
+// already in it. A torn record at the end of the log, left behind by a crash
+// mid-append, is discarded.
+func OpenMetadataLog(dataDir string) (*MetadataLog, []LogEntry, error) {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {return nil, nil, err}
+
+	var entries []LogEntry
+	logPath := filepath.Join(dataDir, MetadataLogFileName)
+	file, err := openRecordFile(logPath, func(line []byte) error {
+		var entry LogEntry
+		err := json.Unmarshal(line, &entry)
+		if err == nil {entries = append(entries, entry)}
+		return err
+	})
+	if err != nil {
+		log.Printf("Error: cannot open metadata log [%s]\n", logPath)
+		return nil, nil, err
+	}
+
+	log.Printf("Read %d entries from metadata log [%s]\n", len(entries), logPath)
+	return &MetadataLog{file: file}, entries, nil
+}
+
+// Append durably records entry at the end of the log.
+func (l *MetadataLog) Append(entry LogEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return appendRecords(l.file, entry)
+}
+
+// Rewrite atomically replaces the contents of the log with entries.
+func (l *MetadataLog) Rewrite(entries []LogEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	records := make([]interface{}, len(entries))
+	for i := range entries {
+		records[i] = entries[i]
+	}
+	file, err := rewriteRecordFile(l.file.Name(), records)
+	if err != nil {return err}
+	l.file.Close()
+	l.file = file
+	return nil
+}
+
+func (l *MetadataLog) Close() error {
+	return l.file.Close()
+}
+
+// openRecordFile opens (or creates) a file of JSON records, one per line, and passes
+// each record in it to decode. Decoding stops at the first record decode rejects:
+// that is a torn record left behind by a crash mid-append, and it is discarded along
+// with anything after it. The returned file is positioned for appending.
+func openRecordFile(path string, decode func(line []byte) error) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {return nil, err}
+
+	var validBytes int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if decode(line) != nil {
+			log.Printf("Discarding torn record at offset %d of [%s]\n", validBytes, path)
+			break
+		}
+		validBytes += int64(len(line)) + 1
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Drop anything after the last complete record so new records start on a clean line
+	if err = file.Truncate(validBytes); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(validBytes, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// appendRecords durably writes records to the end of a file opened by openRecordFile.
+func appendRecords(file *os.File, records ...interface{}) error {
+	var buffer []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {return err}
+		buffer = append(append(buffer, line...), '\n')
+	}
+
+	_, err := file.Write(buffer)
+	if err != nil {return err}
+	return file.Sync()
+}
+
+// rewriteRecordFile atomically replaces the file at path with records, and returns
+// the new file opened for appending.
+func rewriteRecordFile(path string, records []interface{}) (*os.File, error) {
+	tmpFile, err := os.Create(path + ".tmp")
+	if err != nil {return nil, err}
+
+	err = appendRecords(tmpFile, records...)
+	tmpFile.Close()
+	if err == nil {err = os.Rename(tmpFile.Name(), path)}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+}
+
+// openMetadataLog rebuilds the server's metadata from the log in dataDir,
+// then records all further mutations to it.
+func (s *Server) openMetadataLog(dataDir string) error {
+	metadataLog, entries, err := OpenMetadataLog(dataDir)
+	if err != nil {return err}
+
+	for _, entry := range entries {
+		s.apply(entry)
+	}
+	s.metadataLog = metadataLog
+
+	// No client is connected right after a restart, so nobody can still be holding a lock
+	for clientId := range s.DisconnectedClients {
+		s.unlockByClientId(clientId)
+	}
+	log.Printf("Restored %d files, next client ID is [%d]\n", len(s.Files), s.NextClientId)
+	return nil
+}
+
+// commit records entry in the metadata log (if the server has one), forwards it
+// to the standby server (if any) and applies it. In a Raft cluster, it replicates
+// entry to the cluster instead.
+// Nothing is applied if the entry could not be logged.
+func (s *Server) commit(entry LogEntry) error {
+	if s.raft != nil {
+		// Applied by the Raft node once a majority of the cluster has it
+		return s.raft.Replicate(entry)
+	}
+	s.commitLock.Lock()
+	defer s.commitLock.Unlock()
+	return s.commitLocked(entry)
+}
+
+// commitLocked is commit for callers already holding s.commitLock.
+func (s *Server) commitLocked(entry LogEntry) error {
+	if err := s.checkFenced(); err != nil {return err}
+	if s.metadataLog != nil {
+		err := s.metadataLog.Append(entry)
+		if err != nil {
+			log.Printf("Error: cannot append to metadata log: %s\n", err)
+			return err
+		}
+	}
+	if s.backup != nil {
+		// Not applied if the standby has taken over
+		err := s.forwardToBackup(entry)
+		if err != nil {return err}
+	}
+	s.apply(entry)
+	return nil
+}
+
+// apply performs the mutation described by entry on the server's metadata.
+// It is used both for live mutations and for replaying the log.
+func (s *Server) apply(entry LogEntry) {
+	switch entry.Op {
+	case RegisterClientOp:
+		s.clientsLock.Lock()
+		defer s.clientsLock.Unlock()
+		if entry.ClientId >= s.NextClientId {
+			s.NextClientId = entry.ClientId + 1
+		}
+		if _, isConnected := s.ConnectedClients[entry.ClientId]; !isConnected {
+			s.DisconnectedClients[entry.ClientId] = &ClientRegistrationInfo{
+				ClientId:      entry.ClientId,
+				ClientAddress: entry.ClientAddress,
+			}
+		}
+	case CreateFileOp:
+		s.filesLock.Lock()
+		defer s.filesLock.Unlock()
+		if _, exists := s.Files[entry.Filename]; !exists {
+			// Files created before layouts were logged have the default one
+			layout := entry.Layout
+			if !layout.IsValid() {layout = shared.DefaultLayout}
+			fileInfo := &FileInfo{
+				Id: entry.FileId, Layout: layout, ChunkInfo: make(map[uint64]*ChunkInfo),
+				Locks: make(map[int]*WriteLock), FirstVersion: entry.Version, LastWriter: shared.UnsetClientId,
+			}
+			if !entry.Timestamp.IsZero() {
+				fileInfo.LastWriter, fileInfo.LastModified = entry.ClientId, entry.Timestamp
+			}
+			s.Files[entry.Filename] = fileInfo
+		}
+	case WriteChunkOp:
+		fileInfo := s.getFile(entry.Filename)
+		// Entries made while the file was being deleted or renamed are dropped
+		if fileInfo == nil {break}
+		fileInfo.lock.Lock()
+		defer fileInfo.lock.Unlock()
+		chunkInfo, exists := fileInfo.ChunkInfo[entry.ChunkNum]
+		if !exists {
+			chunkInfo = &ChunkInfo{FirstChunkVer, make(map[int][]int)}
+			fileInfo.ChunkInfo[entry.ChunkNum] = chunkInfo
+		}
+		if entry.ChunkNum >= fileInfo.Layout.NumChunks {fileInfo.Layout.NumChunks = entry.ChunkNum + 1}
+		chunkInfo.CurrentVersion = entry.Version
+		if !entry.Timestamp.IsZero() {
+			fileInfo.LastWriter, fileInfo.LastModified = entry.ClientId, entry.Timestamp
+		}
+		chunkInfo.ChunkOwners[entry.Version] = []int{}
+		if entry.ClientId != shared.UnsetClientId {
+			chunkInfo.ChunkOwners[entry.Version] = []int{entry.ClientId}
+		}
+	case AddChunkOwnerOp:
+		fileInfo := s.getFile(entry.Filename)
+		if fileInfo == nil {break}
+		fileInfo.lock.Lock()
+		defer fileInfo.lock.Unlock()
+		chunkInfo := fileInfo.ChunkInfo[entry.ChunkNum]
+		// The chunk may have been truncated away
+		if chunkInfo == nil {break}
+		if !isOwner(chunkInfo.ChunkOwners[entry.Version], entry.ClientId) {
+			chunkInfo.ChunkOwners[entry.Version] = append(chunkInfo.ChunkOwners[entry.Version], entry.ClientId)
+		}
+	case SetLockHolderOp:
+		fileInfo := s.getFile(entry.Filename)
+		if fileInfo == nil {break}
+		fileInfo.lock.Lock()
+		fileInfo.Locks = make(map[int]*WriteLock)
+		if entry.ClientId != shared.UnsetClientId {
+			fileInfo.Locks[entry.ClientId] = &WriteLock{Ranges: []shared.ChunkRange{shared.WholeFile}, Token: entry.Token}
+		}
+		// Tokens never go back, even when a lock is released
+		if entry.Token > fileInfo.LockToken {fileInfo.LockToken = entry.Token}
+		fileInfo.lock.Unlock()
+		// The next client waiting for the lock may take it now
+		if entry.ClientId == shared.UnsetClientId {s.notifyWaiters(entry.Filename)}
+	case LockChunksOp:
+		fileInfo := s.getFile(entry.Filename)
+		if fileInfo == nil {break}
+		fileInfo.lock.Lock()
+		defer fileInfo.lock.Unlock()
+		chunks := shared.ChunkRange{First: entry.ChunkNum, Last: entry.LastChunkNum}
+		lock, exists := fileInfo.Locks[entry.ClientId]
+		if exists && lock.Token == entry.Token {
+			lock.Ranges = append(lock.Ranges, chunks)
+		} else {
+			fileInfo.Locks[entry.ClientId] = &WriteLock{
+				Ranges: []shared.ChunkRange{chunks}, Token: entry.Token, Since: entry.Timestamp,
+			}
+		}
+		if entry.Token > fileInfo.LockToken {fileInfo.LockToken = entry.Token}
+	case UnlockChunksOp:
+		fileInfo := s.getFile(entry.Filename)
+		if fileInfo == nil {break}
+		fileInfo.lock.Lock()
+		delete(fileInfo.Locks, entry.ClientId)
+		fileInfo.lock.Unlock()
+		// Clients waiting for the chunks may take them now
+		s.notifyWaiters(entry.Filename)
+	case ForceUnlockOp:
+		fileInfo := s.getFile(entry.Filename)
+		if fileInfo != nil {
+			fileInfo.lock.Lock()
+			lock, exists := fileInfo.Locks[entry.ClientId]
+			if exists && lock.Token == entry.Token {delete(fileInfo.Locks, entry.ClientId)}
+			fileInfo.lock.Unlock()
+		}
+		s.auditLock.Lock()
+		s.auditLog = append(s.auditLog, shared.AuditRecord{
+			Timestamp: entry.Timestamp, Operator: entry.Operator, Reason: entry.Reason,
+			Filename: entry.Filename, ClientId: entry.ClientId, Token: entry.Token,
+		})
+		s.auditLock.Unlock()
+		log.Printf("Audit: [%s] released the lock of client [%d] on [%s.dfs]: %s\n",
+			entry.Operator, entry.ClientId, entry.Filename, entry.Reason)
+		s.notifyWaiters(entry.Filename)
+	case DeleteFileOp:
+		s.filesLock.Lock()
+		defer s.filesLock.Unlock()
+		delete(s.Files, entry.Filename)
+		s.Tombstones[entry.Filename] = true
+	case RenameFileOp:
+		s.filesLock.Lock()
+		defer s.filesLock.Unlock()
+		fileInfo, exists := s.Files[entry.Filename]
+		if _, isTaken := s.Files[entry.NewFilename]; !exists || isTaken {break}
+		fileInfo.lock.Lock()
+		fileInfo.Locks = make(map[int]*WriteLock)
+		fileInfo.lock.Unlock()
+		delete(s.Files, entry.Filename)
+		s.Files[entry.NewFilename] = fileInfo
+		s.Tombstones[entry.Filename] = true
+	case TruncateFileOp:
+		fileInfo := s.getFile(entry.Filename)
+		if fileInfo == nil {break}
+		fileInfo.lock.Lock()
+		defer fileInfo.lock.Unlock()
+		for chunkNum, chunkInfo := range fileInfo.ChunkInfo {
+			if chunkNum < entry.ChunkNum {continue}
+			for ver := range chunkInfo.ChunkOwners {
+				if ver >= fileInfo.FirstVersion {fileInfo.FirstVersion = ver + 1}
+			}
+			delete(fileInfo.ChunkInfo, chunkNum)
+		}
+		fileInfo.Layout.NumChunks = entry.ChunkNum
+	case PromoteOp:
+		s.epochLock.Lock()
+		defer s.epochLock.Unlock()
+		s.epoch = entry.Epoch
+		s.isPromoted = true
+	case FenceOp:
+		s.epochLock.Lock()
+		defer s.epochLock.Unlock()
+		s.epoch = entry.Epoch
+		// A standby does not serve clients before it takes over anyway
+		s.isFenced = !s.isStandby
+	}
+}
+
+func isOwner(owners []int, clientId int) bool {
+	for _, owner := range owners {
+		if owner == clientId {return true}
+	}
+	return false
+}
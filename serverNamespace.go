@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"math"
+	"net/rpc"
+	"sync"
+	"time"
+	"./shared"
+)
+
+// Deleting, renaming and truncating files
+//
+// Like opening a file for writing, each of these fails if another client holds a
+// valid lease on, or is waiting for, one of the chunks it affects: every chunk for
+// a delete or rename, the chunks past the new end for a truncate. The change is
+// committed under the file's updateLock, then announced to every other connected
+// client through DiskService.ChangeFile so it changes its local copy. A client
+// that cannot be reached in time is disconnected, and, like clients that were
+// offline, is told about the change when it registers again (see missedChanges).
+//
+// Every file has a random ID, so that a client holding a copy of a file that was
+// deleted or renamed can tell it apart from a file created with the same name since.
+
+// DeleteFile is an RPC target. It deletes a file, releasing every lock on it.
+func (s *Server) DeleteFile(req *shared.DeleteFileRequest, reply *shared.FileChangeResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	log.Printf("DeleteFile: client [%d], file [%s]\n", req.ClientId, req.Filename)
+
+	change := shared.FileChange{Op: shared.DeleteChange, Filename: req.Filename}
+	err := s.changeFile(req.ClientId, change, shared.WholeFile, reply)
+	if err != nil || !reply.Success {return err}
+
+	s.announceFileChange(change, req.ClientId)
+	return nil
+}
+
+// RenameFile is an RPC target. It gives a file a new name, releasing every lock on it.
+// The new name must not be taken.
+func (s *Server) RenameFile(req *shared.RenameFileRequest, reply *shared.FileChangeResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	log.Printf("RenameFile: client [%d], file [%s] to [%s]\n", req.ClientId, req.Filename, req.NewFilename)
+
+	if s.doesFileExist(req.NewFilename) {
+		*reply = shared.FileChangeResponse{Exists: true}
+		return nil
+	}
+	change := shared.FileChange{Op: shared.RenameChange, Filename: req.Filename, NewFilename: req.NewFilename}
+	err := s.changeFile(req.ClientId, change, shared.WholeFile, reply)
+	if err != nil || !reply.Success {return err}
+
+	s.announceFileChange(change, req.ClientId)
+	return nil
+}
+
+// TruncateFile is an RPC target. It sets the number of chunks in a file, dropping
+// the chunks past its new end. Chunks added by growing the file read as zeros.
+func (s *Server) TruncateFile(req *shared.TruncateFileRequest, reply *shared.FileChangeResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	log.Printf("TruncateFile: client [%d], file [%s] to [%d] chunks\n", req.ClientId, req.Filename, req.NumChunks)
+
+	// The chunk size of a file never changes, so the new size is checked up front
+	fileInfo := s.getFile(req.Filename)
+	if fileInfo != nil && req.NumChunks > fileInfo.layout().MaxChunks() {
+		*reply = shared.FileChangeResponse{TooLarge: true}
+		return nil
+	}
+	change := shared.FileChange{Op: shared.TruncateChange, Filename: req.Filename, NumChunks: req.NumChunks}
+	dropped := shared.ChunkRange{First: req.NumChunks, Last: math.MaxUint64}
+	err := s.changeFile(req.ClientId, change, dropped, reply)
+	if err != nil || !reply.Success {return err}
+
+	s.announceFileChange(change, req.ClientId)
+	return nil
+}
+
+// changeFile commits a change to a file unless another client holds or awaits a
+// lock on any of chunks, and fills in reply with the outcome. The outcome, and the
+// server's stored copy of the file's chunks, are settled under the file's
+// updateLock, so that no other change to the file comes in between.
+func (s *Server) changeFile(clientId int, change shared.FileChange, chunks shared.ChunkRange,
+	reply *shared.FileChangeResponse) error {
+	fileInfo := s.getFile(change.Filename)
+	if fileInfo == nil {
+		*reply = shared.FileChangeResponse{NotFound: true}
+		return nil
+	}
+
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+	if s.getFile(change.Filename) != fileInfo {
+		// Deleted or renamed in the meantime
+		*reply = shared.FileChangeResponse{NotFound: true}
+		return nil
+	}
+	_, isLocked := fileInfo.overlappingLocks(clientId, chunks)
+	if isLocked || !s.isFirstInQueue(change.Filename, clientId, chunks, shared.UnsetTicketId) {
+		log.Printf("Error: file [%s] is locked\n", change.Filename)
+		conflict := s.describeConflict(change.Filename, fileInfo, clientId, chunks)
+		*reply = shared.FileChangeResponse{ConflictError: true, Conflict: conflict}
+		return nil
+	}
+
+	entry := LogEntry{Filename: change.Filename}
+	switch change.Op {
+	case shared.DeleteChange:
+		entry.Op = DeleteFileOp
+	case shared.RenameChange:
+		entry.Op, entry.NewFilename = RenameFileOp, change.NewFilename
+	case shared.TruncateChange:
+		entry.Op, entry.ChunkNum = TruncateFileOp, change.NumChunks
+	}
+	err := s.commit(entry)
+	if err != nil {return err}
+	if change.Op == shared.RenameChange && s.getFile(change.NewFilename) != fileInfo {
+		// The new name was taken in the meantime, so nothing was renamed
+		*reply = shared.FileChangeResponse{Exists: true}
+		return nil
+	}
+
+	if s.chunkStore != nil {
+		switch change.Op {
+		case shared.DeleteChange:
+			err = s.chunkStore.Remove(fileInfo.Id, change.Filename)
+		case shared.RenameChange:
+			err = s.chunkStore.Rename(fileInfo.Id, change.Filename, change.NewFilename)
+		}
+		if err != nil {log.Printf("Error: cannot update stored chunks of [%s]: %s\n", change.Filename, err)}
+	}
+	if change.Op != shared.TruncateChange {
+		// Clients drop their handles on both names when told of the change
+		s.closeFileHandles(change.Filename)
+		if change.Op == shared.RenameChange {s.closeFileHandles(change.NewFilename)}
+		s.forgetCallbacks(change.Filename)
+	}
+	*reply = shared.FileChangeResponse{Success: true}
+	return nil
+}
+
+// announceFileChange tells every connected client other than clientId to apply a
+// change to its local copy of a file. Returns once they all acknowledged it or
+// were disconnected.
+func (s *Server) announceFileChange(change shared.FileChange, clientId int) {
+	var wg sync.WaitGroup
+	for _, otherId := range s.connectedClientIds() {
+		if otherId == clientId {continue}
+		client := s.clientConnection(otherId)
+		if client == nil {continue}
+
+		wg.Add(1)
+		go func(otherId int, client *rpc.Client) {
+			defer wg.Done()
+			var reply bool
+			call := client.Go("DiskService.ChangeFile", change, &reply, make(chan *rpc.Call, 1))
+			select {
+			case <-call.Done:
+				if call.Error == nil {return}
+				log.Printf("Error: client [%d] did not take change to [%s]: %s\n",
+					otherId, change.Filename, call.Error)
+			case <-time.After(CallbackTimeout):
+				log.Printf("Error: client [%d] did not take change to [%s] in time\n", otherId, change.Filename)
+			}
+			s.disconnectClient(otherId)
+		}(otherId, client)
+	}
+	wg.Wait()
+}
+
+// newFileId returns a random file ID other than shared.UnsetFileId.
+func newFileId() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		fileId := binary.LittleEndian.Uint64(b[:])
+		if fileId != shared.UnsetFileId {return fileId}
+	}
+}
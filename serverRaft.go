@@ -0,0 +1,671 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"./shared"
+)
+
+const (
+	RaftTickPeriod         = 20 * time.Millisecond
+	RaftHeartbeatPeriod    = 100 * time.Millisecond
+	// Election timeouts are picked at random between the minimum and twice the minimum
+	RaftElectionTimeoutMin = 500 * time.Millisecond
+	RaftRPCTimeout         = 500 * time.Millisecond
+	// A leader that a majority acknowledged within RaftLeaderLease still leads: the
+	// others cannot elect a new one before their election timeout, and the lease is
+	// counted from before the acknowledged heartbeat was sent
+	RaftLeaderLease        = RaftElectionTimeoutMin * 4 / 5
+	RaftCommitTimeout      = 3 * time.Second
+	RaftStateFileName      = "raft-state.json"
+	RaftLogFileName        = "raft.log"
+)
+
+// Contains the address of the cluster leader, or "" if there is none yet.
+type NotLeaderError string
+func (e NotLeaderError) Error() string {
+	return shared.NotLeaderErrorPrefix + string(e)
+}
+
+// Contains the log index of the entry that was not committed in time.
+type RaftTimeoutError int
+func (e RaftTimeoutError) Error() string {
+	return fmt.Sprintf("Raft: entry [%d] was not committed in time\n", int(e))
+}
+
+type RaftRole int
+
+const (
+	Follower RaftRole = iota
+	Candidate
+	Leader
+)
+
+// RaftEntry is a metadata mutation in the replicated log, tagged with the term
+// of the leader that created it.
+type RaftEntry struct {
+	Term  int
+	Entry LogEntry
+}
+
+type RequestVoteArgs struct {
+	Term          int
+	CandidateAddr string
+	LastLogIndex  int
+	LastLogTerm   int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderAddr   string
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []RaftEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+	// NextIndex is where the leader should resume sending from when Success is false
+	NextIndex int
+}
+
+// RaftNode keeps the server's metadata consistent across a cluster of servers.
+// Every mutation is appended to a replicated log by the leader, and applied on
+// each server once a majority of the cluster has stored it.
+//
+// Servers are identified by the address clients use to reach them, and Raft RPCs
+// are served on that same address.
+type RaftNode struct {
+	lock sync.Mutex
+	// cond is signalled whenever commitIndex or lastApplied advance, and on every tick
+	cond     *sync.Cond
+	selfAddr string
+	// peers lists the other members of the cluster
+	peers []string
+
+	role        RaftRole
+	currentTerm int
+	votedFor    string
+	// log[0] is a placeholder so that log indices start at 1
+	log         []RaftEntry
+	commitIndex int
+	lastApplied int
+	leaderAddr  string
+	// termStart is the index of the first entry the current leader appended
+	termStart int
+
+	// Leader only: next log index to send to each peer, and highest index known to be stored there
+	nextIndex  map[string]int
+	matchIndex map[string]int
+	inFlight   map[string]bool
+	// lastAck is when the latest heartbeat (or append) each peer answered was sent
+	lastAck    map[string]time.Time
+
+	lastHeard       time.Time
+	lastHeartbeat   time.Time
+	electionTimeout time.Duration
+
+	// storage persists the term, vote and log. Nil if the node keeps them in memory only.
+	storage *RaftStorage
+	apply   func(LogEntry)
+
+	peerClients map[string]*rpc.Client
+	clientsLock sync.Mutex
+}
+
+// NewRaftNode starts a member of the cluster made of selfAddr and peers (which may
+// also list selfAddr). Committed entries are passed to apply in log order. If dataDir
+// is set, the node's state is persisted there and restored on restart.
+func NewRaftNode(selfAddr string, peers []string, dataDir string, apply func(LogEntry)) (*RaftNode, error) {
+	self, err := net.ResolveTCPAddr("tcp", selfAddr)
+	if err != nil {return nil, err}
+	var others []string
+	for _, peer := range peers {
+		peerAddr, err := net.ResolveTCPAddr("tcp", peer)
+		if err != nil {return nil, err}
+		if peerAddr.String() != self.String() {others = append(others, peerAddr.String())}
+	}
+
+	r := &RaftNode{
+		selfAddr:    self.String(),
+		peers:       others,
+		log:         []RaftEntry{{}},
+		nextIndex:   make(map[string]int),
+		matchIndex:  make(map[string]int),
+		inFlight:    make(map[string]bool),
+		lastAck:     make(map[string]time.Time),
+		lastHeard:   time.Now(),
+		apply:       apply,
+		peerClients: make(map[string]*rpc.Client),
+	}
+	r.cond = sync.NewCond(&r.lock)
+	rand.Seed(time.Now().UnixNano())
+	r.resetElectionTimeout()
+
+	if dataDir != "" {
+		storage, state, entries, err := OpenRaftStorage(dataDir)
+		if err != nil {return nil, err}
+		r.storage = storage
+		r.currentTerm = state.CurrentTerm
+		r.votedFor = state.VotedFor
+		r.log = append(r.log, entries...)
+		log.Printf("Raft: restored term [%d] and %d log entries\n", r.currentTerm, len(entries))
+	}
+
+	go r.run()
+	go r.applyCommitted()
+	return r, nil
+}
+
+// IsLeader reports whether this node is the leader, and if not, the address of
+// the leader (or "" if it is not known).
+// A new leader only reports itself once it has applied every entry committed by
+// earlier leaders, so that callers never act on stale metadata. A leader cut off
+// from the rest of the cluster may have been replaced without knowing it, so it
+// only reports itself while a majority has acknowledged it within RaftLeaderLease;
+// otherwise it sends a round of heartbeats and waits for them.
+func (r *RaftNode) IsLeader() (bool, string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.role != Leader {return false, r.leaderAddr}
+	if r.lastApplied < r.termStart {return false, ""}
+
+	if !r.hasLeaderLease() {
+		term := r.currentTerm
+		deadline := time.Now().Add(RaftRPCTimeout)
+		go r.broadcastAppendEntries()
+		for !r.hasLeaderLease() {
+			if r.currentTerm != term || r.role != Leader {return false, r.leaderAddr}
+			if time.Now().After(deadline) {return false, ""}
+			r.cond.Wait()
+		}
+	}
+	return true, r.leaderAddr
+}
+
+// hasLeaderLease reports whether a majority of the cluster, this node included,
+// acknowledged it as leader within RaftLeaderLease.
+func (r *RaftNode) hasLeaderLease() bool {
+	acks := 1
+	for _, peer := range r.peers {
+		if time.Since(r.lastAck[peer]) < RaftLeaderLease {acks++}
+	}
+	return r.isMajority(acks)
+}
+
+// Replicate appends entry to the replicated log and waits until it has been
+// committed and applied. Only the leader accepts entries.
+func (r *RaftNode) Replicate(entry LogEntry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.role != Leader {return NotLeaderError(r.leaderAddr)}
+
+	term := r.currentTerm
+	index, err := r.appendEntry(entry)
+	if err != nil {return err}
+	go r.broadcastAppendEntries()
+
+	deadline := time.Now().Add(RaftCommitTimeout)
+	for r.lastApplied < index {
+		if r.currentTerm != term || r.role != Leader {
+			// The entry may still be committed by the next leader, but it is no longer ours to report on
+			return NotLeaderError(r.leaderAddr)
+		}
+		if time.Now().After(deadline) {return RaftTimeoutError(index)}
+		r.cond.Wait()
+	}
+	if r.log[index].Term != term {return NotLeaderError(r.leaderAddr)}
+	return nil
+}
+
+// appendEntry adds an entry from the current term to the leader's log. The entry
+// is not added if it cannot be persisted, since the leader counts itself among
+// the servers that store it.
+func (r *RaftNode) appendEntry(entry LogEntry) (int, error) {
+	raftEntry := RaftEntry{Term: r.currentTerm, Entry: entry}
+	err := r.persistEntries([]RaftEntry{raftEntry})
+	if err != nil {return 0, err}
+	r.log = append(r.log, raftEntry)
+	r.advanceCommitIndex()
+	return len(r.log) - 1, nil
+}
+
+// run drives elections and heartbeats.
+func (r *RaftNode) run() {
+	for {
+		time.Sleep(RaftTickPeriod)
+
+		r.lock.Lock()
+		if r.role == Leader {
+			if time.Since(r.lastHeartbeat) >= RaftHeartbeatPeriod {
+				r.lastHeartbeat = time.Now()
+				go r.broadcastAppendEntries()
+			}
+		} else if time.Since(r.lastHeard) >= r.electionTimeout {
+			r.startElection()
+		}
+		// Lets waiting callers notice timeouts and lost leadership
+		r.cond.Broadcast()
+		r.lock.Unlock()
+	}
+}
+
+// applyCommitted passes committed entries to apply, in log order.
+func (r *RaftNode) applyCommitted() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for {
+		for r.lastApplied >= r.commitIndex {
+			r.cond.Wait()
+		}
+		index := r.lastApplied + 1
+		entry := r.log[index].Entry
+
+		r.lock.Unlock()
+		r.apply(entry)
+		r.lock.Lock()
+
+		r.lastApplied = index
+		r.cond.Broadcast()
+	}
+}
+
+func (r *RaftNode) resetElectionTimeout() {
+	r.electionTimeout = RaftElectionTimeoutMin + time.Duration(rand.Int63n(int64(RaftElectionTimeoutMin)))
+}
+
+func (r *RaftNode) isMajority(votes int) bool {
+	return votes > (len(r.peers)+1)/2
+}
+
+func (r *RaftNode) lastLogTerm() int {
+	return r.log[len(r.log)-1].Term
+}
+
+func (r *RaftNode) startElection() {
+	r.role = Candidate
+	r.currentTerm++
+	r.votedFor = r.selfAddr
+	r.leaderAddr = ""
+	r.lastHeard = time.Now()
+	r.resetElectionTimeout()
+	if r.persistState() != nil {
+		// Without its vote stored, this node could vote again in the same term after a restart
+		r.role = Follower
+		return
+	}
+	log.Printf("Raft: starting election for term [%d]\n", r.currentTerm)
+
+	args := RequestVoteArgs{
+		Term:          r.currentTerm,
+		CandidateAddr: r.selfAddr,
+		LastLogIndex:  len(r.log) - 1,
+		LastLogTerm:   r.lastLogTerm(),
+	}
+	votes := 1
+	if r.isMajority(votes) {
+		r.becomeLeader()
+		return
+	}
+
+	for _, peer := range r.peers {
+		go func(peer string) {
+			var reply RequestVoteReply
+			if r.call(peer, "Raft.RequestVote", args, &reply) != nil {return}
+
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if reply.Term > r.currentTerm {
+				r.becomeFollower(reply.Term, "")
+				return
+			}
+			if r.role != Candidate || r.currentTerm != args.Term || !reply.VoteGranted {return}
+			votes++
+			if r.isMajority(votes) {r.becomeLeader()}
+		}(peer)
+	}
+}
+
+func (r *RaftNode) becomeLeader() {
+	log.Printf("Raft: elected leader for term [%d]\n", r.currentTerm)
+	r.role = Leader
+	r.leaderAddr = r.selfAddr
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = len(r.log)
+		r.matchIndex[peer] = 0
+		delete(r.lastAck, peer)
+	}
+	// Entries from earlier terms can only be committed along with one from the current term
+	index, err := r.appendEntry(LogEntry{Op: NoOp})
+	if err != nil {
+		// A leader that cannot store entries cannot commit any; let another server lead
+		log.Printf("Raft: stepping down in term [%d]\n", r.currentTerm)
+		r.role = Follower
+		r.leaderAddr = ""
+		r.lastHeard = time.Now()
+		return
+	}
+	r.termStart = index
+	r.lastHeartbeat = time.Now()
+	go r.broadcastAppendEntries()
+}
+
+// becomeFollower steps down to follow leaderAddr (if known) in term. It returns an
+// error if the new term could not be persisted, in which case the node must not
+// vote or accept entries in it.
+func (r *RaftNode) becomeFollower(term int, leaderAddr string) error {
+	var err error
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		err = r.persistState()
+	}
+	if r.role == Leader {log.Printf("Raft: stepping down in term [%d]\n", term)}
+	r.role = Follower
+	r.leaderAddr = leaderAddr
+	return err
+}
+
+func (r *RaftNode) broadcastAppendEntries() {
+	for _, peer := range r.peers {
+		go r.replicateTo(peer)
+	}
+}
+
+// replicateTo sends the peer the log entries it is missing, or an empty heartbeat.
+func (r *RaftNode) replicateTo(peer string) {
+	r.lock.Lock()
+	if r.role != Leader || r.inFlight[peer] {
+		r.lock.Unlock()
+		return
+	}
+	r.inFlight[peer] = true
+	next := r.nextIndex[peer]
+	args := AppendEntriesArgs{
+		Term:         r.currentTerm,
+		LeaderAddr:   r.selfAddr,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.log[next-1].Term,
+		Entries:      append([]RaftEntry(nil), r.log[next:]...),
+		LeaderCommit: r.commitIndex,
+	}
+	r.lock.Unlock()
+
+	var reply AppendEntriesReply
+	sentAt := time.Now()
+	err := r.call(peer, "Raft.AppendEntries", args, &reply)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.inFlight[peer] = false
+	if err != nil {return}
+
+	if reply.Term > r.currentTerm {
+		r.becomeFollower(reply.Term, "")
+		return
+	}
+	if r.role != Leader || r.currentTerm != args.Term {return}
+	// The peer follows this leader whether or not its log matched
+	if sentAt.After(r.lastAck[peer]) {r.lastAck[peer] = sentAt}
+	r.cond.Broadcast()
+
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > r.matchIndex[peer] {r.matchIndex[peer] = match}
+		r.nextIndex[peer] = r.matchIndex[peer] + 1
+		r.advanceCommitIndex()
+	} else {
+		r.nextIndex[peer] = reply.NextIndex
+		if r.nextIndex[peer] < 1 {r.nextIndex[peer] = 1}
+		if r.nextIndex[peer] > len(r.log) {r.nextIndex[peer] = len(r.log)}
+	}
+}
+
+// advanceCommitIndex commits the latest entry of the current term stored on a majority.
+func (r *RaftNode) advanceCommitIndex() {
+	if r.role != Leader {return}
+	for n := len(r.log) - 1; n > r.commitIndex && r.log[n].Term == r.currentTerm; n-- {
+		stored := 1
+		for _, peer := range r.peers {
+			if r.matchIndex[peer] >= n {stored++}
+		}
+		if r.isMajority(stored) {
+			r.commitIndex = n
+			r.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// RequestVote is an RPC target called by candidates during an election.
+func (r *RaftNode) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if args.Term > r.currentTerm {
+		err := r.becomeFollower(args.Term, "")
+		if err != nil {return err}
+	}
+	*reply = RequestVoteReply{Term: r.currentTerm}
+	if args.Term < r.currentTerm {return nil}
+
+	upToDate := args.LastLogTerm > r.lastLogTerm() ||
+		(args.LastLogTerm == r.lastLogTerm() && args.LastLogIndex >= len(r.log)-1)
+	if (r.votedFor == "" || r.votedFor == args.CandidateAddr) && upToDate {
+		// A vote only counts once it is stored
+		votedFor := r.votedFor
+		r.votedFor = args.CandidateAddr
+		if err := r.persistState(); err != nil {
+			r.votedFor = votedFor
+			return err
+		}
+		r.lastHeard = time.Now()
+		reply.VoteGranted = true
+	}
+	return nil
+}
+
+// AppendEntries is an RPC target called by the leader to replicate its log, and as a heartbeat.
+func (r *RaftNode) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	*reply = AppendEntriesReply{Term: r.currentTerm}
+	if args.Term < r.currentTerm {return nil}
+
+	err := r.becomeFollower(args.Term, args.LeaderAddr)
+	if err != nil {return err}
+	r.lastHeard = time.Now()
+	reply.Term = r.currentTerm
+
+	if args.PrevLogIndex >= len(r.log) {
+		reply.NextIndex = len(r.log)
+		return nil
+	}
+	if r.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+		// Skip back over the whole conflicting term instead of one entry per round trip
+		conflictTerm := r.log[args.PrevLogIndex].Term
+		index := args.PrevLogIndex
+		for index > 1 && r.log[index-1].Term == conflictTerm {
+			index--
+		}
+		reply.NextIndex = index
+		return nil
+	}
+
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		if index < len(r.log) {
+			if r.log[index].Term == entry.Term {continue}
+			// Conflicting entries were never committed; replace them with the leader's
+			err = r.persistLog(r.log[:index])
+			if err != nil {return err}
+			r.log = r.log[:index]
+		}
+		// The leader counts the entries as stored here once this reply succeeds
+		err = r.persistEntries(args.Entries[i:])
+		if err != nil {return err}
+		r.log = append(r.log, args.Entries[i:]...)
+		break
+	}
+
+	lastNewIndex := args.PrevLogIndex + len(args.Entries)
+	if args.LeaderCommit > r.commitIndex {
+		r.commitIndex = args.LeaderCommit
+		if lastNewIndex < r.commitIndex {r.commitIndex = lastNewIndex}
+		r.cond.Broadcast()
+	}
+	reply.Success = true
+	return nil
+}
+
+func (r *RaftNode) persistState() error {
+	if r.storage == nil {return nil}
+	err := r.storage.SaveState(RaftPersistentState{CurrentTerm: r.currentTerm, VotedFor: r.votedFor})
+	if err != nil {log.Printf("Error: Raft: cannot persist state: %s\n", err)}
+	return err
+}
+
+// persistLog replaces the stored log with entries, which start with the placeholder.
+func (r *RaftNode) persistLog(entries []RaftEntry) error {
+	if r.storage == nil {return nil}
+	err := r.storage.Rewrite(entries[1:])
+	if err != nil {log.Printf("Error: Raft: cannot persist log: %s\n", err)}
+	return err
+}
+
+// persistEntries stores entries after the end of the log. If that fails, the stored
+// log is rewritten so that no partly written entry is left behind it.
+func (r *RaftNode) persistEntries(entries []RaftEntry) error {
+	if r.storage == nil {return nil}
+	err := r.storage.Append(entries)
+	if err != nil {
+		log.Printf("Error: Raft: cannot persist log: %s\n", err)
+		r.persistLog(r.log)
+	}
+	return err
+}
+
+// call makes an RPC to a peer, giving up after RaftRPCTimeout.
+func (r *RaftNode) call(peer string, method string, args interface{}, reply interface{}) error {
+	r.clientsLock.Lock()
+	client, exists := r.peerClients[peer]
+	if !exists {
+		conn, err := net.DialTimeout("tcp", peer, RaftRPCTimeout)
+		if err != nil {
+			r.clientsLock.Unlock()
+			return err
+		}
+		client = rpc.NewClient(conn)
+		r.peerClients[peer] = client
+	}
+	r.clientsLock.Unlock()
+
+	var err error
+	select {
+	case call := <-client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		err = call.Error
+		if _, isServerError := err.(rpc.ServerError); err == nil || isServerError {return err}
+	case <-time.After(RaftRPCTimeout):
+		err = fmt.Errorf("Raft: %s to [%s] timed out", method, peer)
+	}
+
+	// The connection is broken or stuck; redial on the next call
+	r.clientsLock.Lock()
+	if r.peerClients[peer] == client {delete(r.peerClients, peer)}
+	r.clientsLock.Unlock()
+	client.Close()
+	return err
+}
+
+type RaftPersistentState struct {
+	CurrentTerm int
+	VotedFor    string
+}
+
+// RaftStorage persists a RaftNode's term, vote and log in a data directory.
+// The log is a file of RaftEntry records, one JSON object per line.
+type RaftStorage struct {
+	statePath string
+	logFile   *os.File
+}
+
+// OpenRaftStorage opens (or creates) the Raft state in dataDir and returns what is already stored.
+func OpenRaftStorage(dataDir string) (*RaftStorage, RaftPersistentState, []RaftEntry, error) {
+	var state RaftPersistentState
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {return nil, state, nil, err}
+
+	statePath := filepath.Join(dataDir, RaftStateFileName)
+	data, err := ioutil.ReadFile(statePath)
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		log.Printf("Error: cannot read Raft state [%s]\n", statePath)
+		return nil, state, nil, err
+	}
+
+	var entries []RaftEntry
+	logPath := filepath.Join(dataDir, RaftLogFileName)
+	logFile, err := openRecordFile(logPath, func(line []byte) error {
+		var entry RaftEntry
+		err := json.Unmarshal(line, &entry)
+		if err == nil {entries = append(entries, entry)}
+		return err
+	})
+	if err != nil {
+		log.Printf("Error: cannot open Raft log [%s]\n", logPath)
+		return nil, state, nil, err
+	}
+
+	return &RaftStorage{statePath: statePath, logFile: logFile}, state, entries, nil
+}
+
+// SaveState atomically replaces the stored term and vote.
+func (st *RaftStorage) SaveState(state RaftPersistentState) error {
+	file, err := rewriteRecordFile(st.statePath, []interface{}{state})
+	if err != nil {return err}
+	return file.Close()
+}
+
+// Append durably adds entries to the end of the stored log.
+func (st *RaftStorage) Append(entries []RaftEntry) error {
+	records := make([]interface{}, len(entries))
+	for i := range entries {
+		records[i] = entries[i]
+	}
+	return appendRecords(st.logFile, records...)
+}
+
+// Rewrite atomically replaces the stored log with entries.
+func (st *RaftStorage) Rewrite(entries []RaftEntry) error {
+	records := make([]interface{}, len(entries))
+	for i := range entries {
+		records[i] = entries[i]
+	}
+	file, err := rewriteRecordFile(st.logFile.Name(), records)
+	if err != nil {return err}
+	st.logFile.Close()
+	st.logFile = file
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"time"
+	"./shared"
+)
+
+// Reconcile is an RPC target. It replays chunks a client wrote while disconnected
+// (or without a lock, in DWRITE mode). A chunk is written only if its current
+// version is still the one the client's write was based on; every other chunk is
+// returned as a conflict, along with its current version for the client to merge.
+func (s *Server) Reconcile(args *shared.ReconcileRequest, reply *shared.ReconcileResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	log.Printf("Reconcile: client [%d], file [%s], [%d] chunks\n", args.ClientId, args.Filename, len(args.Chunks))
+
+	if !s.doesFileExist(args.Filename) {
+		layout := args.Layout
+		if !layout.IsValid() {layout = shared.DefaultLayout}
+		err := s.createNewFile(args.Filename, layout)
+		if err != nil {return err}
+	}
+	fileInfo := s.getFile(args.Filename)
+	if fileInfo == nil {
+		// Deleted or renamed in the meantime; the client replays again later
+		*reply = shared.ReconcileResponse{IsLocked: true}
+		return nil
+	}
+
+	written, conflicts, refused, isLocked, err := s.reconcileChunks(fileInfo, args)
+	if err != nil {return err}
+	if isLocked {
+		*reply = shared.ReconcileResponse{IsLocked: true}
+		return nil
+	}
+	s.acknowledgeWrites(args.Filename, args.ClientId, written)
+
+	// The current versions are fetched once the file is no longer held up
+	for i := range conflicts {
+		if conflicts[i].Current.Version == shared.NoVersion {continue}
+		current, err := s.getChunkByVersion(args.Filename, conflicts[i].ChunkNum, conflicts[i].Current.Version)
+		if err != nil {
+			conflicts[i].IsUnavailable = true
+			continue
+		}
+		conflicts[i].Current = current
+	}
+
+	for i := range written {
+		written[i].Data = nil
+	}
+	*reply = shared.ReconcileResponse{Written: written, Conflicts: conflicts, Refused: refused, FileId: fileInfo.Id}
+	return nil
+}
+
+// reconcileChunks commits the next version of each replayed chunk whose current
+// version is its base version. The chunks whose version moved on are returned as
+// conflicts holding the current version, without its data, and the chunks that do
+// not fit the file's layout are refused. Nothing is written, and isLocked is
+// returned, if another client holds a valid lock on any of the chunks.
+func (s *Server) reconcileChunks(fileInfo *FileInfo, args *shared.ReconcileRequest) (written []shared.Chunk,
+	conflicts []shared.ChunkConflict, refused []uint64, isLocked bool, err error) {
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+	// A file deleted or renamed in the meantime is replayed again later
+	if s.getFile(args.Filename) != fileInfo {return nil, nil, nil, true, nil}
+
+	for _, replayed := range args.Chunks {
+		chunkNum := replayed.ChunkData.ChunkNum
+		_, isLocked = fileInfo.overlappingLocks(args.ClientId, shared.ChunkRange{First: chunkNum, Last: chunkNum})
+		if isLocked {return nil, nil, nil, true, nil}
+	}
+
+	for _, replayed := range args.Chunks {
+		chunk := replayed.ChunkData
+		// Replaying it again would fail the same way, so the client drops it
+		if e := checkChunks(fileInfo, []shared.Chunk{chunk}); e != nil {
+			log.Printf("Error: client [%d] replayed file [%s] chunk [%d]: %s", args.ClientId, args.Filename, chunk.ChunkNum, e)
+			refused = append(refused, chunk.ChunkNum)
+			continue
+		}
+		currentVersion, exists := fileInfo.currentVersion(chunk.ChunkNum)
+		if !exists {currentVersion = shared.NoVersion}
+		if currentVersion != replayed.BaseVersion {
+			log.Printf("Conflict: client [%d] wrote file [%s] chunk [%d] over ver [%d], server ver is [%d]\n",
+				args.ClientId, args.Filename, chunk.ChunkNum, replayed.BaseVersion, currentVersion)
+			conflicts = append(conflicts, shared.ChunkConflict{
+				ChunkNum:    chunk.ChunkNum,
+				BaseVersion: replayed.BaseVersion,
+				Current:     shared.Chunk{ChunkNum: chunk.ChunkNum, Version: currentVersion},
+			})
+			continue
+		}
+
+		// As in a direct write, a chunk never written to starts at the file's first version
+		chunk.Version = fileInfo.firstVersion()
+		if exists {chunk.Version = currentVersion + 1}
+		if s.chunkStore != nil {
+			err = s.chunkStore.Put(fileInfo.Id, args.Filename, chunk)
+			if err != nil {return nil, nil, nil, false, err}
+		}
+		err = s.commit(LogEntry{
+			Op: WriteChunkOp, Filename: args.Filename, ChunkNum: chunk.ChunkNum, Version: chunk.Version, ClientId: args.ClientId,
+			Timestamp: time.Now().UTC(),
+		})
+		if err != nil {return nil, nil, nil, false, err}
+		written = append(written, chunk)
+	}
+	return written, conflicts, refused, false, nil
+}
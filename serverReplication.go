@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/rpc"
+	"time"
+	"./shared"
+)
+
+const RepairPeriod = 2
+const DefaultRepairRate = 16
+// How long a client has to store a chunk pushed to it
+const StoreChunkTimeout = 2 * time.Second
+
+// replicateChunk copies a chunk version to other connected clients until it has
+// s.replicas online owners, and records each client that stored it as an owner.
+// Copying stops if a newer version is written in the meantime. Returns the number
+// of online owners of the version.
+func (s *Server) replicateChunk(filename string, chunk shared.Chunk) int {
+	fileInfo := s.getFile(filename)
+	if fileInfo == nil {return 0}
+	owners := s.countOnlineOwners(fileInfo.chunkOwners(chunk.ChunkNum, chunk.Version))
+
+	for _, clientId := range s.connectedClientIds() {
+		if owners >= s.replicas {break}
+		if isOwner(fileInfo.chunkOwners(chunk.ChunkNum, chunk.Version), clientId) {continue}
+
+		err := s.pushChunk(clientId, filename, fileInfo.Id, chunk)
+		if err != nil {continue}
+
+		isCurrent, err := s.addCurrentChunkOwner(fileInfo, filename, chunk, clientId)
+		if err != nil {return owners}
+		if !isCurrent {
+			log.Printf("File [%s] chunk [%d] moved on from ver [%d]; stopped replicating it\n",
+				filename, chunk.ChunkNum, chunk.Version)
+			return owners
+		}
+		owners++
+	}
+
+	if owners < s.replicas {
+		log.Printf("File [%s] chunk [%d] ver [%d] has %d of %d replicas\n",
+			filename, chunk.ChunkNum, chunk.Version, owners, s.replicas)
+	}
+	return owners
+}
+
+// addCurrentChunkOwner records that clientId stored a chunk version, unless it is no
+// longer the current version, or fileInfo was deleted or renamed while it was
+// pushed. The client does not store a version older than the one it holds, so its
+// copy of a newer version is never overwritten; it must only not be taken for an
+// owner of a version that moved on while it was pushed.
+func (s *Server) addCurrentChunkOwner(fileInfo *FileInfo, filename string, chunk shared.Chunk,
+	clientId int) (isCurrent bool, err error) {
+	fileInfo.updateLock.Lock()
+	defer fileInfo.updateLock.Unlock()
+	if s.getFile(filename) != fileInfo {return false, nil}
+	ver, exists := fileInfo.currentVersion(chunk.ChunkNum)
+	if !exists || ver != chunk.Version {return false, nil}
+	return true, s.addChunkOwner(filename, chunk.ChunkNum, chunk.Version, clientId)
+}
+
+func (s *Server) countOnlineOwners(owners []int) int {
+	online := 0
+	for _, owner := range owners {
+		if s.isClientConnected(owner) {online++}
+	}
+	return online
+}
+
+// Periodically copies the current version of under-replicated chunks to more
+// clients, so files stay available as owners go offline.
+func (s *Server) repairChunks() {
+	for {
+		time.Sleep(RepairPeriod * time.Second)
+		s.repairPass()
+	}
+}
+
+// repairPass scans every chunk once. A chunk is under-replicated when its current
+// version has fewer than s.replicas online owners. At most s.repairRate chunk copies
+// are made per pass; the remaining chunks are picked up by later passes.
+func (s *Server) repairPass() {
+	s.repairLock.Lock()
+	status := shared.RepairStatus{TotalCopies: s.repairStatus.TotalCopies}
+	s.repairLock.Unlock()
+	connected := len(s.connectedClientIds())
+
+	for _, filename := range s.fileNames() {
+		fileInfo := s.getFile(filename)
+		if fileInfo == nil {continue}
+		for chunkNum, ver := range fileInfo.currentVersions() {
+			online := s.countOnlineOwners(fileInfo.chunkOwners(chunkNum, ver))
+			if online >= s.replicas {continue}
+
+			status.UnderReplicated++
+			// Every connected client already holds it, so there is nowhere to copy it to
+			if online >= connected || status.Copies >= s.repairRate {continue}
+
+			chunk, err := s.getChunkByVersion(filename, chunkNum, ver)
+			if err != nil {
+				status.Unrecoverable++
+				continue
+			}
+
+			copies := s.replicateChunk(filename, chunk) - online
+			status.Copies += copies
+			if online + copies >= s.replicas {status.UnderReplicated--}
+		}
+	}
+
+	status.TotalCopies += status.Copies
+	status.LastPass = time.Now().UTC()
+	s.repairLock.Lock()
+	s.repairStatus = status
+	s.repairLock.Unlock()
+	if status.UnderReplicated > 0 || status.Copies > 0 {
+		log.Printf("Repair: %d copies made, %d chunks under-replicated, %d with no reachable copy\n",
+			status.Copies, status.UnderReplicated, status.Unrecoverable)
+	}
+}
+
+// GetRepairStatus is an RPC target that reports the progress of re-replication as of the last pass.
+func (s *Server) GetRepairStatus(req *shared.RepairStatusRequest, reply *shared.RepairStatus) error {
+	if err := s.checkLeader(); err != nil {return err}
+	s.repairLock.Lock()
+	defer s.repairLock.Unlock()
+	*reply = s.repairStatus
+	return nil
+}
+
+// pushChunk asks a connected client to store a chunk version on its local disk.
+// Writes wait on the push, so a client that does not answer in time is disconnected.
+func (s *Server) pushChunk(clientId int, filename string, fileId uint64, chunk shared.Chunk) error {
+	req := shared.StoreChunkRequest{Filename: filename, FileId: fileId, ChunkData: chunk}
+	var resp shared.StoreChunkResponse
+	client := s.clientConnection(clientId)
+	if client == nil {return ClientOfflineError(clientId)}
+	var err error
+	select {
+	case call := <-client.Go("DiskService.StoreChunk", req, &resp, make(chan *rpc.Call, 1)).Done:
+		err = call.Error
+	case <-time.After(StoreChunkTimeout):
+		err = fmt.Errorf("DiskService.StoreChunk timed out")
+		s.disconnectClient(clientId)
+	}
+	if err == nil && !resp.Success {err = ChunkRefusedError(chunk.Version)}
+	if err != nil {
+		log.Printf("Error: client [%d] did not store file [%s] chunk [%d] ver [%d]: %s\n",
+			clientId, filename, chunk.ChunkNum, chunk.Version, err)
+		return err
+	}
+	log.Printf("Replicated file [%s] chunk [%d] ver [%d] to client [%d]\n",
+		filename, chunk.ChunkNum, chunk.Version, clientId)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"./shared"
+)
+
+// File status
+//
+// Clients can ask about a file without opening it, to tell whether an open is
+// likely to succeed: whether its chunks can be reached and who holds its lock.
+// They can also list the files the server knows about, a page at a time.
+
+// Stat is an RPC target. It replies with what the server knows of a file.
+func (s *Server) Stat(req *shared.StatRequest, reply *shared.StatResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	log.Printf("Stat: [%s]\n", req.Filename)
+
+	fileInfo := s.getFile(req.Filename)
+	if fileInfo == nil {
+		*reply = shared.StatResponse{Exists: false}
+		return nil
+	}
+	*reply = shared.StatResponse{Exists: true, Stat: s.fileStat(req.Filename, fileInfo)}
+	return nil
+}
+
+// ListFiles is an RPC target. It replies with a page of the files whose names
+// pass the request's filters, in name order.
+func (s *Server) ListFiles(req *shared.ListFilesRequest, reply *shared.ListFilesResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	log.Printf("ListFiles: prefix [%s], pattern [%s], after [%s]\n", req.Prefix, req.Pattern, req.After)
+
+	if _, err := path.Match(req.Pattern, ""); err != nil {
+		*reply = shared.ListFilesResponse{BadPattern: true}
+		return nil
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > shared.MaxListFilesPage {limit = shared.MaxListFilesPage}
+
+	filenames := s.fileNames()
+	sort.Strings(filenames)
+
+	var files []shared.FileStat
+	for _, filename := range filenames {
+		if filename <= req.After || !strings.HasPrefix(filename, req.Prefix) {continue}
+		if req.Pattern != "" {
+			if matched, _ := path.Match(req.Pattern, filename); !matched {continue}
+		}
+		fileInfo := s.getFile(filename)
+		if fileInfo == nil {continue}
+		if len(files) == limit {
+			// There is at least one more file to list
+			*reply = shared.ListFilesResponse{Files: files, Next: files[len(files)-1].Filename}
+			return nil
+		}
+		files = append(files, s.fileStat(filename, fileInfo))
+	}
+	*reply = shared.ListFilesResponse{Files: files}
+	return nil
+}
+
+// fileStat describes a file. A written chunk counts as available if a connected
+// client owns its current version, or the chunk store holds it.
+func (s *Server) fileStat(filename string, fileInfo *FileInfo) shared.FileStat {
+	stat := shared.FileStat{
+		Filename:      filename,
+		Layout:        fileInfo.layout(),
+		ChunkVersions: fileInfo.currentVersions(),
+		Locks:         s.fileLocks(filename, fileInfo),
+	}
+	stat.LastWriter, stat.LastModified = fileInfo.lastWrite()
+
+	for chunkNum, ver := range stat.ChunkVersions {
+		if s.countOnlineOwners(fileInfo.chunkOwners(chunkNum, ver)) > 0 {
+			stat.AvailableChunks++
+		} else if s.chunkStore != nil && s.chunkStore.Has(fileInfo.Id, filename, chunkNum, ver) {
+			stat.AvailableChunks++
+		}
+	}
+	return stat
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/rpc"
+	"sort"
+	"time"
+	"./shared"
+)
+
+// Locking
+//
+// net/rpc serves every call on its own goroutine, so the server's metadata is
+// shared between concurrent RPCs, the background monitors and (in a Raft cluster)
+// the goroutine applying committed entries.
+//
+//   - clientsLock guards ConnectedClients, DisconnectedClients and NextClientId.
+//   - filesLock guards the Files map itself and Tombstones; each FileInfo guards its own fields.
+//   - FileInfo.updateLock is held by RPCs that read a file's metadata and then
+//     commit a change based on it, so that two clients cannot both take a file's
+//     lock or write the same chunk version. Only RPCs on the same file wait on it.
+//   - commitLock keeps the metadata log in the same order as the mutations applied.
+//   - handlesLock guards handles and nextHandleId.
+//   - waitLock guards waitQueues and nextTicketId.
+//   - auditLock guards auditLog.
+//   - callbacksLock guards callbacks.
+//
+// updateLock may be held across a commit; every other lock is only held briefly and
+// never while committing or making an RPC. apply takes the locks it needs itself.
+
+// getFile returns the metadata of a file, or nil if the file has never been created.
+func (s *Server) getFile(filename string) *FileInfo {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+	return s.Files[filename]
+}
+
+// isTombstoned reports whether a file named filename was deleted or renamed.
+func (s *Server) isTombstoned(filename string) bool {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+	return s.Tombstones[filename]
+}
+
+// fileNameById returns the name of the file with ID fileId, and false if there is none.
+func (s *Server) fileNameById(fileId uint64) (string, bool) {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+	for filename, fileInfo := range s.Files {
+		if fileInfo.Id == fileId {return filename, true}
+	}
+	return "", false
+}
+
+// fileNames returns the name of every file the server knows about.
+func (s *Server) fileNames() []string {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+	filenames := make([]string, 0, len(s.Files))
+	for filename := range s.Files {
+		filenames = append(filenames, filename)
+	}
+	return filenames
+}
+
+// holdsLock reports whether clientId holds a write lock on part of the file, even under a lapsed lease.
+func (fi *FileInfo) holdsLock(clientId int) bool {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	_, exists := fi.Locks[clientId]
+	return exists
+}
+
+// lockToken returns the fencing token of the latest lease on the file.
+func (fi *FileInfo) lockToken() int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.LockToken
+}
+
+// currentVersion returns the current version of a chunk, and false if it has never been written to.
+func (fi *FileInfo) currentVersion(chunkNum uint64) (int, bool) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	chunkInfo, exists := fi.ChunkInfo[chunkNum]
+	if !exists {return shared.NoVersion, false}
+	return chunkInfo.CurrentVersion, true
+}
+
+// currentVersions maps every chunk that has been written to its current version.
+func (fi *FileInfo) currentVersions() map[uint64]int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	versions := make(map[uint64]int, len(fi.ChunkInfo))
+	for chunkNum, chunkInfo := range fi.ChunkInfo {
+		versions[chunkNum] = chunkInfo.CurrentVersion
+	}
+	return versions
+}
+
+// firstVersion returns the version of chunks written for the first time.
+func (fi *FileInfo) firstVersion() int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.FirstVersion
+}
+
+// chunkVersions returns every version of a chunk the file has a record of, newest first.
+func (fi *FileInfo) chunkVersions(chunkNum uint64) []int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	chunkInfo, exists := fi.ChunkInfo[chunkNum]
+	if !exists {return nil}
+	var versions []int
+	for ver := range chunkInfo.ChunkOwners {
+		versions = append(versions, ver)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	return versions
+}
+
+// layout returns the file's layout.
+func (fi *FileInfo) layout() shared.FileLayout {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.Layout
+}
+
+// lastWrite returns the client that last wrote to the file, and when.
+func (fi *FileInfo) lastWrite() (int, time.Time) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.LastWriter, fi.LastModified
+}
+
+// chunkOwners returns a copy of the owners of a chunk version.
+func (fi *FileInfo) chunkOwners(chunkNum uint64, ver int) []int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	chunkInfo, exists := fi.ChunkInfo[chunkNum]
+	if !exists {return nil}
+	return append([]int(nil), chunkInfo.ChunkOwners[ver]...)
+}
+
+// hasVersion reports whether version ver of a chunk was committed.
+func (fi *FileInfo) hasVersion(chunkNum uint64, ver int) bool {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	chunkInfo, exists := fi.ChunkInfo[chunkNum]
+	if !exists {return false}
+	_, isCommitted := chunkInfo.ChunkOwners[ver]
+	return isCommitted
+}
+
+// allocateClientId hands out a client ID that no other client has or will be given.
+func (s *Server) allocateClientId() int {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	clientId := s.NextClientId
+	s.NextClientId++
+	return clientId
+}
+
+// reserveClientId makes sure clientId is never handed out to a new client.
+// Returns true if the server did not know about clientId yet.
+func (s *Server) reserveClientId(clientId int) bool {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	if clientId < s.NextClientId {return false}
+	s.NextClientId = clientId + 1
+	return true
+}
+
+// clientAddress returns the address a client registered with, connected or not.
+func (s *Server) clientAddress(clientId int) string {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+	info, exists := s.ConnectedClients[clientId]
+	if !exists {info, exists = s.DisconnectedClients[clientId]}
+	if !exists {return ""}
+	return info.ClientAddress
+}
+
+// clientConnection returns the RPC connection to a connected client, or nil.
+func (s *Server) clientConnection(clientId int) *rpc.Client {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+	info, exists := s.ConnectedClients[clientId]
+	if !exists {return nil}
+	return info.RPCConnection
+}
+
+// connectedClientIds returns the IDs of all connected clients.
+func (s *Server) connectedClientIds() []int {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+	clientIds := make([]int, 0, len(s.ConnectedClients))
+	for clientId := range s.ConnectedClients {
+		clientIds = append(clientIds, clientId)
+	}
+	return clientIds
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"time"
+	"./shared"
+)
+
+// Ticket IDs start after shared.UnsetTicketId
+const FirstTicketId = 1
+
+// WaitQueue holds the clients waiting for a write lock on a file, in the order they
+// asked for it. A range of chunks is only locked once nobody ahead in the queue is
+// waiting for any of them, so clients waiting for disjoint ranges do not block each other.
+type WaitQueue struct {
+	tickets []*WaitTicket
+	// changed is closed (and replaced) whenever the queue moves or the lock is released
+	changed chan struct{}
+}
+
+// WaitTicket is a client's place in a WaitQueue.
+type WaitTicket struct {
+	TicketId int
+	ClientId int
+	Chunks   shared.ChunkRange
+	// Since is when the client started waiting
+	Since    time.Time
+}
+
+// Wait queues are kept in memory only. Tickets are not carried over to a server
+// that takes over, so a client waiting when its server fails is told it was
+// disconnected and has to queue again.
+
+// EnqueueWrite is an RPC target. It puts the client at the back of the file's
+// wait queue and returns its ticket and position (1 is the head of the queue).
+func (s *Server) EnqueueWrite(req *shared.EnqueueWriteRequest, reply *shared.WaitPosition) error {
+	if err := s.checkLeader(); err != nil {return err}
+	if !req.Chunks.IsValid() {return ChunkRangeError(req.Chunks)}
+	if !s.isClientConnected(req.ClientId) {
+		*reply = shared.WaitPosition{TicketId: shared.UnsetTicketId}
+		return nil
+	}
+
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	queue := s.waitQueue(req.Filename)
+	ticket := &WaitTicket{TicketId: s.nextTicketId, ClientId: req.ClientId, Chunks: req.Chunks, Since: time.Now().UTC()}
+	s.nextTicketId++
+	queue.tickets = append(queue.tickets, ticket)
+	log.Printf("Client [%d] waiting for [%s.dfs] with ticket [%d] at position [%d]\n",
+		req.ClientId, req.Filename, ticket.TicketId, len(queue.tickets))
+	*reply = shared.WaitPosition{TicketId: ticket.TicketId, Position: len(queue.tickets)}
+	return nil
+}
+
+// AwaitWriteLock is an RPC target. It blocks until nobody ahead of the ticket in
+// the queue waits for its chunks and they are not locked, then opens the file for
+// writing like OpenFile. It gives up if the ticket is cancelled or the timeout elapses.
+func (s *Server) AwaitWriteLock(req *shared.AwaitWriteLockRequest, reply *shared.OpenFileResponse) error {
+	if err := s.checkLeader(); err != nil {return err}
+	fileInfo := s.getFile(req.Filename)
+	if fileInfo == nil {
+		s.leaveQueue(req.Filename, req.TicketId)
+		*reply = shared.OpenFileResponse{Success: false, WaitCancelled: true}
+		return nil
+	}
+
+	var timeout <-chan time.Time
+	if req.Timeout > 0 {
+		timer := time.NewTimer(req.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		ticket, position, changed := s.findTicket(req.Filename, req.TicketId)
+		if position == 0 {
+			// Cancelled, or the client was disconnected
+			*reply = shared.OpenFileResponse{Success: false, WaitCancelled: true}
+			return nil
+		}
+		token, acquired, err := s.acquireFileLock(fileInfo, req.Filename, req.ClientId, ticket.Chunks, req.TicketId)
+		if err != nil {
+			s.leaveQueue(req.Filename, req.TicketId)
+			return err
+		}
+		if acquired {
+			s.leaveQueue(req.Filename, req.TicketId)
+			log.Printf("Client [%d] took [%s.dfs] from the wait queue\n", req.ClientId, req.Filename)
+			openReq := shared.OpenFileRequest{
+				ClientId: req.ClientId, Filename: req.Filename, Mode: shared.WRITE, Chunks: ticket.Chunks,
+			}
+			return s.openFileContents(&openReq, fileInfo, shared.Lease{Token: token, Duration: LeaseDuration}, reply)
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			s.leaveQueue(req.Filename, req.TicketId)
+			*reply = shared.OpenFileResponse{Success: false, WaitTimedOut: true}
+			return nil
+		}
+	}
+}
+
+// CancelWait is an RPC target. It removes a ticket from its queue; the client's
+// AwaitWriteLock call then returns. Replies false if the ticket was not queued.
+func (s *Server) CancelWait(req *shared.WaitTicketRequest, reply *bool) error {
+	if err := s.checkLeader(); err != nil {return err}
+	*reply = s.leaveQueue(req.Filename, req.TicketId)
+	if *reply {
+		log.Printf("Client [%d] cancelled ticket [%d] on [%s.dfs]\n", req.ClientId, req.TicketId, req.Filename)
+	}
+	return nil
+}
+
+// GetWaitPosition is an RPC target. It replies with the ticket's position in its
+// queue (1 is the head), or 0 if it is no longer queued.
+func (s *Server) GetWaitPosition(req *shared.WaitTicketRequest, reply *shared.WaitPosition) error {
+	if err := s.checkLeader(); err != nil {return err}
+	_, position, _ := s.findTicket(req.Filename, req.TicketId)
+	*reply = shared.WaitPosition{TicketId: req.TicketId, Position: position}
+	return nil
+}
+
+// isFirstInQueue reports whether clientId may lock chunks of the file without
+// jumping the queue: no other client is waiting for any of them ahead of ticketId
+// (anywhere in the queue if ticketId is shared.UnsetTicketId).
+func (s *Server) isFirstInQueue(filename string, clientId int, chunks shared.ChunkRange, ticketId int) bool {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	queue, exists := s.waitQueues[filename]
+	if !exists {return true}
+	for _, ticket := range queue.tickets {
+		if ticket.TicketId == ticketId {break}
+		if ticket.ClientId != clientId && ticket.Chunks.Overlaps(chunks) {return false}
+	}
+	return true
+}
+
+// firstWaiting returns a copy of the first ticket of another client than clientId
+// waiting for any of chunks, and false if there is none.
+func (s *Server) firstWaiting(filename string, clientId int, chunks shared.ChunkRange) (WaitTicket, bool) {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	queue, exists := s.waitQueues[filename]
+	if !exists {return WaitTicket{}, false}
+	for _, ticket := range queue.tickets {
+		if ticket.ClientId != clientId && ticket.Chunks.Overlaps(chunks) {return *ticket, true}
+	}
+	return WaitTicket{}, false
+}
+
+// findTicket returns a copy of the ticket and its position in the file's queue (0
+// if it is not queued), and a channel that is closed the next time it may be
+// able to lock its chunks.
+func (s *Server) findTicket(filename string, ticketId int) (WaitTicket, int, <-chan struct{}) {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	queue, exists := s.waitQueues[filename]
+	if !exists {return WaitTicket{}, 0, nil}
+	for i, ticket := range queue.tickets {
+		if ticket.TicketId == ticketId {return *ticket, i + 1, queue.changed}
+	}
+	return WaitTicket{}, 0, queue.changed
+}
+
+// leaveQueue removes a ticket from the file's queue. Returns false if it was not queued.
+func (s *Server) leaveQueue(filename string, ticketId int) bool {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	queue, exists := s.waitQueues[filename]
+	if !exists {return false}
+	for i, ticket := range queue.tickets {
+		if ticket.TicketId != ticketId {continue}
+		queue.tickets = append(queue.tickets[:i], queue.tickets[i+1:]...)
+		s.notifyQueueLocked(filename, queue)
+		return true
+	}
+	return false
+}
+
+// leaveAllQueues removes every ticket held by clientId, e.g. once it disconnects.
+func (s *Server) leaveAllQueues(clientId int) {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	for filename, queue := range s.waitQueues {
+		kept := queue.tickets[:0]
+		for _, ticket := range queue.tickets {
+			if ticket.ClientId != clientId {kept = append(kept, ticket)}
+		}
+		if len(kept) == len(queue.tickets) {continue}
+		queue.tickets = kept
+		s.notifyQueueLocked(filename, queue)
+	}
+}
+
+// notifyWaiters wakes the clients waiting for a lock on the file, e.g. once one is released.
+func (s *Server) notifyWaiters(filename string) {
+	s.waitLock.Lock()
+	defer s.waitLock.Unlock()
+	queue, exists := s.waitQueues[filename]
+	if exists {s.notifyQueueLocked(filename, queue)}
+}
+
+// waitQueue returns the file's queue, creating it if needed. Must be called with waitLock held.
+func (s *Server) waitQueue(filename string) *WaitQueue {
+	queue, exists := s.waitQueues[filename]
+	if !exists {
+		queue = &WaitQueue{changed: make(chan struct{})}
+		s.waitQueues[filename] = queue
+	}
+	return queue
+}
+
+// notifyQueueLocked wakes the queue's waiters, and forgets the queue once nobody
+// is waiting. Must be called with waitLock held.
+func (s *Server) notifyQueueLocked(filename string, queue *WaitQueue) {
+	close(queue.changed)
+	queue.changed = make(chan struct{})
+	if len(queue.tickets) == 0 {delete(s.waitQueues, filename)}
+}
@@ -1,21 +1,62 @@
 package shared
 
 import (
+	"math"
 	"time"
 )
 
 const UnsetClientId = -1
+// UnsetHandleId is the handle ID of a file opened without the server (in DREAD mode).
+const UnsetHandleId = 0
+// NoVersion is the version of a chunk that has never been written to.
+const NoVersion = -1
+// UnsetFileId is the ID of a file whose ID is unknown. Other IDs are random, so
+// that a name that is deleted and created again never refers to the same ID.
+const UnsetFileId = 0
 const FileExtension = ".dfs"
+// Servers in a Raft cluster that are not the leader refuse client calls with an
+// error made of this prefix followed by the leader's address (if known).
+const NotLeaderErrorPrefix = "DFS server is not the leader; leader is "
+// Files opened without being created with CreateFile have ChunksPerFile chunks
+// of BytesPerChunk bytes (DefaultLayout).
 const ChunksPerFile = 256
 const BytesPerChunk = 32
+const MaxChunkSize = 1 << 20
+// MaxFileSize is the largest size of a file in bytes. It bounds the chunk numbers
+// of a file (see FileLayout.MaxChunks), so that every offset in it fits in an int64.
+const MaxFileSize = 1 << 40
 
 type FileMode int
 
 type Chunk struct {
-	ChunkNum uint8
+	ChunkNum uint64
 	Version int
-	Data [32]byte
+	// Data holds the whole chunk; it is nil (all zeros) in a chunk that has never been written to
+	Data []byte
 }
+
+// FileLayout is the size of a file's chunks and how many of them it holds. A
+// file grows whenever a chunk past its end is written.
+type FileLayout struct {
+	ChunkSize int
+	NumChunks uint64
+}
+
+var DefaultLayout = FileLayout{ChunkSize: BytesPerChunk, NumChunks: ChunksPerFile}
+
+// IsValid reports whether chunks of the layout's size can be written, and the
+// file is no larger than MaxFileSize.
+func (l FileLayout) IsValid() bool {
+	return l.ChunkSize > 0 && l.ChunkSize <= MaxChunkSize && l.NumChunks <= l.MaxChunks()
+}
+
+// MaxChunks returns the largest number of chunks a file with the layout's chunk
+// size holds; chunk numbers from MaxChunks on cannot be read or written.
+func (l FileLayout) MaxChunks() uint64 {
+	if l.ChunkSize <= 0 {return 0}
+	return MaxFileSize / uint64(l.ChunkSize)
+}
+
 const (
 	// Read mode.
 	READ FileMode = iota
@@ -31,10 +72,150 @@ type FileExistsRequest struct {
 	Filename string
 }
 
+type CreateFileRequest struct {
+	Filename string
+	Layout FileLayout
+}
+
+type CreateFileResponse struct {
+	// Created is false if the file already existed; Layout is then its layout
+	Created bool
+	Layout FileLayout
+	FileId uint64
+}
+
+// FileChangeOp is a change to a file as a whole.
+type FileChangeOp int
+
+const (
+	DeleteChange FileChangeOp = iota
+	RenameChange
+	TruncateChange
+)
+
+// A FileChange tells a client how to change its local copy of a file.
+type FileChange struct {
+	Op FileChangeOp
+	Filename string
+	// NewFilename is the new name of the file, with RenameChange
+	NewFilename string
+	// NumChunks is the new number of chunks in the file, with TruncateChange
+	NumChunks uint64
+}
+
+type DeleteFileRequest struct {
+	ClientId int
+	Filename string
+}
+
+type RenameFileRequest struct {
+	ClientId int
+	Filename string
+	NewFilename string
+}
+
+type TruncateFileRequest struct {
+	ClientId int
+	Filename string
+	NumChunks uint64
+}
+
+type FileChangeResponse struct {
+	Success bool
+	// NotFound is set if the file does not exist
+	NotFound bool
+	// Exists is set if a file already has the new name of a renamed file
+	Exists bool
+	// ConflictError is set if another client holds or awaits a lock on an affected
+	// chunk; Conflict then describes it
+	ConflictError bool
+	Conflict LockInfo
+	// TooLarge is set if a truncated file would be larger than MaxFileSize
+	TooLarge bool
+}
+
+type StatRequest struct {
+	Filename string
+}
+
+type StatResponse struct {
+	// Exists is false if the server has never heard of the file
+	Exists bool
+	Stat FileStat
+}
+
+// MaxListFilesPage is the most files the server lists in one reply.
+const MaxListFilesPage = 500
+
+type ListFilesRequest struct {
+	// Prefix keeps only the files whose names start with it
+	Prefix string
+	// Pattern, if set, keeps only the files whose names match it (see path.Match)
+	Pattern string
+	// After is the name of the last file of the previous page, "" for the first page
+	After string
+	// Limit is the most files to list; MaxListFilesPage if 0 or more than that
+	Limit int
+}
+
+type ListFilesResponse struct {
+	// Files are in name order
+	Files []FileStat
+	// Next is the After of the next page, "" if this is the last page
+	Next string
+	// BadPattern is set if Pattern is malformed; nothing is listed then
+	BadPattern bool
+}
+
+// FileStat describes a file as the server knows it.
+type FileStat struct {
+	Filename string
+	Layout FileLayout
+	// ChunkVersions maps every chunk that has been written to its current version
+	ChunkVersions map[uint64]int
+	// LastWriter is the client that last wrote to the file, UnsetClientId if unknown
+	LastWriter int
+	// LastModified is when the file was last written to; zero if unknown
+	LastModified time.Time
+	// Locks holds the write locks on the file, by client ID
+	Locks []LockInfo
+	// AvailableChunks is how many written chunks have an online owner of their current
+	// version, or have it in the server's chunk store
+	AvailableChunks int
+}
+
 type ClientRegistrationRequest struct {
 	ClientId int
 	ClientAddress string
 	LatestHeartbeat time.Time
+	// Inventory lists the files the client holds locally
+	Inventory []FileInventory
+}
+
+type ClientRegistrationResponse struct {
+	ClientId int
+	// Conflicts lists chunks the client holds at a version the server never committed;
+	// the client drops its record of those versions
+	Conflicts []InventoryConflict
+	// Changes lists the deletes, renames and truncates of the client's files it
+	// missed while offline, to apply to its local copies
+	Changes []FileChange
+}
+
+type FileInventory struct {
+	Filename string
+	// FileId is the ID of the file the local copy was taken from
+	FileId uint64
+	// ChunkVersions maps chunk # to the version held locally
+	ChunkVersions map[uint64]int
+	Layout FileLayout
+}
+
+type InventoryConflict struct {
+	Filename string
+	ChunkNum uint64
+	LocalVersion int
+	ServerVersion int
 }
 
 type ClientHeartbeat struct {
@@ -46,19 +227,154 @@ type OpenFileRequest struct {
 	ClientId int
 	Filename string
 	Mode FileMode
+	// Chunks is the range of chunks to lock in WRITE mode (WholeFile for all of them)
+	Chunks ChunkRange
+}
+
+// ChunkRange is the chunks of a file from First to Last, inclusive.
+type ChunkRange struct {
+	First uint64
+	Last uint64
+}
+
+// WholeFile is the range of every chunk in a file, however much it grows.
+var WholeFile = ChunkRange{First: 0, Last: math.MaxUint64}
+
+// IsValid reports whether the range holds at least one chunk.
+func (r ChunkRange) IsValid() bool {
+	return r.First <= r.Last
+}
+
+func (r ChunkRange) Contains(chunkNum uint64) bool {
+	return r.First <= chunkNum && chunkNum <= r.Last
+}
+
+func (r ChunkRange) Overlaps(other ChunkRange) bool {
+	return r.First <= other.Last && other.First <= r.Last
+}
+
+// Includes reports whether every chunk of other is in the range.
+func (r ChunkRange) Includes(other ChunkRange) bool {
+	return r.First <= other.First && other.Last <= r.Last
 }
 
 type OpenFileResponse struct {
 	Chunks []Chunk
+	Layout FileLayout
+	FileId uint64
 	Success bool
 	ConflictError bool
 	UnavailableError bool
+	// HandleId identifies the opened file in CloseFile
+	HandleId int
+	// Lease is the lease on the file's write lock, in WRITE mode
+	Lease Lease
+	// WaitCancelled and WaitTimedOut explain why AwaitWriteLock gave up
+	WaitCancelled bool
+	WaitTimedOut bool
+	// Conflict describes the lock that kept the file from being opened, with ConflictError
+	Conflict LockInfo
+}
+
+// LockInfo describes a client's write lock on a file.
+type LockInfo struct {
+	Filename string
+	ClientId int
+	ClientAddress string
+	Ranges []ChunkRange
+	// Since is when the client acquired the lock
+	Since time.Time
+	Token int
+	// IsWaiting is set in a conflict if the client does not hold the chunks yet,
+	// but is waiting for them ahead of the caller
+	IsWaiting bool
+}
+
+type ListLocksRequest struct {
+	// Filename restricts the list to one file; every file if empty
+	Filename string
+}
+
+type ListLocksResponse struct {
+	Locks []LockInfo
+}
+
+type ForceUnlockRequest struct {
+	Filename string
+	// ClientId is the client whose lock is released; UnsetClientId releases every lock on the file
+	ClientId int
+	// Operator and Reason are recorded in the audit log
+	Operator string
+	Reason string
+}
+
+type ForceUnlockResponse struct {
+	// Released lists the locks that were released
+	Released []LockInfo
+}
+
+// AuditRecord records a lock released by an administrator.
+type AuditRecord struct {
+	Timestamp time.Time
+	Operator string
+	Reason string
+	Filename string
+	ClientId int
+	Token int
+}
+
+type AuditLogRequest struct {
+}
+
+type AuditLogResponse struct {
+	Records []AuditRecord
+}
+
+// Lease is a time-bounded hold on a file's write lock. It is renewed by every
+// heartbeat the server receives from the holder.
+type Lease struct {
+	// Token increases every time the lock changes hands; writes must carry the current one
+	Token int
+	// Duration is how long the lease lasts after it was granted or last renewed
+	Duration time.Duration
+}
+
+// Ticket IDs are handed out by the server from 1
+const UnsetTicketId = 0
+
+type EnqueueWriteRequest struct {
+	ClientId int
+	Filename string
+	// Chunks is the range of chunks to wait for
+	Chunks ChunkRange
+}
+
+type AwaitWriteLockRequest struct {
+	ClientId int
+	Filename string
+	TicketId int
+	// Timeout is how long to wait for the lock; zero waits until cancelled
+	Timeout time.Duration
+}
+
+type WaitTicketRequest struct {
+	ClientId int
+	Filename string
+	TicketId int
+}
+
+// WaitPosition is a ticket's place in a file's wait queue. Position 1 is the head
+// of the queue, and 0 means the ticket is no longer queued.
+type WaitPosition struct {
+	TicketId int
+	Position int
 }
 
 type CloseFileRequest struct {
 	ClientId int
 	Filename string
 	Mode FileMode
+	HandleId int
 }
 
 type CloseFileResponse struct {
@@ -68,29 +384,116 @@ type CloseFileResponse struct {
 type GetLatestChunkRequest struct {
 	ClientId int
 	Filename string
-	ChunkNum uint8
+	ChunkNum uint64
 	Mode FileMode
+	// LocalVersion is the version of the chunk the client holds locally, NoVersion if unknown
+	LocalVersion int
 }
 
 type GetLatestChunkResponse struct {
 	ChunkData Chunk
 	Success bool
+	// NotModified is set, and ChunkData holds no data, if the client's local version is current
+	NotModified bool
 }
 
 type WriteChunkRequest struct {
 	ClientId int
 	Filename string
-	ChunkNum uint8
+	ChunkNum uint64
 	ChunkData Chunk
+	LeaseToken int
 }
 
 type WriteChunkResponse struct {
 	Success bool
+	Version int
+}
+
+type WriteChunksRequest struct {
+	ClientId int
+	Filename string
+	Chunks []Chunk
+	LeaseToken int
+}
+
+type WriteChunksResponse struct {
+	Success bool
+	// Versions holds the version written for each chunk, in the order they were sent
+	Versions []int
+}
+
+// JournalChunk is a chunk written while disconnected, along with the version it
+// was based on (NoVersion if the chunk had never been written to).
+type JournalChunk struct {
+	ChunkData Chunk
+	BaseVersion int
+}
+
+type ReconcileRequest struct {
+	ClientId int
+	Filename string
+	Chunks []JournalChunk
+	// Layout is the file's local layout, used if the server does not know the file
+	Layout FileLayout
+}
+
+// ChunkConflict is a chunk whose current version moved on from the version a
+// disconnected write was based on.
+type ChunkConflict struct {
+	ChunkNum uint64
+	BaseVersion int
+	// Current holds the current version, unless IsUnavailable (all its owners are offline)
+	Current Chunk
+	IsUnavailable bool
+}
+
+type ReconcileResponse struct {
+	// IsLocked is set, and nothing is written, if another client holds a lock on one of the chunks
+	IsLocked bool
+	// Written holds the version each written chunk was given, without its data
+	Written []Chunk
+	Conflicts []ChunkConflict
+	// Refused holds the chunks that do not fit the file's layout, which are never written
+	Refused []uint64
+	FileId uint64
 }
 
 type FetchChunkRequest struct {
 	Filename string
-	ChunkNum uint8
+	ChunkNum uint64
+	ChunkSize int
+}
+
+type InvalidateChunkRequest struct {
+	Filename string
+	ChunkNum uint64
+	// Version is the chunk's new current version
+	Version int
+}
+
+type StoreChunkRequest struct {
+	Filename string
+	FileId uint64
+	ChunkData Chunk
+}
+
+type StoreChunkResponse struct {
+	Success bool
+}
+
+type RepairStatusRequest struct {
+}
+
+type RepairStatus struct {
+	// Chunks whose current version has fewer online owners than the replication target
+	UnderReplicated int
+	// Under-replicated chunks with no reachable copy of their current version
+	Unrecoverable int
+	// Chunk copies made in the last repair pass, and since the server started
+	Copies int
+	TotalCopies int
+	LastPass time.Time
 }
 
 type FetchChunkResponse struct {
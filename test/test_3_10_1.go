@@ -0,0 +1,141 @@
+// Disconnected writes with conflicts
+// Client A writes chunks 0-2 of a file in DWRITE mode while offline. Client B writes
+// chunks 0 and 2 in the meantime. When A reconnects, its write to chunk 1 is replayed,
+// and the other two are only settled once A sets a resolver: chunk 0 is merged, and
+// B's chunk 2 is kept.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const FileName3101 = "3101"
+// An address no server listens on, to mount while disconnected
+const OfflineAddr3101 = "127.0.0.1:1"
+
+func Test_3_10_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.10.1]")
+	fmt.Println("Disconnected - One DWRITE client and one writer client")
+	fmt.Println("Client A writes offline while B writes the same chunks, then A reconnects and resolves the conflicts")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA3101_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB3101_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_10_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_10_1\n\n")
+	CleanDir("clientA3101")
+	CleanDir("clientB3101")
+	itwg.Done()
+}
+
+func clients_3_10_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	loggerA := NewLogger("(3.10.1) Client A (DW)")
+	loggerB := NewLogger("(3.10.1) Client B (W)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	testCase := fmt.Sprintf("Writing chunks 0-2 of '%s'", FileName3101)
+	err = write_3_10_1(dfsA, dfslib.WRITE, map[uint8]string{0: "base 0", 1: "base 1", 2: "base 2"})
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+	// B keeps a copy of every chunk while A is away
+	testCase = fmt.Sprintf("Reading chunks 0-2 of '%s'", FileName3101)
+	err = check_3_10_1(dfsB, map[uint8]string{0: "base 0", 1: "base 1", 2: "base 2"})
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+	err = dfsA.UMountDFS()
+	if err != nil {return err}
+
+	offline, err := dfslib.MountDFS(OfflineAddr3101, localIP, localPathA)
+	if err != nil {return err}
+	testCase = fmt.Sprintf("Opening file '%s' for writing fails while disconnected", FileName3101)
+	_, err = offline.Open(FileName3101, dfslib.WRITE)
+	_, isDisconnected := err.(dfslib.DisconnectedError)
+	loggerA.TestResult(testCase, isDisconnected)
+	if !isDisconnected {return fmt.Errorf("expected DisconnectedError, got %v", err)}
+
+	testCase = fmt.Sprintf("Writing chunks 0-2 of '%s' in DWRITE mode", FileName3101)
+	err = write_3_10_1(offline, dfslib.DWRITE, map[uint8]string{0: "mine 0", 1: "mine 1", 2: "mine 2"})
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+	offline.UMountDFS()
+
+	testCase = fmt.Sprintf("Writing chunks 0 and 2 of '%s'", FileName3101)
+	err = write_3_10_1(dfsB, dfslib.WRITE, map[uint8]string{0: "their 0", 2: "their 2"})
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	dfsA, err = dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	testCase = "Reading the replayed chunk 1 and unresolved chunks 0 and 2"
+	err = check_3_10_1(dfsB, map[uint8]string{0: "their 0", 1: "mine 1", 2: "their 2"})
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	var conflicts []uint64
+	err = dfsA.SetConflictResolver(func(conflict dfslib.WriteConflict) (resolution dfslib.Resolution, merged []byte) {
+		conflicts = append(conflicts, conflict.ChunkNum)
+		if conflict.ChunkNum == 0 {
+			return dfslib.Merge, []byte("merged 0")
+		}
+		return dfslib.KeepTheirs, nil
+	})
+	if err == nil && len(conflicts) != 2 {err = fmt.Errorf("resolved conflicts on chunks %v, expected 0 and 2", conflicts)}
+	loggerA.TestResult("Resolving conflicts on chunks 0 and 2", err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading the merged chunk 0 and B's chunk 2"
+	err = check_3_10_1(dfsB, map[uint8]string{0: "merged 0", 1: "mine 1", 2: "their 2"})
+	loggerB.TestResult(testCase, err == nil)
+	return err
+}
+
+// write_3_10_1 opens the file in mode and writes chunks to it.
+func write_3_10_1(dfs dfslib.DFS, mode dfslib.FileMode, chunks map[uint8]string) error {
+	file, err := dfs.Open(FileName3101, mode)
+	if err != nil {return err}
+	for chunkNum, content := range chunks {
+		var blob dfslib.Chunk
+		copy(blob[:], content)
+		err = file.Write(chunkNum, &blob)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// check_3_10_1 reads the file and checks that it holds chunks.
+func check_3_10_1(dfs dfslib.DFS, chunks map[uint8]string) error {
+	file, err := dfs.Open(FileName3101, dfslib.READ)
+	if err != nil {return err}
+	defer file.Close()
+	for chunkNum, content := range chunks {
+		var got, expected dfslib.Chunk
+		copy(expected[:], content)
+		err = file.Read(chunkNum, &got)
+		if err != nil {return err}
+		if got != expected {
+			return fmt.Errorf("read back %q from chunk %d, expected %q", string(got[:]), chunkNum, content)
+		}
+	}
+	return nil
+}
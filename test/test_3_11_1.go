@@ -0,0 +1,110 @@
+// Local chunk metadata
+// Client A writes chunk 1 of file F. F's .ver file records the version A wrote and when
+// it was synced, and the sync time moves on when A reads the chunk from the server
+// again. No temporary file is left behind.
+
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"fmt"
+	"os"
+	"path/filepath"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const FileName3111 = "3111"
+// Long enough for the next sync time to differ from the first
+const SyncWait3111 = 1100 * time.Millisecond
+
+// chunkMetadata_3_11_1 is what a .ver file records about a chunk.
+type chunkMetadata_3_11_1 struct {
+	Version  int
+	SyncedAt time.Time
+}
+
+func Test_3_11_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.11.1]")
+	fmt.Println("Versions - One writer client")
+	fmt.Println("Client A writes F, and F's .ver file records the chunk's version and its sync times")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA3111_")
+
+	if errA != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clientA_3_11_1(serverAddr, LocalIP, clientALocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_11_1\n\n")
+	CleanDir("clientA3111")
+	itwg.Done()
+}
+
+func clientA_3_11_1(serverAddr, localIP, localPath string) (err error) {
+	var blob dfslib.Chunk
+	logger := NewLogger("(3.11.1) Client A (W)")
+	copy(blob[:], "This is test 3.11.1!")
+
+	dfs, err := dfslib.MountDFS(serverAddr, localIP, localPath)
+	if err != nil {return err}
+	defer dfs.UMountDFS()
+
+	start := time.Now()
+	file, err := dfs.Open(FileName3111, dfslib.WRITE)
+	if err != nil {return err}
+	err = file.Write(1, &blob)
+	if err == nil {err = file.Close()}
+	if err != nil {return err}
+
+	testCase := "Recording the written version of chunk 1"
+	written, err := metadata_3_11_1(localPath, 1)
+	if err == nil && written.SyncedAt.Before(start) {
+		err = fmt.Errorf("chunk 1 was synced at %v, before the write started", written.SyncedAt)
+	}
+	logger.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	time.Sleep(SyncWait3111)
+	testCase = "Recording a later sync time after reading chunk 1 from the server"
+	file, err = dfs.Open(FileName3111, dfslib.READ)
+	if err != nil {return err}
+	err = file.Read(1, &blob)
+	file.Close()
+	var read chunkMetadata_3_11_1
+	if err == nil {read, err = metadata_3_11_1(localPath, 1)}
+	if err == nil && (read.Version != written.Version || !read.SyncedAt.After(written.SyncedAt)) {
+		err = fmt.Errorf("chunk 1 is recorded at version %d synced at %v, after version %d synced at %v",
+			read.Version, read.SyncedAt, written.Version, written.SyncedAt)
+	}
+	logger.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "No temporary version file is left behind"
+	_, err = os.Stat(filepath.Join(localPath, FileName3111+dfslib.VersionFileExtension+".tmp"))
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err == nil {
+		err = fmt.Errorf("a temporary version file was left behind")
+	}
+	logger.TestResult(testCase, err == nil)
+	return err
+}
+
+// metadata_3_11_1 returns what the .ver file of FileName3111 in localPath records about chunk chunkNum.
+func metadata_3_11_1(localPath string, chunkNum uint8) (chunkMetadata_3_11_1, error) {
+	data, err := ioutil.ReadFile(filepath.Join(localPath, FileName3111+dfslib.VersionFileExtension))
+	if err != nil {return chunkMetadata_3_11_1{}, err}
+	var metadata map[uint8]chunkMetadata_3_11_1
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {return chunkMetadata_3_11_1{}, err}
+	meta, exists := metadata[chunkNum]
+	if !exists {return meta, fmt.Errorf("no version is recorded for chunk %d", chunkNum)}
+	return meta, nil
+}
@@ -0,0 +1,145 @@
+// Chunk freshness
+// Client A writes chunk 0 of file F and keeps F open. Client B reads it in READ and
+// DREAD modes and gets it Fresh. A writes chunk 0 again: B's cached copy is then
+// KnownStale, also once B is disconnected, and B's chunk written offline in DWRITE mode
+// is PossiblyStale until it is replayed.
+
+package test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const FileName3121 = "3121"
+// An address no server listens on, to mount while disconnected
+const OfflineAddr3121 = "127.0.0.1:1"
+// A chunk of F nobody writes
+const UnwrittenChunk3121 = 5
+
+func Test_3_12_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.12.1]")
+	fmt.Println("Freshness - One writer client and one reader client")
+	fmt.Println("Client A writes F twice, and B reads the status of its copy connected and disconnected")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA3121_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB3121_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_12_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_12_1\n\n")
+	CleanDir("clientA3121")
+	CleanDir("clientB3121")
+	itwg.Done()
+}
+
+func clients_3_12_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(3.12.1) Client A (W)")
+	loggerB := NewLogger("(3.12.1) Client B (R)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+
+	fileA, err := dfsA.Open(FileName3121, dfslib.WRITE)
+	if err != nil {return err}
+	defer fileA.Close()
+	testCase := fmt.Sprintf("Writing the first version of chunk 0 of '%s'", FileName3121)
+	copy(blob[:], "first")
+	err = fileA.Write(0, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading chunk 0 Fresh in READ mode"
+	fileB, err := dfsB.Open(FileName3121, dfslib.READ)
+	if err != nil {return err}
+	status, err := status_3_12_1(fileB, 0, "first", dfslib.Fresh)
+	fileB.Close()
+	if err == nil && (status.LocalVersion != status.LatestVersion || status.SyncedAt.IsZero()) {
+		err = fmt.Errorf("read version %d of %d synced at %v, expected the latest version synced", status.LocalVersion, status.LatestVersion, status.SyncedAt)
+	}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading the cached chunk 0 Fresh in DREAD mode"
+	fileB, err = dfsB.Open(FileName3121, dfslib.DREAD)
+	if err != nil {return err}
+	_, err = status_3_12_1(fileB, 0, "first", dfslib.Fresh)
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Writing the second version of chunk 0 of '%s'", FileName3121)
+	copy(blob[:], "second")
+	err = fileA.Write(0, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading the first version of chunk 0 KnownStale in DREAD mode"
+	status, err = status_3_12_1(fileB, 0, "first", dfslib.KnownStale)
+	if err == nil && status.LatestVersion <= status.LocalVersion {
+		err = fmt.Errorf("read version %d with latest version %d, expected a newer latest version", status.LocalVersion, status.LatestVersion)
+	}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Reading unwritten chunk %d PossiblyStale in DREAD mode", UnwrittenChunk3121)
+	status, err = status_3_12_1(fileB, UnwrittenChunk3121, "", dfslib.PossiblyStale)
+	if err == nil && status.LocalVersion != dfslib.NoVersion {
+		err = fmt.Errorf("read version %d, expected NoVersion", status.LocalVersion)
+	}
+	loggerB.TestResult(testCase, err == nil)
+	fileB.Close()
+	if err != nil {return err}
+	err = dfsB.UMountDFS()
+	if err != nil {return err}
+
+	offline, err := dfslib.MountDFS(OfflineAddr3121, localIP, localPathB)
+	if err != nil {return err}
+	defer offline.UMountDFS()
+	testCase = "Reading chunk 0 KnownStale while disconnected"
+	fileB, err = offline.Open(FileName3121, dfslib.DREAD)
+	if err != nil {return err}
+	_, err = status_3_12_1(fileB, 0, "first", dfslib.KnownStale)
+	fileB.Close()
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading chunk 0 written in DWRITE mode PossiblyStale"
+	fileB, err = offline.Open(FileName3121, dfslib.DWRITE)
+	if err != nil {return err}
+	defer fileB.Close()
+	copy(blob[:], "offline")
+	err = fileB.Write(0, &blob)
+	if err == nil {_, err = status_3_12_1(fileB, 0, "offline", dfslib.PossiblyStale)}
+	loggerB.TestResult(testCase, err == nil)
+	return err
+}
+
+// status_3_12_1 reads chunk chunkNum of file and checks that it holds content and is as fresh as expected.
+func status_3_12_1(file dfslib.DFSFile, chunkNum uint64, content string, expected dfslib.Freshness) (dfslib.ChunkStatus, error) {
+	got := make([]byte, file.ChunkSize())
+	blob := make([]byte, file.ChunkSize())
+	copy(blob, content)
+	status, err := file.ReadWithStatus(chunkNum, got)
+	if err != nil {return status, err}
+	if !bytes.Equal(got, blob) {
+		return status, fmt.Errorf("read back %q from chunk %d, expected %q", string(got[:]), chunkNum, content)
+	}
+	if status.Freshness != expected {
+		return status, fmt.Errorf("chunk %d has freshness %d, expected %d", chunkNum, status.Freshness, expected)
+	}
+	return status, nil
+}
@@ -0,0 +1,134 @@
+// Byte streams
+// Client A writes file F through a FileStream: text at an offset that is not on a chunk
+// boundary and spans chunks, and JSON further on. Client B reads both back through its
+// own FileStream and reads to the end of F, and A's write past the end of F grows it.
+
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"../shared"
+	"sync"
+)
+
+const FileName3131 = "3131"
+const (
+	// Not on a chunk boundary, and the text spans several chunks
+	TextOffset3131 = 5
+	Text3131       = "This is test 3.13.1, written across chunk boundaries!"
+	JSONOffset3131 = 100
+	JSONValue3131  = 3131
+	// Number of bytes in a file created by Open
+	FileSize3131   = shared.ChunksPerFile * shared.BytesPerChunk
+)
+
+func Test_3_13_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.13.1]")
+	fmt.Println("Streams - One writer client and one reader client")
+	fmt.Println("Client A writes text and JSON to F through a FileStream, and B reads them back through its own")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA3131_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB3131_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_13_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_13_1\n\n")
+	CleanDir("clientA3131")
+	CleanDir("clientB3131")
+	itwg.Done()
+}
+
+func clients_3_13_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	loggerA := NewLogger("(3.13.1) Client A (W)")
+	loggerB := NewLogger("(3.13.1) Client B (R)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	fileA, err := dfsA.Open(FileName3131, dfslib.WRITE)
+	if err != nil {return err}
+	defer fileA.Close()
+	streamA := dfslib.NewFileStream(fileA)
+
+	testCase := fmt.Sprintf("Writing %d bytes at offset %d", len(Text3131), TextOffset3131)
+	_, err = streamA.Seek(TextOffset3131, io.SeekStart)
+	var n int
+	if err == nil {n, err = streamA.Write([]byte(Text3131))}
+	if err == nil && n != len(Text3131) {err = fmt.Errorf("wrote %d bytes, expected %d", n, len(Text3131))}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Encoding JSON at offset %d", JSONOffset3131)
+	_, err = streamA.Seek(JSONOffset3131, io.SeekStart)
+	if err == nil {err = json.NewEncoder(streamA).Encode(JSONValue3131)}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	fileB, err := dfsB.Open(FileName3131, dfslib.READ)
+	if err != nil {return err}
+	defer fileB.Close()
+	streamB := dfslib.NewFileStream(fileB)
+
+	testCase = fmt.Sprintf("Reading the text back at offset %d", TextOffset3131)
+	text := make([]byte, len(Text3131))
+	_, err = streamB.ReadAt(text, TextOffset3131)
+	if err == nil && string(text) != Text3131 {err = fmt.Errorf("read back %q, expected %q", string(text), Text3131)}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Decoding JSON back at offset %d", JSONOffset3131)
+	var value int
+	err = json.NewDecoder(io.NewSectionReader(streamB, JSONOffset3131, FileSize3131 - JSONOffset3131)).Decode(&value)
+	if err == nil && value != JSONValue3131 {err = fmt.Errorf("decoded %d, expected %d", value, JSONValue3131)}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading the last 3 bytes, then the end of the file"
+	var pos int64
+	pos, err = streamB.Seek(-3, io.SeekEnd)
+	if err == nil && pos != FileSize3131 - 3 {err = fmt.Errorf("seeked to %d, expected %d", pos, FileSize3131 - 3)}
+	if err == nil {n, err = streamB.Read(text)}
+	if err == nil && n != 3 {err = fmt.Errorf("read %d bytes, expected 3", n)}
+	if err == io.EOF {err = nil}
+	if err == nil {
+		n, err = streamB.Read(text)
+		if err == io.EOF && n == 0 {
+			err = nil
+		} else {
+			err = fmt.Errorf("read %d bytes with error %v, expected io.EOF", n, err)
+		}
+	}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Writing past the end of the file grows it"
+	_, err = streamA.WriteAt([]byte(Text3131), FileSize3131 - 1)
+	if err == nil {pos, err = streamA.Seek(0, io.SeekEnd)}
+	if err == nil && pos <= FileSize3131 {err = fmt.Errorf("the file is %d bytes long, expected more than %d", pos, FileSize3131)}
+	if err == nil {_, err = streamA.ReadAt(text, FileSize3131 - 1)}
+	if err == nil && string(text) != Text3131 {err = fmt.Errorf("read back %q, expected %q", string(text), Text3131)}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Seeking before the start of the file fails"
+	_, err = streamA.Seek(-1, io.SeekStart)
+	_, isOutOfRange := err.(dfslib.OffsetOutOfRangeError)
+	loggerA.TestResult(testCase, isOutOfRange)
+	if !isOutOfRange {return fmt.Errorf("expected OffsetOutOfRangeError, got %v", err)}
+	return nil
+}
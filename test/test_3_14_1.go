@@ -0,0 +1,125 @@
+// File layouts
+// Client A creates file F with 100-byte chunks and writes a chunk past the 256th. Client
+// B reads it back with F's chunk size, and chunks never written read as zeros. Reads
+// with 32-byte chunks, chunks past the largest file size and creating F again with
+// another chunk size all fail.
+
+package test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"../shared"
+	"sync"
+)
+
+const FileName3141 = "3141"
+const (
+	ChunkSize3141 = 100
+	NumChunks3141 = 4
+	// Past the 256 chunks of a file created by Open
+	FarChunk3141  = 300
+)
+
+func Test_3_14_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.14.1]")
+	fmt.Println("Layouts - One writer client and one reader client")
+	fmt.Println("Client A creates F with 100-byte chunks and writes past chunk 256, and B reads it back")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA3141_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB3141_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_14_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_14_1\n\n")
+	CleanDir("clientA3141")
+	CleanDir("clientB3141")
+	itwg.Done()
+}
+
+func clients_3_14_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	loggerA := NewLogger("(3.14.1) Client A (W)")
+	loggerB := NewLogger("(3.14.1) Client B (R)")
+	content := "This is test 3.14.1, in a chunk of 100 bytes!"
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	testCase := fmt.Sprintf("Creating file '%s' with %d chunks of %d bytes", FileName3141, NumChunks3141, ChunkSize3141)
+	err = dfsA.CreateFile(FileName3141, ChunkSize3141, NumChunks3141)
+	// Creating it again with the same layout does nothing
+	if err == nil {err = dfsA.CreateFile(FileName3141, ChunkSize3141, NumChunks3141)}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Creating file '%s' again with %d-byte chunks fails", FileName3141, shared.BytesPerChunk)
+	err = dfsB.CreateFile(FileName3141, shared.BytesPerChunk, NumChunks3141)
+	_, isExists := err.(dfslib.FileExistsError)
+	loggerB.TestResult(testCase, isExists)
+	if !isExists {return fmt.Errorf("expected FileExistsError, got %v", err)}
+
+	testCase = "Creating a file with 0-byte chunks fails"
+	err = dfsA.CreateFile("3141empty", 0, NumChunks3141)
+	_, isBadSize := err.(dfslib.BadChunkSizeError)
+	loggerA.TestResult(testCase, isBadSize)
+	if !isBadSize {return fmt.Errorf("expected BadChunkSizeError, got %v", err)}
+
+	fileA, err := dfsA.Open(FileName3141, dfslib.WRITE)
+	if err != nil {return err}
+	defer fileA.Close()
+	testCase = fmt.Sprintf("Writing chunk %d of '%s'", FarChunk3141, FileName3141)
+	blob := make([]byte, ChunkSize3141)
+	copy(blob, content)
+	err = fileA.WriteChunk(FarChunk3141, blob)
+	if err == nil && fileA.NumChunks() != FarChunk3141 + 1 {
+		err = fmt.Errorf("the file has %d chunks, expected %d", fileA.NumChunks(), FarChunk3141 + 1)
+	}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Writing a chunk past the largest file size fails"
+	err = fileA.WriteChunk(shared.MaxFileSize / ChunkSize3141 + 1, blob)
+	_, isBadNum := err.(dfslib.BadChunkNumError)
+	loggerA.TestResult(testCase, isBadNum)
+	if !isBadNum {return fmt.Errorf("expected BadChunkNumError, got %v", err)}
+
+	fileB, err := dfsB.Open(FileName3141, dfslib.READ)
+	if err != nil {return err}
+	defer fileB.Close()
+	testCase = fmt.Sprintf("Reading chunk %d back with %d-byte chunks", FarChunk3141, ChunkSize3141)
+	if fileB.ChunkSize() != ChunkSize3141 {
+		err = fmt.Errorf("the file has %d-byte chunks, expected %d", fileB.ChunkSize(), ChunkSize3141)
+	}
+	got := make([]byte, ChunkSize3141)
+	if err == nil {err = fileB.ReadChunk(FarChunk3141, got)}
+	if err == nil && !bytes.Equal(got, blob) {err = fmt.Errorf("read back %q, expected %q", string(got), content)}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading a chunk never written as zeros"
+	err = fileB.ReadChunk(FarChunk3141 - 1, got)
+	if err == nil && !bytes.Equal(got, make([]byte, ChunkSize3141)) {err = fmt.Errorf("read back %q, expected zeros", string(got))}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Reading a %d-byte chunk fails", shared.BytesPerChunk)
+	var chunk dfslib.Chunk
+	err = fileB.Read(0, &chunk)
+	_, isBadSize = err.(dfslib.BadChunkSizeError)
+	loggerB.TestResult(testCase, isBadSize)
+	if !isBadSize {return fmt.Errorf("expected BadChunkSizeError, got %v", err)}
+	return nil
+}
@@ -0,0 +1,127 @@
+// File status
+// Client A creates file F with 64-byte chunks and writes chunk 3 twice and chunk 7 once.
+// Client B stats F while A holds its lock and after A closes it: B sees the layout, the
+// chunk versions, A as the last writer and lock holder, and once A unmounts, that none
+// of F's chunks is available.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const FileName3151 = "3151"
+const (
+	ChunkSize3151 = 64
+	NumChunks3151 = 8
+	// Long enough for the server to see A go offline
+	OfflineWait3151 = 500 * time.Millisecond
+)
+
+func Test_3_15_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.15.1]")
+	fmt.Println("Stat - One writer client and one reader client")
+	fmt.Println("Client A writes F, and B stats F while A holds it, after A closes it and after A unmounts")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA3151_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB3151_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_15_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_15_1\n\n")
+	CleanDir("clientA3151")
+	CleanDir("clientB3151")
+	itwg.Done()
+}
+
+func clients_3_15_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	loggerA := NewLogger("(3.15.1) Client A (W)")
+	loggerB := NewLogger("(3.15.1) Client B (R)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	testCase := fmt.Sprintf("Stating file '%s' before it exists fails", FileName3151)
+	_, err = dfsB.Stat(FileName3151)
+	_, isNotFound := err.(dfslib.FileNotFoundError)
+	loggerB.TestResult(testCase, isNotFound)
+	if !isNotFound {return fmt.Errorf("expected FileNotFoundError, got %v", err)}
+
+	testCase = fmt.Sprintf("Writing chunk 3 twice and chunk 7 of '%s'", FileName3151)
+	start := time.Now()
+	err = dfsA.CreateFile(FileName3151, ChunkSize3151, NumChunks3151)
+	if err != nil {return err}
+	file, err := dfsA.Open(FileName3151, dfslib.WRITE)
+	if err != nil {return err}
+	chunk := make([]byte, ChunkSize3151)
+	copy(chunk, "This is test 3.15.1!")
+	for _, chunkNum := range []uint64{3, 3, 7} {
+		if err == nil {err = file.WriteChunk(chunkNum, chunk)}
+	}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Stating the file while A holds its lock"
+	stat, err := dfsB.Stat(FileName3151)
+	if err == nil {err = layout_3_15_1(stat)}
+	if err == nil && stat.ChunkVersions[3] <= stat.ChunkVersions[7] {
+		err = fmt.Errorf("chunk 3 is at version %d, expected a later version than chunk 7's %d", stat.ChunkVersions[3], stat.ChunkVersions[7])
+	}
+	if err == nil && len(stat.LockHolders) != 1 {err = fmt.Errorf("%d clients hold locks, expected 1", len(stat.LockHolders))}
+	if err == nil && stat.LastWriter != stat.LockHolders[0].ClientId {
+		err = fmt.Errorf("client %d wrote last, expected the lock holder %d", stat.LastWriter, stat.LockHolders[0].ClientId)
+	}
+	if err == nil && stat.LastModified.Before(start) {
+		err = fmt.Errorf("the file was last modified at %v, before the writes started", stat.LastModified)
+	}
+	if err == nil && stat.AvailableChunks != 2 {err = fmt.Errorf("%d chunks are available, expected 2", stat.AvailableChunks)}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Stating the file after A closes it"
+	err = file.Close()
+	if err == nil {stat, err = dfsB.Stat(FileName3151)}
+	if err == nil {err = layout_3_15_1(stat)}
+	if err == nil && len(stat.LockHolders) != 0 {err = fmt.Errorf("%d clients hold locks, expected none", len(stat.LockHolders))}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Stating the file after A unmounts"
+	err = dfsA.UMountDFS()
+	time.Sleep(OfflineWait3151)
+	if err == nil {stat, err = dfsB.Stat(FileName3151)}
+	if err == nil && stat.AvailableChunks != 0 {err = fmt.Errorf("%d chunks are available, expected none", stat.AvailableChunks)}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Opening the file for reading fails with no chunk available"
+	_, err = dfsB.Open(FileName3151, dfslib.READ)
+	_, isUnavailable := err.(dfslib.FileUnavailableError)
+	loggerB.TestResult(testCase, isUnavailable)
+	if !isUnavailable {return fmt.Errorf("expected FileUnavailableError, got %v", err)}
+	return nil
+}
+
+// layout_3_15_1 checks that stat describes FileName3151 with chunks 3 and 7 written.
+func layout_3_15_1(stat dfslib.FileStat) error {
+	if stat.Filename != FileName3151 || stat.ChunkSize != ChunkSize3151 || stat.NumChunks != NumChunks3151 {
+		return fmt.Errorf("stat describes '%s' with %d chunks of %d bytes, expected '%s' with %d chunks of %d bytes",
+			stat.Filename, stat.NumChunks, stat.ChunkSize, FileName3151, NumChunks3151, ChunkSize3151)
+	}
+	if len(stat.ChunkVersions) != 2 {return fmt.Errorf("%d chunks were written, expected 2", len(stat.ChunkVersions))}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Deletes, renames and truncates with an offline client
+// Clients B and C hold copies of four files. While C is offline, client A deletes
+// one, renames another, deletes and recreates the third and truncates the fourth.
+// B's copies follow at once; C's follow when it reconnects, and none of its old
+// copies come back.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const (
+	DeletedFileName3161   = "3161d"
+	RenamedFileName3161   = "3161r"
+	NewFileName3161       = "3161n"
+	RecreatedFileName3161 = "3161e"
+	TruncatedFileName3161 = "3161t"
+	// TruncatedFileName3161 is cut to TruncatedChunks3161 chunks, dropping DroppedChunk3161
+	TruncatedChunks3161   = 3
+	DroppedChunk3161      = 5
+)
+
+func Test_3_16_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.16.1]")
+	fmt.Println("Namespace - One writer client, one reader client and one offline reader client")
+	fmt.Println("Client A deletes, renames, recreates and truncates files held by B, and by C while it is offline")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA3161_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB3161_")
+	clientCLocalPath, errC := ioutil.TempDir(".", "clientC3161_")
+
+	if errA != nil || errB != nil || errC != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_16_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath, clientCLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_16_1\n\n")
+	CleanDir("clientA3161")
+	CleanDir("clientB3161")
+	CleanDir("clientC3161")
+	itwg.Done()
+}
+
+func clients_3_16_1(serverAddr, localIP, localPathA, localPathB, localPathC string) (err error) {
+	loggerA := NewLogger("(3.16.1) Client A (W)")
+	loggerB := NewLogger("(3.16.1) Client B (R)")
+	loggerC := NewLogger("(3.16.1) Client C (R)")
+	fileNames := []string{DeletedFileName3161, RenamedFileName3161, RecreatedFileName3161, TruncatedFileName3161}
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+	dfsC, err := dfslib.MountDFS(serverAddr, localIP, localPathC)
+	if err != nil {return err}
+
+	for _, fname := range fileNames {
+		testCase := fmt.Sprintf("Writing file '%s'", fname)
+		err = write_3_16_1(dfsA, fname, 0, "old "+fname)
+		if err == nil && fname == TruncatedFileName3161 {
+			err = write_3_16_1(dfsA, fname, DroppedChunk3161, "old "+fname)
+		}
+		loggerA.TestResult(testCase, err == nil)
+		if err != nil {return err}
+		for _, dfs := range []dfslib.DFS{dfsB, dfsC} {
+			err = check_3_16_1(dfs, fname, "old "+fname)
+			if err != nil {return err}
+		}
+	}
+	err = dfsC.UMountDFS()
+	if err != nil {return err}
+	time.Sleep(200 * time.Millisecond)
+
+	testCase := "Deleting, renaming, recreating and truncating files"
+	err = dfsA.DeleteFile(DeletedFileName3161)
+	if err == nil {err = dfsA.RenameFile(RenamedFileName3161, NewFileName3161)}
+	if err == nil {err = dfsA.DeleteFile(RecreatedFileName3161)}
+	if err == nil {err = write_3_16_1(dfsA, RecreatedFileName3161, 0, "new "+RecreatedFileName3161)}
+	if err == nil {err = dfsA.TruncateFile(TruncatedFileName3161, TruncatedChunks3161)}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Deleting '%s' again fails", DeletedFileName3161)
+	err = dfsA.DeleteFile(DeletedFileName3161)
+	_, isNotFound := err.(dfslib.FileNotFoundError)
+	loggerA.TestResult(testCase, isNotFound)
+	if !isNotFound {return fmt.Errorf("expected FileNotFoundError, got %v", err)}
+
+	err = checkNamespace_3_16_1(dfsB)
+	loggerB.TestResult("Local copies follow the changes at once", err == nil)
+	if err != nil {return err}
+
+	dfsC, err = dfslib.MountDFS(serverAddr, localIP, localPathC)
+	if err != nil {return err}
+	defer dfsC.UMountDFS()
+	err = checkNamespace_3_16_1(dfsC)
+	loggerC.TestResult("Local copies follow the changes missed while offline", err == nil)
+	if err != nil {return err}
+
+	exists, err := dfsC.GlobalFileExists(DeletedFileName3161)
+	if err == nil && exists {err = fmt.Errorf("'%s' was recovered from C's copy", DeletedFileName3161)}
+	loggerC.TestResult(fmt.Sprintf("'%s' stays deleted", DeletedFileName3161), err == nil)
+	if err != nil {return err}
+
+	err = check_3_16_1(dfsC, RecreatedFileName3161, "new "+RecreatedFileName3161)
+	loggerC.TestResult(fmt.Sprintf("Reading the recreated '%s'", RecreatedFileName3161), err == nil)
+	return err
+}
+
+// checkNamespace_3_16_1 checks that the deleted file and the renamed file's old name
+// are gone from the local path, the renamed file can be read under its new name, and
+// the truncated file lost its dropped chunk.
+func checkNamespace_3_16_1(dfs dfslib.DFS) error {
+	for _, fname := range []string{DeletedFileName3161, RenamedFileName3161} {
+		exists, err := dfs.LocalFileExists(fname)
+		if err != nil {return err}
+		if exists {return fmt.Errorf("local copy of '%s' was kept", fname)}
+	}
+	exists, err := dfs.LocalFileExists(NewFileName3161)
+	if err != nil {return err}
+	if !exists {return fmt.Errorf("no local copy of '%s'", NewFileName3161)}
+	err = check_3_16_1(dfs, NewFileName3161, "old "+RenamedFileName3161)
+	if err != nil {return err}
+
+	file, err := dfs.Open(TruncatedFileName3161, dfslib.READ)
+	if err != nil {return err}
+	defer file.Close()
+	if file.NumChunks() != TruncatedChunks3161 {
+		return fmt.Errorf("'%s' has %d chunks, expected %d", TruncatedFileName3161, file.NumChunks(), TruncatedChunks3161)
+	}
+	var got dfslib.Chunk
+	err = file.Read(DroppedChunk3161, &got)
+	if err != nil {return err}
+	if got != (dfslib.Chunk{}) {
+		return fmt.Errorf("read back %q from dropped chunk %d, expected zeros", string(got[:]), DroppedChunk3161)
+	}
+	return check_3_16_1(dfs, TruncatedFileName3161, "old "+TruncatedFileName3161)
+}
+
+// write_3_16_1 writes content to chunk chunkNum of fname.
+func write_3_16_1(dfs dfslib.DFS, fname string, chunkNum uint8, content string) error {
+	file, err := dfs.Open(fname, dfslib.WRITE)
+	if err != nil {return err}
+	var blob dfslib.Chunk
+	copy(blob[:], content)
+	err = file.Write(chunkNum, &blob)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// check_3_16_1 reads the first chunk of fname and checks that it holds content.
+func check_3_16_1(dfs dfslib.DFS, fname string, content string) error {
+	file, err := dfs.Open(fname, dfslib.READ)
+	if err != nil {return err}
+	defer file.Close()
+	var got, expected dfslib.Chunk
+	copy(expected[:], content)
+	err = file.Read(0, &got)
+	if err != nil {return err}
+	if got != expected {
+		return fmt.Errorf("read back %q from '%s', expected %q", string(got[:]), fname, content)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// File listing with prefix and pattern filters
+// Client A writes five files and holds one of them in WRITE mode. Client B lists them
+// by prefix, then a page at a time by pattern, and lists its own local copies.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"reflect"
+	"sync"
+)
+
+const (
+	Prefix3171     = "3171"
+	HeldFile3171   = "3171a2"
+	Pattern3171    = "3171a[0-9]*"
+	PageLimit3171  = 2
+)
+
+var FileNames3171 = []string{"3171a1", "3171a2", "3171a10", "3171ax", "3171b"}
+
+func Test_3_17_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.17.1]")
+	fmt.Println("Listing - One writer client and one reader client")
+	fmt.Println("Client A writes files, client B lists them by prefix, by pattern a page at a time, and locally")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA3171_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB3171_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_17_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_17_1\n\n")
+	CleanDir("clientA3171")
+	CleanDir("clientB3171")
+	itwg.Done()
+}
+
+func clients_3_17_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	loggerA := NewLogger("(3.17.1) Client A (W)")
+	loggerB := NewLogger("(3.17.1) Client B (R)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	var blob dfslib.Chunk
+	for _, fname := range FileNames3171 {
+		testCase := fmt.Sprintf("Writing chunk %d of '%s'", CHUNKNUM, fname)
+		file, err := dfsA.Open(fname, dfslib.WRITE)
+		if err == nil {err = file.Write(CHUNKNUM, &blob)}
+		if err == nil {err = file.Close()}
+		loggerA.TestResult(testCase, err == nil)
+		if err != nil {return err}
+	}
+	held, err := dfsA.Open(HeldFile3171, dfslib.WRITE)
+	if err != nil {return err}
+	defer held.Close()
+
+	testCase := fmt.Sprintf("Listing files starting with '%s'", Prefix3171)
+	files, err := dfsB.ListFiles(Prefix3171)
+	if err == nil {err = checkNames_3_17_1(files, []string{"3171a1", "3171a10", "3171a2", "3171ax", "3171b"})}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Listing shows A's lock on '%s' and the written chunk", HeldFile3171)
+	for _, stat := range files {
+		lockHolders := 0
+		if stat.Filename == HeldFile3171 {lockHolders = 1}
+		if len(stat.LockHolders) != lockHolders {
+			err = fmt.Errorf("'%s' has %d lock holders, expected %d", stat.Filename, len(stat.LockHolders), lockHolders)
+		} else if len(stat.ChunkVersions) != 1 || stat.AvailableChunks != 1 {
+			err = fmt.Errorf("'%s' has %d chunks written and %d available, expected 1",
+				stat.Filename, len(stat.ChunkVersions), stat.AvailableChunks)
+		}
+		if err != nil {break}
+	}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Listing files matching '%s' %d at a time", Pattern3171, PageLimit3171)
+	var pages [][]string
+	after := ""
+	for {
+		var next string
+		files, next, err = dfsB.ListFilesPage(Prefix3171, Pattern3171, after, PageLimit3171)
+		if err != nil {break}
+		var names []string
+		for _, stat := range files {
+			names = append(names, stat.Filename)
+		}
+		pages = append(pages, names)
+		if next == "" {break}
+		after = next
+	}
+	expected := [][]string{{"3171a1", "3171a10"}, {"3171a2"}}
+	if err == nil && !reflect.DeepEqual(pages, expected) {err = fmt.Errorf("listed pages %v, expected %v", pages, expected)}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Listing files with a malformed pattern fails"
+	_, _, err = dfsB.ListFilesPage(Prefix3171, "3171[", "", 0)
+	_, isBadPattern := err.(dfslib.BadPatternError)
+	loggerB.TestResult(testCase, isBadPattern)
+	if !isBadPattern {return fmt.Errorf("expected BadPatternError, got %v", err)}
+
+	testCase = "Listing the local copies of files read"
+	reader, err := dfsB.Open("3171b", dfslib.READ)
+	if err != nil {return err}
+	err = reader.Read(CHUNKNUM, &blob)
+	reader.Close()
+	if err != nil {return err}
+	localFiles, err := dfsB.ListLocalFiles(Prefix3171)
+	if err == nil && (len(localFiles) != 1 || localFiles[0].Filename != "3171b" || len(localFiles[0].ChunkVersions) != 1) {
+		err = fmt.Errorf("listed local copies %+v, expected '3171b' with 1 chunk", localFiles)
+	}
+	loggerB.TestResult(testCase, err == nil)
+	return err
+}
+
+// checkNames_3_17_1 checks that files are named names, in order.
+func checkNames_3_17_1(files []dfslib.FileStat, names []string) error {
+	var listed []string
+	for _, stat := range files {
+		listed = append(listed, stat.Filename)
+	}
+	if !reflect.DeepEqual(listed, names) {return fmt.Errorf("listed %v, expected %v", listed, names)}
+	return nil
+}
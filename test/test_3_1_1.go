@@ -0,0 +1,181 @@
+// Stress test: dozens of clients at once
+// Every client writes and reads back its own range of a shared file, takes turns with
+// the others for the whole of a second shared file, and writes and reads back a file
+// of its own. Build the server and app.go with -race to
+// check both under load.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const (
+	FileName311       = "311"
+	QueueFileName311  = "311queue"
+	NumClients311     = 24
+	NumRounds311      = 5
+	WaitTimeout311    = 60 * time.Second
+)
+
+func Test_3_1_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.1.1]")
+	fmt.Println("Stress - Dozens of reader/writer clients at once")
+	fmt.Println("Each client writes its own range of a shared file, queues for a second shared file, and writes a file of its own")
+
+	errChannel := make(chan error, NumClients311)
+	var finished sync.WaitGroup
+	finished.Add(NumClients311)
+	for i := 0; i < NumClients311; i++ {
+		localPath, err := ioutil.TempDir(".", fmt.Sprintf("client311_%02d_", i))
+		if err != nil {
+			panic("Could not create temporary directory")
+		}
+		go client_3_1_1(serverAddr, LocalIP, localPath, i, &finished, errChannel)
+	}
+
+	for i := 0; i < NumClients311; i++ {
+		e := <- errChannel
+		if e != nil {
+			itwg.Done()
+			reportError(e)
+		}
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_1_1\n\n")
+	CleanDir("client311")
+	itwg.Done()
+}
+
+func client_3_1_1(serverAddr, localIP, localPath string, id int, finished *sync.WaitGroup, rc chan <- error) {
+	logger := NewLogger(fmt.Sprintf("(3.1.1) Client %02d", id))
+
+	testCase := fmt.Sprintf("Mounting DFS('%s', '%s', '%s')", serverAddr, localIP, localPath)
+	dfs, err := dfslib.MountDFS(serverAddr, localIP, localPath)
+	if err != nil {
+		logger.TestResult(testCase, false)
+		finished.Done()
+		rc <- err
+		return
+	}
+
+	err = rounds_3_1_1(dfs, id, logger)
+	// Stay mounted until every client is done: the others may still need chunks only this client owns
+	finished.Done()
+	if err != nil {
+		rc <- err
+		return
+	}
+	finished.Wait()
+
+	if err = dfs.UMountDFS(); err != nil {
+		logger.TestResult("Unmounting DFS", false)
+		rc <- err
+		return
+	}
+	rc <- nil
+}
+
+// rounds_3_1_1 runs client id's rounds of writes on the shared file and its own file.
+func rounds_3_1_1(dfs dfslib.DFS, id int, logger testLogger) (err error) {
+	var testCase string
+	ownFileName := fmt.Sprintf("311c%02d", id)
+	for round := 0; round < NumRounds311; round++ {
+		content := fmt.Sprintf("(%02d) round %d", id, round)
+
+		// Clients hold disjoint ranges of the shared file at the same time
+		testCase = fmt.Sprintf("Writing and reading back chunk %d of '%s' (round %d)", id, FileName311, round)
+		err = writeRange_3_1_1(dfs, FileName311, uint8(id), content)
+		if err != nil {
+			logger.TestResult(testCase, false)
+			return err
+		}
+
+		// Clients take turns with the whole of the queued file
+		testCase = fmt.Sprintf("Queueing for '%s' (round %d)", QueueFileName311, round)
+		err = writeQueued_3_1_1(dfs, QueueFileName311, content)
+		if err != nil {
+			logger.TestResult(testCase, false)
+			return err
+		}
+
+		testCase = fmt.Sprintf("Writing and reading back '%s' (round %d)", ownFileName, round)
+		err = writeOwn_3_1_1(dfs, ownFileName, round, content)
+		if err != nil {
+			logger.TestResult(testCase, false)
+			return err
+		}
+	}
+	logger.TestResult(fmt.Sprintf("Completed %d rounds", NumRounds311), true)
+	return nil
+}
+
+// writeRange_3_1_1 writes content to chunk chunkNum of fname, holding only that chunk,
+// then reads it back from a READ handle.
+func writeRange_3_1_1(dfs dfslib.DFS, fname string, chunkNum uint8, content string) error {
+	file, err := dfs.OpenRange(fname, uint64(chunkNum), uint64(chunkNum))
+	if err != nil {return err}
+	var blob dfslib.Chunk
+	copy(blob[:], content)
+	err = file.Write(chunkNum, &blob)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {return err}
+	return readBack_3_1_1(dfs, fname, chunkNum, content)
+}
+
+// writeQueued_3_1_1 waits for the whole of fname, writes content to its first chunk
+// and reads it back before letting the next client in.
+func writeQueued_3_1_1(dfs dfslib.DFS, fname string, content string) error {
+	file, err := dfs.OpenWithWait(fname, dfslib.WRITE, WaitTimeout311)
+	if err != nil {return err}
+	var blob, got dfslib.Chunk
+	copy(blob[:], content)
+	err = file.Write(0, &blob)
+	if err == nil {err = file.Read(0, &got)}
+	if err == nil && got != blob {
+		err = fmt.Errorf("read back %q from '%s', expected %q", string(got[:]), fname, content)
+	}
+	closeErr := file.Close()
+	if err != nil {return err}
+	return closeErr
+}
+
+// writeOwn_3_1_1 writes content to the round's chunk of fname, which no other client
+// opens, and reads it back.
+func writeOwn_3_1_1(dfs dfslib.DFS, fname string, round int, content string) error {
+	file, err := dfs.Open(fname, dfslib.WRITE)
+	if err != nil {return err}
+	var blob dfslib.Chunk
+	copy(blob[:], content)
+	err = file.Write(uint8(round), &blob)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {return err}
+	return readBack_3_1_1(dfs, fname, uint8(round), content)
+}
+
+// readBack_3_1_1 checks that chunk chunkNum of fname holds content.
+func readBack_3_1_1(dfs dfslib.DFS, fname string, chunkNum uint8, content string) error {
+	file, err := dfs.Open(fname, dfslib.READ)
+	if err != nil {return err}
+	defer file.Close()
+	var got, expected dfslib.Chunk
+	copy(expected[:], content)
+	err = file.Read(chunkNum, &got)
+	if err != nil {return err}
+	if got != expected {
+		return fmt.Errorf("read back %q from '%s' chunk %d, expected %q", string(got[:]), fname, chunkNum, content)
+	}
+	return nil
+}
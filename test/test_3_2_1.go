@@ -0,0 +1,122 @@
+// Two mounts in one process
+// Client A opens file F for writing and client B opens it for reading, both from this
+// process. B cannot write, but reads A's write. B keeps working after A unmounts, and
+// A can mount again.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const FileName321 = "321"
+
+func Test_3_2_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.2.1]")
+	fmt.Println("Mounts - One writer client and one reader client in the same process")
+	fmt.Println("Client A writes F and B reads it; B keeps working after A unmounts, and A mounts again")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA321_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB321_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_2_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_2_1\n\n")
+	CleanDir("clientA321")
+	CleanDir("clientB321")
+	itwg.Done()
+}
+
+func clients_3_2_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(3.2.1) Client A (W)")
+	loggerB := NewLogger("(3.2.1) Client B (R)")
+	content := "This is test 3.2.1!"
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	loggerA.TestResult("Mounting DFS", err == nil)
+	if err != nil {return err}
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	loggerB.TestResult("Mounting DFS in the same process", err == nil)
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+	defer dfsB.UMountDFS()
+
+	testCase := fmt.Sprintf("Opening file '%s' for writing", FileName321)
+	fileA, err := dfsA.Open(FileName321, dfslib.WRITE)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+
+	testCase = fmt.Sprintf("Opening file '%s' for reading", FileName321)
+	fileB, err := dfsB.Open(FileName321, dfslib.READ)
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+	defer fileB.Close()
+
+	testCase = fmt.Sprintf("Writing chunk %d after B opened the file for reading", CHUNKNUM)
+	copy(blob[:], content)
+	err = fileA.Write(CHUNKNUM, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+
+	testCase = fmt.Sprintf("Writing chunk %d fails in READ mode", CHUNKNUM)
+	err = fileB.Write(CHUNKNUM, &blob)
+	_, isBadMode := err.(dfslib.BadFileModeError)
+	loggerB.TestResult(testCase, isBadMode)
+	if !isBadMode {
+		dfsA.UMountDFS()
+		return fmt.Errorf("expected BadFileModeError, got %v", err)
+	}
+
+	err = read_3_2_1(fileB, content, loggerB, "Reading A's write")
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+
+	err = fileA.Close()
+	if err == nil {err = dfsA.UMountDFS()}
+	loggerA.TestResult("Unmounting DFS", err == nil)
+	if err != nil {return err}
+
+	err = read_3_2_1(fileB, content, loggerB, "Reading A's write after A unmounted")
+	if err != nil {return err}
+
+	dfsA, err = dfslib.MountDFS(serverAddr, localIP, localPathA)
+	loggerA.TestResult("Mounting DFS again", err == nil)
+	if err != nil {return err}
+	return dfsA.UMountDFS()
+}
+
+// read_3_2_1 checks that chunk CHUNKNUM of file holds content.
+func read_3_2_1(file dfslib.DFSFile, content string, logger testLogger, testCase string) (err error) {
+	var blob dfslib.Chunk
+	testCase = fmt.Sprintf("%s back from chunk %d", testCase, CHUNKNUM)
+	err = file.Read(CHUNKNUM, &blob)
+	if err == nil && string(blob[:len(content)]) != content {
+		err = fmt.Errorf("read back %q, expected %q", string(blob[:len(content)]), content)
+	}
+	logger.TestResult(testCase, err == nil)
+	return err
+}
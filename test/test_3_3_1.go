@@ -0,0 +1,112 @@
+// Per-handle file modes
+// Client A opens file F for writing twice and for reading once, and file G for reading.
+// Each handle keeps its own mode, and A holds F's write lock until its last WRITE
+// handle is closed.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const (
+	FileName331      = "331"
+	OtherFileName331 = "331other"
+)
+
+func Test_3_3_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.3.1]")
+	fmt.Println("Handles - One client with several handles and one writer client")
+	fmt.Println("Client A's READ and WRITE handles keep their own modes; B can write F once all of A's WRITE handles are closed")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA331_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB331_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_3_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_3_1\n\n")
+	CleanDir("clientA331")
+	CleanDir("clientB331")
+	itwg.Done()
+}
+
+func clients_3_3_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(3.3.1) Client A")
+	loggerB := NewLogger("(3.3.1) Client B (W)")
+	copy(blob[:], "This is test 3.3.1!")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	testCase := fmt.Sprintf("Opening file '%s' for writing", FileName331)
+	writer1, err := dfsA.Open(FileName331, dfslib.WRITE)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Opening file '%s' for reading", OtherFileName331)
+	other, err := dfsA.Open(OtherFileName331, dfslib.READ)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+	defer other.Close()
+
+	testCase = fmt.Sprintf("Writing chunk %d of '%s' after opening '%s' for reading", CHUNKNUM, FileName331, OtherFileName331)
+	err = writer1.Write(CHUNKNUM, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Writing chunk %d through a READ handle of '%s' fails", CHUNKNUM, FileName331)
+	reader, err := dfsA.Open(FileName331, dfslib.READ)
+	if err != nil {return err}
+	defer reader.Close()
+	err = reader.Write(CHUNKNUM, &blob)
+	_, isBadMode := err.(dfslib.BadFileModeError)
+	loggerA.TestResult(testCase, isBadMode)
+	if !isBadMode {return fmt.Errorf("expected BadFileModeError, got %v", err)}
+
+	testCase = fmt.Sprintf("Opening file '%s' for writing a second time", FileName331)
+	writer2, err := dfsA.Open(FileName331, dfslib.WRITE)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Closing the first WRITE handle twice fails the second time"
+	err = writer1.Close()
+	if err == nil {
+		if writer1.Close() == nil {err = fmt.Errorf("closing a closed handle succeeded")}
+	}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Writing chunk %d through the second WRITE handle", CHUNKNUM+1)
+	err = writer2.Write(CHUNKNUM+1, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Opening file '%s' for writing fails while A holds it", FileName331)
+	_, err = dfsB.Open(FileName331, dfslib.WRITE)
+	_, isConflict := err.(dfslib.OpenWriteConflictError)
+	loggerB.TestResult(testCase, isConflict)
+	if !isConflict {return fmt.Errorf("expected OpenWriteConflictError, got %v", err)}
+
+	err = writer2.Close()
+	if err != nil {return err}
+	testCase = fmt.Sprintf("Opening file '%s' for writing once A closed its WRITE handles", FileName331)
+	writerB, err := dfsB.Open(FileName331, dfslib.WRITE)
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+	return writerB.Close()
+}
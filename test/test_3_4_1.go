@@ -0,0 +1,175 @@
+// Write leases and fencing tokens
+// Client A holds file F in WRITE mode past its lease duration, then an administrator
+// releases its lock. Client B takes the lock under a newer token, and A's writes are
+// rejected from then on.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"net/rpc"
+	"../dfslib"
+	"../shared"
+	"sync"
+	"time"
+)
+
+const FileName341 = "341"
+// Longer than the server's lease duration, so the lease must have been renewed
+const LeaseWait341 = 7 * time.Second
+
+func Test_3_4_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.4.1]")
+	fmt.Println("Leases - Two writer clients and an administrator")
+	fmt.Println("Client A's lease outlives its duration, then its lock is released and B's newer token fences it")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA341_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB341_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_4_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_4_1\n\n")
+	CleanDir("clientA341")
+	CleanDir("clientB341")
+	itwg.Done()
+}
+
+func clients_3_4_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(3.4.1) Client A (W)")
+	loggerB := NewLogger("(3.4.1) Client B (W)")
+	loggerAdmin := NewLogger("(3.4.1) Admin")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+	admin, err := rpc.Dial("tcp", serverAddr)
+	if err != nil {return err}
+	defer admin.Close()
+
+	testCase := fmt.Sprintf("Opening file '%s' for writing", FileName341)
+	fileA, err := dfsA.Open(FileName341, dfslib.WRITE)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+	defer fileA.Close()
+
+	lockA, err := lock_3_4_1(admin, FileName341)
+	loggerAdmin.TestResult("Listing A's lock", err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Writing chunk %d", CHUNKNUM)
+	blob = chunk_3_4_1("(A) first write")
+	err = fileA.Write(CHUNKNUM, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	time.Sleep(LeaseWait341)
+	testCase = fmt.Sprintf("Writing chunk %d after the lease was renewed", CHUNKNUM)
+	blob = chunk_3_4_1("(A) renewed write")
+	err = fileA.Write(CHUNKNUM, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Opening file '%s' for writing fails, naming A as the holder", FileName341)
+	_, err = dfsB.Open(FileName341, dfslib.WRITE)
+	conflict, isConflict := err.(dfslib.OpenWriteConflictError)
+	if !isConflict {
+		err = fmt.Errorf("expected OpenWriteConflictError, got %v", err)
+	} else if conflict.LockHolder != lockA.ClientId || conflict.IsWaiting {
+		err = fmt.Errorf("conflict names client [%d] (waiting: %t), expected holder [%d]",
+			conflict.LockHolder, conflict.IsWaiting, lockA.ClientId)
+	} else {
+		err = nil
+	}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	req := shared.ForceUnlockRequest{
+		Filename: FileName341, ClientId: lockA.ClientId, Operator: "test", Reason: "test 3.4.1",
+	}
+	var released shared.ForceUnlockResponse
+	err = admin.Call("Server.ForceUnlock", req, &released)
+	if err == nil && len(released.Released) != 1 {err = fmt.Errorf("released %d locks, expected 1", len(released.Released))}
+	loggerAdmin.TestResult("Releasing A's lock", err == nil)
+	if err != nil {return err}
+
+	var audit shared.AuditLogResponse
+	err = admin.Call("Server.GetAuditLog", shared.AuditLogRequest{}, &audit)
+	if err == nil {
+		records := audit.Records
+		if len(records) == 0 || records[len(records)-1].Filename != FileName341 ||
+			records[len(records)-1].ClientId != lockA.ClientId || records[len(records)-1].Operator != "test" {
+			err = fmt.Errorf("the audit log does not end with the release of A's lock")
+		}
+	}
+	loggerAdmin.TestResult("Finding the release in the audit log", err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Opening file '%s' for writing", FileName341)
+	fileB, err := dfsB.Open(FileName341, dfslib.WRITE)
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	lockB, err := lock_3_4_1(admin, FileName341)
+	if err == nil && lockB.Token <= lockA.Token {
+		err = fmt.Errorf("B's token [%d] is not newer than A's [%d]", lockB.Token, lockA.Token)
+	}
+	loggerAdmin.TestResult("B's fencing token is newer than A's", err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Writing chunk %d", CHUNKNUM)
+	blob = chunk_3_4_1("(B) takes over")
+	err = fileB.Write(CHUNKNUM, &blob)
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Writing chunk %d with a stale token fails", CHUNKNUM)
+	blob = chunk_3_4_1("(A) stale write")
+	err = fileA.Write(CHUNKNUM, &blob)
+	_, isTimeout := err.(dfslib.WriteModeTimeoutError)
+	loggerA.TestResult(testCase, isTimeout)
+	if !isTimeout {return fmt.Errorf("expected WriteModeTimeoutError, got %v", err)}
+
+	err = fileB.Close()
+	if err != nil {return err}
+	return readBack_3_4_1(dfsB, loggerB, "(B) takes over")
+}
+
+// lock_3_4_1 returns the only write lock held on fname.
+func lock_3_4_1(admin *rpc.Client, fname string) (shared.LockInfo, error) {
+	var reply shared.ListLocksResponse
+	err := admin.Call("Server.ListLocks", shared.ListLocksRequest{Filename: fname}, &reply)
+	if err != nil {return shared.LockInfo{}, err}
+	if len(reply.Locks) != 1 {return shared.LockInfo{}, fmt.Errorf("%d locks on '%s', expected 1", len(reply.Locks), fname)}
+	return reply.Locks[0], nil
+}
+
+// readBack_3_4_1 checks that chunk CHUNKNUM of FileName341 holds content.
+func readBack_3_4_1(dfs dfslib.DFS, logger testLogger, content string) (err error) {
+	testCase := fmt.Sprintf("Reading '%s' back from chunk %d", content, CHUNKNUM)
+	reader, err := dfs.Open(FileName341, dfslib.READ)
+	if err != nil {return err}
+	defer reader.Close()
+	var got dfslib.Chunk
+	err = reader.Read(CHUNKNUM, &got)
+	if err == nil && got != chunk_3_4_1(content) {err = fmt.Errorf("read back %q, expected %q", string(got[:]), content)}
+	logger.TestResult(testCase, err == nil)
+	return err
+}
+
+// chunk_3_4_1 returns a chunk holding content.
+func chunk_3_4_1(content string) (blob dfslib.Chunk) {
+	copy(blob[:], content)
+	return blob
+}
@@ -0,0 +1,125 @@
+// Write-lock wait queue
+// Client A holds file F in WRITE mode. Client E's wait times out, then B and C queue for
+// F in that order. C cancels its wait, D's plain Open cannot jump the queue, and B gets
+// F once A closes it.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const (
+	FileName351      = "351"
+	ShortTimeout351  = 1 * time.Second
+	QueueWait351     = 200 * time.Millisecond
+	ClientNames351   = "ABCDE"
+)
+
+func Test_3_5_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.5.1]")
+	fmt.Println("Wait queue - Five writer clients")
+	fmt.Println("Clients queue for F held by A; waits time out or are cancelled, and B gets F when A closes it")
+	var localPaths []string
+	for _, name := range ClientNames351 {
+		localPath, err := ioutil.TempDir(".", fmt.Sprintf("client%c351_", name))
+		if err != nil {
+			panic("Could not create temporary directory")
+		}
+		localPaths = append(localPaths, localPath)
+	}
+
+	err := clients_3_5_1(serverAddr, LocalIP, localPaths)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_5_1\n\n")
+	for _, name := range ClientNames351 {
+		CleanDir(fmt.Sprintf("client%c351", name))
+	}
+	itwg.Done()
+}
+
+// waitResult_3_5_1 is the outcome of an OpenWithWait call made in the background.
+type waitResult_3_5_1 struct {
+	file dfslib.DFSFile
+	err  error
+}
+
+func clients_3_5_1(serverAddr, localIP string, localPaths []string) (err error) {
+	loggers := make(map[rune]testLogger)
+	dfs := make(map[rune]dfslib.DFS)
+	for i, name := range ClientNames351 {
+		loggers[name] = NewLogger(fmt.Sprintf("(3.5.1) Client %c (W)", name))
+		dfs[name], err = dfslib.MountDFS(serverAddr, localIP, localPaths[i])
+		if err != nil {return err}
+		defer dfs[name].UMountDFS()
+	}
+
+	testCase := fmt.Sprintf("Opening file '%s' for writing", FileName351)
+	fileA, err := dfs['A'].Open(FileName351, dfslib.WRITE)
+	loggers['A'].TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Waiting %v for file '%s' times out", ShortTimeout351, FileName351)
+	_, err = dfs['E'].OpenWithWait(FileName351, dfslib.WRITE, ShortTimeout351)
+	_, isTimeout := err.(dfslib.OpenWaitTimeoutError)
+	loggers['E'].TestResult(testCase, isTimeout)
+	if !isTimeout {return fmt.Errorf("expected OpenWaitTimeoutError, got %v", err)}
+
+	waitB := wait_3_5_1(dfs['B'])
+	time.Sleep(QueueWait351)
+	waitC := wait_3_5_1(dfs['C'])
+	time.Sleep(QueueWait351)
+
+	for position, name := range "BC" {
+		testCase = fmt.Sprintf("Waiting for file '%s' at position %d", FileName351, position+1)
+		var got int
+		got, err = dfs[name].WaitPosition(FileName351)
+		if err == nil && got != position+1 {err = fmt.Errorf("client %c is at position %d, expected %d", name, got, position+1)}
+		loggers[name].TestResult(testCase, err == nil)
+		if err != nil {return err}
+	}
+
+	testCase = fmt.Sprintf("Cancelling the wait for file '%s'", FileName351)
+	err = dfs['C'].CancelWait(FileName351)
+	if err == nil {
+		result := <-waitC
+		if _, isCancelled := result.err.(dfslib.OpenWaitCancelledError); !isCancelled {
+			err = fmt.Errorf("expected OpenWaitCancelledError, got %v", result.err)
+		}
+	}
+	loggers['C'].TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Opening file '%s' for writing fails while B is waiting", FileName351)
+	_, err = dfs['D'].Open(FileName351, dfslib.WRITE)
+	_, isConflict := err.(dfslib.OpenWriteConflictError)
+	loggers['D'].TestResult(testCase, isConflict)
+	if !isConflict {return fmt.Errorf("expected OpenWriteConflictError, got %v", err)}
+
+	err = fileA.Close()
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Getting file '%s' once A closed it", FileName351)
+	result := <-waitB
+	loggers['B'].TestResult(testCase, result.err == nil)
+	if result.err != nil {return result.err}
+	return result.file.Close()
+}
+
+// wait_3_5_1 starts waiting for FileName351 on dfs, with no timeout, in the background.
+func wait_3_5_1(dfs dfslib.DFS) chan waitResult_3_5_1 {
+	results := make(chan waitResult_3_5_1, 1)
+	go func() {
+		file, err := dfs.OpenWithWait(FileName351, dfslib.WRITE, 0)
+		results <- waitResult_3_5_1{file, err}
+	}()
+	return results
+}
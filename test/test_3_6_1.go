@@ -0,0 +1,140 @@
+// Chunk-range write locks
+// Clients A and B write disjoint ranges of file F at the same time. Client C cannot
+// take the whole file or an overlapping range, but can take a free range. Writes
+// outside a client's range fail, and every client's write can be read back.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const FileName361 = "361"
+
+func Test_3_6_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.6.1]")
+	fmt.Println("Range locks - Three writer clients")
+	fmt.Println("Clients A, B and C hold disjoint ranges of F at once; overlapping ranges and the whole file are refused")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA361_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB361_")
+	clientCLocalPath, errC := ioutil.TempDir(".", "clientC361_")
+
+	if errA != nil || errB != nil || errC != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_6_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath, clientCLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_6_1\n\n")
+	CleanDir("clientA361")
+	CleanDir("clientB361")
+	CleanDir("clientC361")
+	itwg.Done()
+}
+
+func clients_3_6_1(serverAddr, localIP, localPathA, localPathB, localPathC string) (err error) {
+	loggerA := NewLogger("(3.6.1) Client A (W)")
+	loggerB := NewLogger("(3.6.1) Client B (W)")
+	loggerC := NewLogger("(3.6.1) Client C (W)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+	dfsC, err := dfslib.MountDFS(serverAddr, localIP, localPathC)
+	if err != nil {return err}
+	defer dfsC.UMountDFS()
+
+	fileA, err := openRange_3_6_1(dfsA, loggerA, 0, 9)
+	if err != nil {return err}
+	fileB, err := openRange_3_6_1(dfsB, loggerB, 10, 19)
+	if err != nil {return err}
+
+	testCase := fmt.Sprintf("Opening the whole of file '%s' for writing fails", FileName361)
+	_, err = dfsC.Open(FileName361, dfslib.WRITE)
+	_, isConflict := err.(dfslib.OpenWriteConflictError)
+	loggerC.TestResult(testCase, isConflict)
+	if !isConflict {return fmt.Errorf("expected OpenWriteConflictError, got %v", err)}
+
+	testCase = fmt.Sprintf("Opening chunks 19-25 of file '%s', which overlap B's, fails", FileName361)
+	_, err = dfsC.OpenRange(FileName361, 19, 25)
+	_, isConflict = err.(dfslib.OpenWriteConflictError)
+	loggerC.TestResult(testCase, isConflict)
+	if !isConflict {return fmt.Errorf("expected OpenWriteConflictError, got %v", err)}
+
+	testCase = "Opening chunks 30-29 fails"
+	_, err = dfsC.OpenRange(FileName361, 30, 29)
+	_, isBadRange := err.(dfslib.BadChunkRangeError)
+	loggerC.TestResult(testCase, isBadRange)
+	if !isBadRange {return fmt.Errorf("expected BadChunkRangeError, got %v", err)}
+
+	fileC, err := openRange_3_6_1(dfsC, loggerC, 20, 25)
+	if err != nil {return err}
+
+	testCase = "Writing chunk 15, outside A's range, fails"
+	blob := chunk_3_6_1("A")
+	err = fileA.Write(15, &blob)
+	_, isNotLocked := err.(dfslib.ChunkNotLockedError)
+	loggerA.TestResult(testCase, isNotLocked)
+	if !isNotLocked {return fmt.Errorf("expected ChunkNotLockedError, got %v", err)}
+
+	writes := []struct {
+		file     dfslib.DFSFile
+		logger   testLogger
+		chunkNum uint8
+		content  string
+	}{
+		{fileA, loggerA, 5, "A"},
+		{fileB, loggerB, 15, "B"},
+		{fileC, loggerC, 25, "C"},
+	}
+	for _, w := range writes {
+		testCase = fmt.Sprintf("Writing chunk %d", w.chunkNum)
+		blob = chunk_3_6_1(w.content)
+		err = w.file.Write(w.chunkNum, &blob)
+		w.logger.TestResult(testCase, err == nil)
+		if err != nil {return err}
+	}
+	for _, w := range writes {
+		err = w.file.Close()
+		if err != nil {return err}
+	}
+
+	reader, err := dfsC.Open(FileName361, dfslib.READ)
+	if err != nil {return err}
+	defer reader.Close()
+	for _, w := range writes {
+		testCase = fmt.Sprintf("Reading %s's write back from chunk %d", w.content, w.chunkNum)
+		var got dfslib.Chunk
+		err = reader.Read(w.chunkNum, &got)
+		if err == nil && got != chunk_3_6_1(w.content) {
+			err = fmt.Errorf("read back %q from chunk %d, expected %q", string(got[:]), w.chunkNum, w.content)
+		}
+		loggerC.TestResult(testCase, err == nil)
+		if err != nil {return err}
+	}
+	return nil
+}
+
+// openRange_3_6_1 opens chunks firstChunk to lastChunk of FileName361 for writing.
+func openRange_3_6_1(dfs dfslib.DFS, logger testLogger, firstChunk, lastChunk uint64) (dfslib.DFSFile, error) {
+	testCase := fmt.Sprintf("Opening chunks %d-%d of file '%s' for writing", firstChunk, lastChunk, FileName361)
+	file, err := dfs.OpenRange(FileName361, firstChunk, lastChunk)
+	logger.TestResult(testCase, err == nil)
+	return file, err
+}
+
+// chunk_3_6_1 returns a chunk holding content.
+func chunk_3_6_1(content string) (blob dfslib.Chunk) {
+	copy(blob[:], content)
+	return blob
+}
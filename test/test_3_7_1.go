@@ -0,0 +1,104 @@
+// Callback invalidation
+// Client B keeps file F open for reading and reads chunk 0 repeatedly while client A
+// writes it. Every write A makes is seen by B's next read.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const (
+	FileName371  = "371"
+	NumWrites371 = 3
+	NumReads371  = 3
+)
+
+func Test_3_7_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.7.1]")
+	fmt.Println("Callbacks - One writer client and one reader client")
+	fmt.Println("Client B reads F repeatedly while A writes it, and sees every write")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA371_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB371_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_7_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_7_1\n\n")
+	CleanDir("clientA371")
+	CleanDir("clientB371")
+	itwg.Done()
+}
+
+func clients_3_7_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	loggerA := NewLogger("(3.7.1) Client A (W)")
+	loggerB := NewLogger("(3.7.1) Client B (R)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	writer, err := dfsA.Open(FileName371, dfslib.WRITE)
+	if err != nil {return err}
+	defer writer.Close()
+	blob := chunk_3_7_1("version 0")
+	err = writer.Write(0, &blob)
+	if err != nil {return err}
+
+	reader, err := dfsB.Open(FileName371, dfslib.READ)
+	if err != nil {return err}
+	defer reader.Close()
+
+	for version := 1; version <= NumWrites371; version++ {
+		testCase := fmt.Sprintf("Reading version %d of chunk 0 %d times", version-1, NumReads371)
+		err = read_3_7_1(reader, fmt.Sprintf("version %d", version-1))
+		loggerB.TestResult(testCase, err == nil)
+		if err != nil {return err}
+
+		testCase = fmt.Sprintf("Writing version %d of chunk 0", version)
+		blob = chunk_3_7_1(fmt.Sprintf("version %d", version))
+		err = writer.Write(0, &blob)
+		loggerA.TestResult(testCase, err == nil)
+		if err != nil {return err}
+	}
+
+	testCase := fmt.Sprintf("Reading the last version of chunk 0 %d times", NumReads371)
+	err = read_3_7_1(reader, fmt.Sprintf("version %d", NumWrites371))
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading its own last write back"
+	err = read_3_7_1(writer, fmt.Sprintf("version %d", NumWrites371))
+	loggerA.TestResult(testCase, err == nil)
+	return err
+}
+
+// read_3_7_1 reads chunk 0 of file NumReads371 times and checks that it holds content.
+func read_3_7_1(file dfslib.DFSFile, content string) error {
+	for i := 0; i < NumReads371; i++ {
+		var got dfslib.Chunk
+		err := file.Read(0, &got)
+		if err != nil {return err}
+		if got != chunk_3_7_1(content) {return fmt.Errorf("read back %q, expected %q", string(got[:]), content)}
+	}
+	return nil
+}
+
+// chunk_3_7_1 returns a chunk holding content.
+func chunk_3_7_1(content string) (blob dfslib.Chunk) {
+	copy(blob[:], content)
+	return blob
+}
@@ -0,0 +1,115 @@
+// Version-validated reads
+// Client B reads file F and unmounts. Client A writes F again, then B mounts again with
+// its old copy and reads A's new write. After A unmounts, B keeps reading its now
+// current copy.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const FileName381 = "381"
+
+func Test_3_8_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.8.1]")
+	fmt.Println("Versions - One writer client and one reader client")
+	fmt.Println("Client B's old copy of F is replaced by A's new write, and B's current copy is read while A is offline")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA381_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB381_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_8_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_8_1\n\n")
+	CleanDir("clientA381")
+	CleanDir("clientB381")
+	itwg.Done()
+}
+
+func clients_3_8_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	loggerA := NewLogger("(3.8.1) Client A (W)")
+	loggerB := NewLogger("(3.8.1) Client B (R)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+
+	testCase := "Writing the first version of chunk 0"
+	err = write_3_8_1(dfsA, "first version")
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+
+	err = readMount_3_8_1(serverAddr, localIP, localPathB, loggerB, "first version")
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+
+	testCase = "Writing the second version of chunk 0 while B is unmounted"
+	err = write_3_8_1(dfsA, "second version")
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+
+	err = readMount_3_8_1(serverAddr, localIP, localPathB, loggerB, "second version")
+	if err == nil {err = dfsA.UMountDFS()}
+	if err != nil {return err}
+	loggerA.TestResult("Unmounting DFS", true)
+
+	return readMount_3_8_1(serverAddr, localIP, localPathB, loggerB, "second version")
+}
+
+// write_3_8_1 writes content to chunk 0 of FileName381.
+func write_3_8_1(dfs dfslib.DFS, content string) error {
+	file, err := dfs.Open(FileName381, dfslib.WRITE)
+	if err != nil {return err}
+	blob := chunk_3_8_1(content)
+	err = file.Write(0, &blob)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readMount_3_8_1 mounts localPath, checks twice that chunk 0 of FileName381 holds
+// content and unmounts.
+func readMount_3_8_1(serverAddr, localIP, localPath string, logger testLogger, content string) error {
+	dfs, err := dfslib.MountDFS(serverAddr, localIP, localPath)
+	if err != nil {return err}
+	defer dfs.UMountDFS()
+
+	testCase := fmt.Sprintf("Reading the %s of chunk 0 twice", content)
+	file, err := dfs.Open(FileName381, dfslib.READ)
+	for i := 0; err == nil && i < 2; i++ {
+		var got dfslib.Chunk
+		err = file.Read(0, &got)
+		if err == nil && got != chunk_3_8_1(content) {
+			err = fmt.Errorf("read back %q, expected %q", string(got[:]), content)
+		}
+	}
+	if file != nil {file.Close()}
+	logger.TestResult(testCase, err == nil)
+	return err
+}
+
+// chunk_3_8_1 returns a chunk holding content.
+func chunk_3_8_1(content string) (blob dfslib.Chunk) {
+	copy(blob[:], content)
+	return blob
+}
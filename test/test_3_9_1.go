@@ -0,0 +1,140 @@
+// Write-back buffering
+// Client A writes several chunks of file F with buffering on, and reads its staged
+// writes back. Client B does not see them until A flushes. Later staged writes are
+// committed by Sync and Close, and a READ handle cannot be buffered.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const (
+	FileName391  = "391"
+	NumChunks391 = 5
+)
+
+func Test_3_9_1(serverAddr string, itwg *sync.WaitGroup) {
+	fmt.Println("[3.9.1]")
+	fmt.Println("Buffering - One buffered writer client and one reader client")
+	fmt.Println("Client A's buffered writes to F are seen by A at once, and by B once A flushes, syncs or closes F")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA391_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB391_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_3_9_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		itwg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_3_9_1\n\n")
+	CleanDir("clientA391")
+	CleanDir("clientB391")
+	itwg.Done()
+}
+
+func clients_3_9_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(3.9.1) Client A (W)")
+	loggerB := NewLogger("(3.9.1) Client B (R)")
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	writer, err := dfsA.Open(FileName391, dfslib.WRITE)
+	if err != nil {return err}
+	testCase := "Turning buffering on"
+	err = writer.SetBuffered(true)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Staging writes to chunks 0-%d", NumChunks391-1)
+	for chunkNum := uint8(0); err == nil && chunkNum < NumChunks391; chunkNum++ {
+		blob = chunk_3_9_1(fmt.Sprintf("chunk %d", chunkNum))
+		err = writer.Write(chunkNum, &blob)
+	}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading its own staged write back"
+	err = read_3_9_1(writer, 3, "chunk 3")
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	reader, err := dfsB.Open(FileName391, dfslib.READ)
+	if err != nil {return err}
+	defer reader.Close()
+	testCase = "Chunk 3 is still empty before A flushes"
+	err = read_3_9_1(reader, 3, "")
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Flushing the staged writes"
+	err = writer.Flush()
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Reading chunks 0-%d back after A flushed", NumChunks391-1)
+	for chunkNum := uint8(0); err == nil && chunkNum < NumChunks391; chunkNum++ {
+		err = read_3_9_1(reader, chunkNum, fmt.Sprintf("chunk %d", chunkNum))
+	}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	blob = chunk_3_9_1("committed by Sync")
+	err = writer.Write(4, &blob)
+	if err == nil {err = writer.Sync()}
+	loggerA.TestResult("Syncing a staged write", err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading the write committed by Sync"
+	err = read_3_9_1(reader, 4, "committed by Sync")
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	blob = chunk_3_9_1("committed by Close")
+	err = writer.Write(4, &blob)
+	if err == nil {err = writer.Close()}
+	loggerA.TestResult("Closing the file with a staged write", err == nil)
+	if err != nil {return err}
+
+	testCase = "Reading the write committed by Close"
+	err = read_3_9_1(reader, 4, "committed by Close")
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Turning buffering on for a READ handle fails"
+	err = reader.SetBuffered(true)
+	_, isBadMode := err.(dfslib.BadFileModeError)
+	loggerB.TestResult(testCase, isBadMode)
+	if !isBadMode {return fmt.Errorf("expected BadFileModeError, got %v", err)}
+	return nil
+}
+
+// read_3_9_1 checks that chunk chunkNum of file holds content.
+func read_3_9_1(file dfslib.DFSFile, chunkNum uint8, content string) error {
+	var got dfslib.Chunk
+	err := file.Read(chunkNum, &got)
+	if err != nil {return err}
+	if got != chunk_3_9_1(content) {
+		return fmt.Errorf("read back %q from chunk %d, expected %q", string(got[:]), chunkNum, content)
+	}
+	return nil
+}
+
+// chunk_3_9_1 returns a chunk holding content.
+func chunk_3_9_1(content string) (blob dfslib.Chunk) {
+	copy(blob[:], content)
+	return blob
+}
@@ -0,0 +1,100 @@
+// Chunk inventories (run the server without -data-dir)
+// Client A writes file F and unmounts. The server is restarted and forgets F. When A
+// mounts again its inventory brings F back, and client B reads A's write.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const FileName421 = "421"
+
+func Test_4_2_1(serverAddr string, wg *sync.WaitGroup) {
+	fmt.Println("[4.2.1]")
+	fmt.Println("Restart - One writer client and one reader client (server started without -data-dir)")
+	fmt.Println("Client A writes F, the server restarts, A mounts again and B reads A's write")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA421_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB421_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_4_2_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		wg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_4_2_1\n\n")
+	CleanDir("clientA421")
+	CleanDir("clientB421")
+	wg.Done()
+}
+
+func clients_4_2_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(4.2.1) Client A (W)")
+	loggerB := NewLogger("(4.2.1) Client B (R)")
+	content := "This is test 4.2.1!"
+
+	err = write_4_2_1(serverAddr, localIP, localPathA, content, loggerA)
+	if err != nil {return err}
+
+	for i := ServerShutdownTimer; i > 0; i-- {
+		fmt.Printf("RESTART SERVER NOW: [%d]\n", i)
+		time.Sleep(1 * time.Second)
+	}
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	loggerA.TestResult("Mounting DFS again after the restart", err == nil)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	testCase := fmt.Sprintf("File '%s' exists globally", FileName421)
+	exists, err := dfsB.GlobalFileExists(FileName421)
+	if err == nil && !exists {err = fmt.Errorf("expected file '%s' to exist globally", FileName421)}
+	loggerB.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = fmt.Sprintf("Reading '%s' back from chunk %d", content, CHUNKNUM)
+	file, err := dfsB.Open(FileName421, dfslib.READ)
+	if err != nil {return err}
+	defer file.Close()
+	err = file.Read(CHUNKNUM, &blob)
+	if err == nil && string(blob[:len(content)]) != content {
+		err = fmt.Errorf("read back %q, expected %q", string(blob[:len(content)]), content)
+	}
+	loggerB.TestResult(testCase, err == nil)
+	return err
+}
+
+// write_4_2_1 mounts localPath, writes content to chunk CHUNKNUM of FileName421 and unmounts.
+func write_4_2_1(serverAddr, localIP, localPath, content string, logger testLogger) (err error) {
+	var blob dfslib.Chunk
+	dfs, err := dfslib.MountDFS(serverAddr, localIP, localPath)
+	if err != nil {return err}
+
+	testCase := fmt.Sprintf("Writing chunk %d of file '%s'", CHUNKNUM, FileName421)
+	file, err := dfs.Open(FileName421, dfslib.WRITE)
+	if err == nil {
+		copy(blob[:], content)
+		err = file.Write(CHUNKNUM, &blob)
+		if closeErr := file.Close(); err == nil {err = closeErr}
+	}
+	logger.TestResult(testCase, err == nil)
+	if err != nil {
+		dfs.UMountDFS()
+		return err
+	}
+	return dfs.UMountDFS()
+}
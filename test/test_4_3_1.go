@@ -0,0 +1,90 @@
+// Server chunk store (run the server with -data-dir and -store-chunks)
+// Client A writes file F and unmounts. The server is restarted. Client B reads A's
+// write from the server's copy while A stays offline.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const FileName431 = "431"
+
+func Test_4_3_1(serverAddr string, wg *sync.WaitGroup) {
+	fmt.Println("[4.3.1]")
+	fmt.Println("Restart - One writer client and one reader client (server started with -store-chunks)")
+	fmt.Println("Client A writes F and goes offline, the server restarts, B reads A's write")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA431_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB431_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_4_3_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		wg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_4_3_1\n\n")
+	CleanDir("clientA431")
+	CleanDir("clientB431")
+	wg.Done()
+}
+
+func clients_4_3_1(serverAddr, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(4.3.1) Client A (W)")
+	loggerB := NewLogger("(4.3.1) Client B (R)")
+	content := "This is test 4.3.1!"
+
+	err = write_4_3_1(serverAddr, localIP, localPathA, content, loggerA)
+	if err != nil {return err}
+
+	for i := ServerShutdownTimer; i > 0; i-- {
+		fmt.Printf("RESTART SERVER NOW: [%d]\n", i)
+		time.Sleep(1 * time.Second)
+	}
+
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	loggerB.TestResult("Mounting DFS after the restart", err == nil)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	testCase := fmt.Sprintf("Reading '%s' back from chunk %d while A is offline", content, CHUNKNUM)
+	file, err := dfsB.Open(FileName431, dfslib.READ)
+	if err != nil {return err}
+	defer file.Close()
+	err = file.Read(CHUNKNUM, &blob)
+	if err == nil && string(blob[:len(content)]) != content {
+		err = fmt.Errorf("read back %q, expected %q", string(blob[:len(content)]), content)
+	}
+	loggerB.TestResult(testCase, err == nil)
+	return err
+}
+
+// write_4_3_1 mounts localPath, writes content to chunk CHUNKNUM of FileName431 and unmounts.
+func write_4_3_1(serverAddr, localIP, localPath, content string, logger testLogger) (err error) {
+	var blob dfslib.Chunk
+	dfs, err := dfslib.MountDFS(serverAddr, localIP, localPath)
+	if err != nil {return err}
+
+	testCase := fmt.Sprintf("Writing chunk %d of file '%s'", CHUNKNUM, FileName431)
+	file, err := dfs.Open(FileName431, dfslib.WRITE)
+	if err == nil {
+		copy(blob[:], content)
+		err = file.Write(CHUNKNUM, &blob)
+		if closeErr := file.Close(); err == nil {err = closeErr}
+	}
+	logger.TestResult(testCase, err == nil)
+	if err != nil {
+		dfs.UMountDFS()
+		return err
+	}
+	return dfs.UMountDFS()
+}
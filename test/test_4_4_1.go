@@ -0,0 +1,87 @@
+// Chunk replication (run the server with -replicas 2)
+// Client C is mounted but idle. Client A writes file F and unmounts. Client B reads
+// A's write from the replica the server pushed to C.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+)
+
+const FileName441 = "441"
+
+func Test_4_4_1(serverAddr string, wg *sync.WaitGroup) {
+	fmt.Println("[4.4.1]")
+	fmt.Println("Replication - One writer client, one reader client and one idle client (server started with -replicas 2)")
+	fmt.Println("Client A writes F and goes offline, B reads A's write from idle client C")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA441_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB441_")
+	clientCLocalPath, errC := ioutil.TempDir(".", "clientC441_")
+
+	if errA != nil || errB != nil || errC != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_4_4_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath, clientCLocalPath)
+	if err != nil {
+		wg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_4_4_1\n\n")
+	CleanDir("clientA441")
+	CleanDir("clientB441")
+	CleanDir("clientC441")
+	wg.Done()
+}
+
+func clients_4_4_1(serverAddr, localIP, localPathA, localPathB, localPathC string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(4.4.1) Client A (W)")
+	loggerB := NewLogger("(4.4.1) Client B (R)")
+	content := "This is test 4.4.1!"
+
+	dfsC, err := dfslib.MountDFS(serverAddr, localIP, localPathC)
+	if err != nil {return err}
+	defer dfsC.UMountDFS()
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	testCase := fmt.Sprintf("Writing chunk %d of file '%s'", CHUNKNUM, FileName441)
+	file, err := dfsA.Open(FileName441, dfslib.WRITE)
+	if err == nil {
+		copy(blob[:], content)
+		err = file.Write(CHUNKNUM, &blob)
+		if closeErr := file.Close(); err == nil {err = closeErr}
+	}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {
+		dfsA.UMountDFS()
+		return err
+	}
+	err = dfsA.UMountDFS()
+	loggerA.TestResult("Unmounting DFS", err == nil)
+	if err != nil {return err}
+
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	testCase = fmt.Sprintf("Reading '%s' back from chunk %d while A is offline", content, CHUNKNUM)
+	file, err = dfsB.Open(FileName441, dfslib.READ)
+	if err != nil {
+		loggerB.TestResult(testCase, false)
+		return err
+	}
+	defer file.Close()
+	blob = dfslib.Chunk{}
+	err = file.Read(CHUNKNUM, &blob)
+	if err == nil && string(blob[:len(content)]) != content {
+		err = fmt.Errorf("read back %q, expected %q", string(blob[:len(content)]), content)
+	}
+	loggerB.TestResult(testCase, err == nil)
+	return err
+}
@@ -0,0 +1,110 @@
+// Re-replication (run the server with -replicas 2)
+// Client A writes file F with idle client C holding the replica, and unmounts. Client D
+// mounts, and once the server has copied F to D, C unmounts as well. Client B reads
+// A's write from D.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const FileName451 = "451"
+// Longer than two of the server's repair passes
+const RepairWait451 = 4500 * time.Millisecond
+
+func Test_4_5_1(serverAddr string, wg *sync.WaitGroup) {
+	fmt.Println("[4.5.1]")
+	fmt.Println("Re-replication - One writer client, one reader client and two idle clients (server started with -replicas 2)")
+	fmt.Println("Client A writes F, A and then C go offline, B reads A's write from idle client D")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA451_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB451_")
+	clientCLocalPath, errC := ioutil.TempDir(".", "clientC451_")
+	clientDLocalPath, errD := ioutil.TempDir(".", "clientD451_")
+
+	if errA != nil || errB != nil || errC != nil || errD != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_4_5_1(serverAddr, LocalIP, clientALocalPath, clientBLocalPath, clientCLocalPath, clientDLocalPath)
+	if err != nil {
+		wg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_4_5_1\n\n")
+	CleanDir("clientA451")
+	CleanDir("clientB451")
+	CleanDir("clientC451")
+	CleanDir("clientD451")
+	wg.Done()
+}
+
+func clients_4_5_1(serverAddr, localIP, localPathA, localPathB, localPathC, localPathD string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(4.5.1) Client A (W)")
+	loggerB := NewLogger("(4.5.1) Client B (R)")
+	loggerC := NewLogger("(4.5.1) Client C")
+	content := "This is test 4.5.1!"
+
+	dfsC, err := dfslib.MountDFS(serverAddr, localIP, localPathC)
+	if err != nil {return err}
+
+	dfsA, err := dfslib.MountDFS(serverAddr, localIP, localPathA)
+	if err != nil {return err}
+	testCase := fmt.Sprintf("Writing chunk %d of file '%s'", CHUNKNUM, FileName451)
+	file, err := dfsA.Open(FileName451, dfslib.WRITE)
+	if err == nil {
+		copy(blob[:], content)
+		err = file.Write(CHUNKNUM, &blob)
+		if closeErr := file.Close(); err == nil {err = closeErr}
+	}
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {
+		dfsA.UMountDFS()
+		dfsC.UMountDFS()
+		return err
+	}
+	err = dfsA.UMountDFS()
+	loggerA.TestResult("Unmounting DFS", err == nil)
+	if err != nil {
+		dfsC.UMountDFS()
+		return err
+	}
+
+	dfsD, err := dfslib.MountDFS(serverAddr, localIP, localPathD)
+	if err != nil {
+		dfsC.UMountDFS()
+		return err
+	}
+	defer dfsD.UMountDFS()
+
+	// Give the server a repair pass to copy F to D
+	time.Sleep(RepairWait451)
+	err = dfsC.UMountDFS()
+	loggerC.TestResult("Unmounting DFS", err == nil)
+	if err != nil {return err}
+
+	dfsB, err := dfslib.MountDFS(serverAddr, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	testCase = fmt.Sprintf("Reading '%s' back from chunk %d while A is offline", content, CHUNKNUM)
+	file, err = dfsB.Open(FileName451, dfslib.READ)
+	if err != nil {
+		loggerB.TestResult(testCase, false)
+		return err
+	}
+	defer file.Close()
+	blob = dfslib.Chunk{}
+	err = file.Read(CHUNKNUM, &blob)
+	if err == nil && string(blob[:len(content)]) != content {
+		err = fmt.Errorf("read back %q, expected %q", string(blob[:len(content)]), content)
+	}
+	loggerB.TestResult(testCase, err == nil)
+	return err
+}
@@ -0,0 +1,96 @@
+// Primary/backup failover (run a standby at StandbyAddr461, and the server under test
+// with -backup StandbyAddr461)
+// Client A writes chunk 1 of file F through the primary, which is then shut down. A
+// writes chunk 2 through the standby. Client B reads both writes back.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const FileName461 = "461"
+const StandbyAddr461 = "127.0.0.1:8082"
+
+func Test_4_6_1(serverAddr string, wg *sync.WaitGroup) {
+	fmt.Println("[4.6.1]")
+	fmt.Println("Failover - One writer client and one reader client (server started with -backup " + StandbyAddr461 + ")")
+	fmt.Println("Client A writes F, the primary shuts down, A writes F again and B reads both writes")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA461_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB461_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_4_6_1(serverAddr+","+StandbyAddr461, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		wg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_4_6_1\n\n")
+	CleanDir("clientA461")
+	CleanDir("clientB461")
+	wg.Done()
+}
+
+func clients_4_6_1(serverAddrs, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(4.6.1) Client A (W)")
+	loggerB := NewLogger("(4.6.1) Client B (R)")
+	contents := []string{"", "Written to the primary", "Written to the standby"}
+
+	dfsA, err := dfslib.MountDFS(serverAddrs, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+
+	testCase := fmt.Sprintf("Opening file '%s' for writing", FileName461)
+	file, err := dfsA.Open(FileName461, dfslib.WRITE)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Writing chunk 1 through the primary"
+	copy(blob[:], contents[1])
+	err = file.Write(1, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	for i := ServerShutdownTimer; i > 0; i-- {
+		fmt.Printf("SHUT DOWN PRIMARY SERVER NOW: [%d]\n", i)
+		time.Sleep(1 * time.Second)
+	}
+
+	testCase = "Writing chunk 2 through the standby"
+	blob = dfslib.Chunk{}
+	copy(blob[:], contents[2])
+	err = file.Write(2, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+	err = file.Close()
+	if err != nil {return err}
+
+	dfsB, err := dfslib.MountDFS(serverAddrs, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	reader, err := dfsB.Open(FileName461, dfslib.READ)
+	if err != nil {return err}
+	defer reader.Close()
+	for chunkNum := uint8(1); chunkNum <= 2; chunkNum++ {
+		testCase = fmt.Sprintf("Reading '%s' back from chunk %d", contents[chunkNum], chunkNum)
+		blob = dfslib.Chunk{}
+		err = reader.Read(chunkNum, &blob)
+		content := contents[chunkNum]
+		if err == nil && string(blob[:len(content)]) != content {
+			err = fmt.Errorf("read back %q, expected %q", string(blob[:len(content)]), content)
+		}
+		loggerB.TestResult(testCase, err == nil)
+		if err != nil {return err}
+	}
+	return nil
+}
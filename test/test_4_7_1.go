@@ -0,0 +1,95 @@
+// Raft cluster (run three servers with -peers, the server under test and PeerAddrs471)
+// Client A writes chunk 1 of file F, then the leader is shut down. A writes chunk 2
+// through the new leader. Client B reads both writes back.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const FileName471 = "471"
+const PeerAddrs471 = "127.0.0.1:8082,127.0.0.1:8083"
+
+func Test_4_7_1(serverAddr string, wg *sync.WaitGroup) {
+	fmt.Println("[4.7.1]")
+	fmt.Println("Raft - One writer client and one reader client (three servers started with -peers)")
+	fmt.Println("Client A writes F, the leader shuts down, A writes F again and B reads both writes")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA471_")
+	clientBLocalPath, errB := ioutil.TempDir(".", "clientB471_")
+
+	if errA != nil || errB != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clients_4_7_1(serverAddr+","+PeerAddrs471, LocalIP, clientALocalPath, clientBLocalPath)
+	if err != nil {
+		wg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_4_7_1\n\n")
+	CleanDir("clientA471")
+	CleanDir("clientB471")
+	wg.Done()
+}
+
+func clients_4_7_1(serverAddrs, localIP, localPathA, localPathB string) (err error) {
+	var blob dfslib.Chunk
+	loggerA := NewLogger("(4.7.1) Client A (W)")
+	loggerB := NewLogger("(4.7.1) Client B (R)")
+	contents := []string{"", "Written to the old leader", "Written to the new leader"}
+
+	dfsA, err := dfslib.MountDFS(serverAddrs, localIP, localPathA)
+	if err != nil {return err}
+	defer dfsA.UMountDFS()
+
+	testCase := fmt.Sprintf("Opening file '%s' for writing", FileName471)
+	file, err := dfsA.Open(FileName471, dfslib.WRITE)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	testCase = "Writing chunk 1 through the old leader"
+	copy(blob[:], contents[1])
+	err = file.Write(1, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	for i := ServerShutdownTimer; i > 0; i-- {
+		fmt.Printf("SHUT DOWN THE LEADER NOW: [%d]\n", i)
+		time.Sleep(1 * time.Second)
+	}
+
+	testCase = "Writing chunk 2 through the new leader"
+	blob = dfslib.Chunk{}
+	copy(blob[:], contents[2])
+	err = file.Write(2, &blob)
+	loggerA.TestResult(testCase, err == nil)
+	if err != nil {return err}
+	err = file.Close()
+	if err != nil {return err}
+
+	dfsB, err := dfslib.MountDFS(serverAddrs, localIP, localPathB)
+	if err != nil {return err}
+	defer dfsB.UMountDFS()
+
+	reader, err := dfsB.Open(FileName471, dfslib.READ)
+	if err != nil {return err}
+	defer reader.Close()
+	for chunkNum := uint8(1); chunkNum <= 2; chunkNum++ {
+		testCase = fmt.Sprintf("Reading '%s' back from chunk %d", contents[chunkNum], chunkNum)
+		blob = dfslib.Chunk{}
+		err = reader.Read(chunkNum, &blob)
+		content := contents[chunkNum]
+		if err == nil && string(blob[:len(content)]) != content {
+			err = fmt.Errorf("read back %q, expected %q", string(blob[:len(content)]), content)
+		}
+		loggerB.TestResult(testCase, err == nil)
+		if err != nil {return err}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Lease lapse
+// Client A opens file F for writing and writes it. The server is shut down for longer
+// than A's lease, so A's next write fails with WriteModeTimeoutError without reaching
+// the server.
+
+package test
+
+import (
+	"io/ioutil"
+	"fmt"
+	"../dfslib"
+	"sync"
+	"time"
+)
+
+const FileName481 = "481"
+// Longer than the server's lease duration
+const LeaseWait481 = 6 * time.Second
+
+func Test_4_8_1(serverAddr string, wg *sync.WaitGroup) {
+	fmt.Println("[4.8.1]")
+	fmt.Println("Leases - One writer client")
+	fmt.Println("Client A writes F, the server shuts down, and A's lease lapses")
+	clientALocalPath, errA := ioutil.TempDir(".", "clientA481_")
+
+	if errA != nil {
+		panic("Could not create temporary directory")
+	}
+
+	err := clientA_4_8_1(serverAddr, LocalIP, clientALocalPath)
+	if err != nil {
+		wg.Done()
+		reportError(err)
+	}
+
+	fmt.Printf("\nALL TESTS PASSED: Test_4_8_1\n\n")
+	CleanDir("clientA481")
+	wg.Done()
+}
+
+func clientA_4_8_1(serverAddr, localIP, localPath string) (err error) {
+	var blob dfslib.Chunk
+	logger := NewLogger("(4.8.1) Client A (W)")
+	copy(blob[:], "This is test 4.8.1!")
+
+	dfs, err := dfslib.MountDFS(serverAddr, localIP, localPath)
+	if err != nil {return err}
+	defer dfs.UMountDFS()
+
+	testCase := fmt.Sprintf("Writing chunk %d of file '%s'", CHUNKNUM, FileName481)
+	file, err := dfs.Open(FileName481, dfslib.WRITE)
+	if err == nil {err = file.Write(CHUNKNUM, &blob)}
+	logger.TestResult(testCase, err == nil)
+	if err != nil {return err}
+
+	for i := ServerShutdownTimer; i > 0; i-- {
+		fmt.Printf("SHUT DOWN SERVER NOW: [%d]\n", i)
+		time.Sleep(1 * time.Second)
+	}
+	time.Sleep(LeaseWait481)
+
+	testCase = fmt.Sprintf("Writing chunk %d after the lease lapsed fails", CHUNKNUM)
+	err = file.Write(CHUNKNUM, &blob)
+	_, isTimeout := err.(dfslib.WriteModeTimeoutError)
+	logger.TestResult(testCase, isTimeout)
+	if !isTimeout {return fmt.Errorf("expected WriteModeTimeoutError, got %v", err)}
+	return nil
+}